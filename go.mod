@@ -14,13 +14,15 @@ require (
 	fornaxian.tech/log v0.0.0-20211102185326-552e9b1f8640
 	fornaxian.tech/pixeldrain_api_client v0.0.0-20240321144932-32993212d251
 	fornaxian.tech/util v0.0.0-20240305140022-c865b3d36a3f
+	github.com/BurntSushi/toml v1.4.0
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/microcosm-cc/bluemonday v1.0.26
 	github.com/russross/blackfriday/v2 v2.1.0
+	github.com/ulikunitz/xz v0.5.15
+	golang.org/x/image v0.18.0
 )
 
 require (
-	github.com/BurntSushi/toml v1.4.0 // indirect
 	github.com/aymerick/douceur v0.2.0 // indirect
 	github.com/gocql/gocql v1.6.0 // indirect
 	github.com/golang/snappy v0.0.4 // indirect
@@ -28,5 +30,6 @@ require (
 	github.com/hailocab/go-hostpool v0.0.0-20160125115350-e80d13ce29ed // indirect
 	golang.org/x/crypto v0.24.0 // indirect
 	golang.org/x/net v0.26.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
 	gopkg.in/inf.v0 v0.9.1 // indirect
 )
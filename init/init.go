@@ -27,7 +27,8 @@ api_socket_path       = ""
 session_cookie_domain = ""
 resource_dir          = "res"
 
-# Parse all the templates every time a request comes in
+# Watch the resource directory and parse the templates again when they change.
+# Open pages are reloaded automatically when a resource file changes
 debug_mode            = true
 
 # Create proxy listeners to forward all requests made to /api to
@@ -36,6 +37,66 @@ proxy_api_requests    = true
 
 # When this is true every request will return a maintainance HTML page
 maintenance_mode      = false
+
+# Maximum number of comma-separated file IDs which can be opened in the file
+# viewer at once. Every file is a separate API request, raise with care
+max_viewer_files      = 100
+
+# Directory where the link preview images of files and lists are stored. Leave
+# empty to render the images on every request
+card_cache_dir        = "card_cache"
+
+# Domain which hosted websites are served from, like pixeldrain.site. Shared
+# directories with website hosting enabled are served on
+# https://<sites_domain>/d/<id>. It must be a separate domain which does not get
+# the session cookies of session_cookie_domain. Leave empty to disable website
+# hosting
+sites_domain          = ""
+
+# User agents of the bots which fetch link previews for chat apps and social
+# media. They get a small page with only the metadata of a file, list or
+# directory. Matching is case-insensitive and on a part of the user agent
+crawler_user_agents   = [
+	"Discordbot",
+	"Twitterbot",
+	"Slackbot",
+	"TelegramBot",
+	"facebookexternalhit",
+	"WhatsApp",
+	"Mastodon",
+	"redditbot",
+	"LinkedInBot",
+	"SkypeUriPreview",
+	"vkShare",
+	"Embedly",
+]
+
+# User agents of download tools. These are redirected from the file viewer to
+# the file, from the list viewer to a zip file and from the filesystem to the
+# file or a zip of the directory. Matching works like crawler_user_agents
+download_user_agents  = [
+	"Wget/",
+	"curl/",
+	"aria2/",
+	"HTTPie/",
+	"PowerShell/",
+	"rclone/",
+]
+
+# API key of an admin account. This is used for reading the global settings of
+# the API, which are shown in the documentation. The key is only used by this
+# server, only a few public settings like max_file_size are shown. Leave empty
+# to disable
+admin_api_key         = ""
+
+# Rules for robots.txt. A link to the sitemap is added automatically. Leave
+# empty to use the default rules
+robots_txt            = """
+User-agent: *
+Disallow: /user
+Disallow: /admin
+Disallow: /search
+"""
 `
 
 // Init initializes the Pixeldrain Web UI controllers
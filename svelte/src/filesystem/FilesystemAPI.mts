@@ -74,6 +74,9 @@ export type NodeOptions = {
 	brand_header_image: string | undefined,
 	brand_header_link: string | undefined,
 	brand_background_image: string | undefined,
+
+	// Static website hosting
+	site_enabled: boolean | undefined,
 }
 
 // API methods
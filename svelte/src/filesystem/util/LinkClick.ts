@@ -0,0 +1,22 @@
+import type { FSNavigator } from "../FSNavigator"
+
+// Rendered documents link to other files with /d/ URLs. Those links are opened
+// with the navigator so the page doesn't have to reload. Links opened in a new
+// tab are left alone
+export const fs_link_click = (e: MouseEvent, nav: FSNavigator) => {
+	if (e.button !== 0 || e.ctrlKey || e.metaKey || e.shiftKey || e.altKey) {
+		return
+	}
+
+	const link = (e.target as HTMLElement).closest("a")
+	if (
+		link === null ||
+		link.origin !== window.location.origin ||
+		!link.pathname.startsWith("/d/")
+	) {
+		return
+	}
+
+	e.preventDefault()
+	nav.navigate(decodeURIComponent(link.pathname.substring(2)), true)
+}
@@ -0,0 +1,288 @@
+package webcontroller
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+	"fornaxian.tech/util"
+	"github.com/julienschmidt/httprouter"
+	"github.com/ulikunitz/xz"
+)
+
+// Archive listings show which files are in an archive without downloading it.
+// Zip archives have a central directory at the end of the file, which is read
+// with range requests. Tar archives don't have an index, the headers are spread
+// through the whole file. Uncompressed tar files are read with range requests
+// too so the contents of the files can be skipped. Compressed tar files have to
+// be decompressed from the start, so only the first part of those is listed
+const (
+	archiveMaxEntries = 5000     // Entries after this are not listed
+	archiveMaxRead    = 32 << 20 // Bytes read from the API for a single listing
+)
+
+// archiveExtensions and archiveMimeTypes map files to their archive format
+var (
+	archiveExtensions = map[string]string{
+		".zip":     "zip",
+		".tar":     "tar",
+		".tar.gz":  "tar.gz",
+		".tgz":     "tar.gz",
+		".tar.bz2": "tar.bz2",
+		".tbz2":    "tar.bz2",
+		".tbz":     "tar.bz2",
+		".tar.xz":  "tar.xz",
+		".txz":     "tar.xz",
+	}
+	archiveMimeTypes = map[string]string{
+		"application/zip":              "zip",
+		"application/x-zip-compressed": "zip",
+		"application/x-tar":            "tar",
+	}
+)
+
+func init() {
+	var archive = &previewRenderer{name: "archive", stream: true, render: previewArchive}
+	for ext := range archiveExtensions {
+		archive.extensions = append(archive.extensions, ext)
+	}
+	for mime := range archiveMimeTypes {
+		archive.mimeTypes = append(archive.mimeTypes, mime)
+	}
+	registerPreviewRenderer(archive)
+}
+
+// archiveFormat returns the archive format of a file, or an empty string if
+// the file is not an archive which can be listed
+func archiveFormat(file pixelapi.FileInfo) string {
+	var name = strings.ToLower(file.Name)
+	for ext, format := range archiveExtensions {
+		if strings.HasSuffix(name, ext) {
+			return format
+		}
+	}
+	var mimeType, _, _ = strings.Cut(file.MimeType, ";")
+	return archiveMimeTypes[strings.TrimSpace(mimeType)]
+}
+
+type archiveEntry struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Dir      bool      `json:"dir"`
+}
+
+type archiveListing struct {
+	Format  string         `json:"format"`
+	Entries []archiveEntry `json:"entries"`
+
+	// Number of entries in the archive and their total size. When the listing
+	// is truncated these only count the entries which were read
+	Total     int   `json:"total"`
+	TotalSize int64 `json:"total_size"`
+
+	// Truncated is true when the archive has more entries than are listed,
+	// because of the entry limit or the read limit
+	Truncated bool `json:"truncated"`
+}
+
+func (l *archiveListing) add(e archiveEntry) {
+	e.Name = strings.ToValidUTF8(e.Name, "\uFFFD")
+	l.Total++
+	l.TotalSize += e.Size
+	if len(l.Entries) < archiveMaxEntries {
+		l.Entries = append(l.Entries, e)
+	} else {
+		l.Truncated = true
+	}
+}
+
+// archiveResult is a cached archive listing. Archives which can't be listed
+// are cached too, so they aren't downloaded again on every request
+type archiveResult struct {
+	listing archiveListing
+	err     error
+}
+
+// getArchiveListing returns the listing of an archive. Files don't change, so
+// the listings are cached for a long time. Failed API requests are not cached
+func (wc *WebController) getArchiveListing(td *TemplateData, file pixelapi.FileInfo) (archiveListing, error) {
+	res, err := wc.cache.archive.get(file.ID, func() (archiveResult, error) {
+		listing, err := wc.listArchive(td, file)
+		if _, ok := err.(pixelapi.Error); ok || errors.Is(err, errAPIRequest) {
+			return archiveResult{}, err
+		}
+		return archiveResult{listing, err}, nil
+	})
+	if err != nil {
+		return archiveListing{}, err
+	}
+	return res.listing, res.err
+}
+
+func (wc *WebController) listArchive(td *TemplateData, file pixelapi.FileInfo) (listing archiveListing, err error) {
+	listing.Format = archiveFormat(file)
+
+	// The listing is shared by everyone who requests it at the same time, so
+	// it doesn't use the context of the request
+	var ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var ra = wc.newRangeReader(ctx, td, file, archiveMaxRead)
+
+	switch listing.Format {
+	case "zip":
+		err = listing.readZip(ra, file.Size)
+	case "tar":
+		err = listing.readTar(io.NewSectionReader(ra, 0, file.Size))
+	case "tar.gz", "tar.bz2", "tar.xz":
+		var body io.ReadCloser
+		if body, err = td.PixelAPI.GetFile(file.ID); err != nil {
+			return listing, err
+		}
+		defer body.Close()
+
+		var rd io.Reader = &limitReader{r: apiBody{body}, n: archiveMaxRead}
+		switch listing.Format {
+		case "tar.gz":
+			rd, err = gzip.NewReader(rd)
+		case "tar.bz2":
+			rd = bzip2.NewReader(rd)
+		case "tar.xz":
+			rd, err = xz.NewReader(rd)
+		}
+		if err != nil {
+			return listing, err
+		}
+		err = listing.readTar(rd)
+	default:
+		return listing, fmt.Errorf("file %s is not an archive", file.ID)
+	}
+	return listing, err
+}
+
+func (l *archiveListing) readZip(ra io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+		return err
+	}
+
+	for _, f := range zr.File {
+		var mod = f.Modified
+		if mod.IsZero() {
+			mod = f.ModTime()
+		}
+		l.add(archiveEntry{
+			Name:     f.Name,
+			Size:     int64(f.UncompressedSize64),
+			Modified: mod,
+			Dir:      f.FileInfo().IsDir(),
+		})
+	}
+	return nil
+}
+
+// readTar reads the headers of a tar archive. When the read limit is reached
+// the entries which were read so far are returned
+func (l *archiveListing) readTar(rd io.Reader) error {
+	var tr = tar.NewReader(rd)
+	for !l.Truncated {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			if l.Total > 0 && errors.Is(err, errPreviewTooLarge) {
+				l.Truncated = true
+				return nil
+			}
+			return err
+		}
+
+		l.add(archiveEntry{
+			Name:     hdr.Name,
+			Size:     hdr.Size,
+			Modified: hdr.ModTime,
+			Dir:      hdr.Typeflag == tar.TypeDir,
+		})
+	}
+	return nil
+}
+
+// previewArchive shows the entries of an archive as a table
+func previewArchive(wc *WebController, out *bytes.Buffer, r *http.Request, td *TemplateData, file pixelapi.FileInfo, body []byte) error {
+	listing, err := wc.getArchiveListing(td, file)
+	if err != nil {
+		return err
+	}
+
+	var t = func(key string, args ...any) string { return html.EscapeString(td.Locale.T(key, args...)) }
+	var size = func(n int64) string { return html.EscapeString(td.Locale.formatNumber(wc.templates.formatData(n))) }
+
+	out.WriteString(`<div class="preview_archive"><p>` + t("preview.archive.summary", listing.Total, size(listing.TotalSize)))
+	if listing.Truncated {
+		out.WriteString(" " + t("preview.archive.truncated", len(listing.Entries)))
+	}
+	out.WriteString(` <a href="/u/` + html.EscapeString(file.ID) + `/archive.json">JSON</a></p>`)
+
+	out.WriteString(`<div class="preview_table"><table><thead><tr><th>` + t("preview.archive.name") +
+		`</th><th>` + t("preview.archive.size") + `</th><th>` + t("preview.archive.modified") +
+		"</th></tr></thead><tbody>\n")
+	for _, e := range listing.Entries {
+		out.WriteString("<tr><td>" + html.EscapeString(e.Name) + "</td><td>")
+		if !e.Dir {
+			out.WriteString(size(e.Size))
+		}
+		out.WriteString("</td><td>")
+		if !e.Modified.IsZero() {
+			out.WriteString(html.EscapeString(td.Locale.formatDate(e.Modified)))
+		}
+		out.WriteString("</td></tr>\n")
+	}
+	out.WriteString("</tbody></table></div></div>\n")
+	return nil
+}
+
+// serveArchiveListing returns the listing of an archive as JSON
+func (wc *WebController) serveArchiveListing(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var td = wc.newTemplateData(w, r)
+	file, err := wc.getFileInfo(td, p.ByName("id"))
+	if err != nil {
+		wc.serveAPIError(w, r, td, err, "")
+		return
+	} else if archiveFormat(file) == "" {
+		var res = errorFor(http.StatusUnsupportedMediaType, nil)
+		res.value, res.message = "not_an_archive", "This file is not an archive which can be listed"
+		wc.serveError(w, r, td, res)
+		return
+	}
+
+	listing, err := wc.getArchiveListing(td, file)
+	if err != nil {
+		var res = errorFor(http.StatusUnprocessableEntity, err)
+		if errors.Is(err, errPreviewTooLarge) {
+			res.value, res.message = "archive_too_large", "The index of this archive is too large to read"
+		} else {
+			res.value, res.message = "archive_unreadable", "This archive could not be read"
+		}
+		wc.serveError(w, r, td, res)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	if err = json.NewEncoder(w).Encode(listing); err != nil && !util.IsNetError(err) {
+		log.Error("Failed to encode archive listing: %s", err)
+	}
+}
@@ -0,0 +1,340 @@
+package webcontroller
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+)
+
+// archiveTestServer serves a file with range requests like the API does. It
+// checks that the requests carry the credentials and the address of the
+// visitor
+func archiveTestServer(t *testing.T, data []byte) (wc *WebController, read *atomic.Int64) {
+	t.Helper()
+	read = new(atomic.Int64)
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, key, _ := r.BasicAuth(); key != "key" {
+			t.Errorf("request has API key %q", key)
+		}
+		if ip := r.Header.Get("X-Real-IP"); ip != "203.0.113.1" {
+			t.Errorf("request has real IP %q", ip)
+		}
+		if agent := r.UserAgent(); agent != "Test/1.0" {
+			t.Errorf("request has user agent %q", agent)
+		}
+		if r.Header.Get("Range") == "" {
+			t.Errorf("request for %s is not a range request", r.URL.Path)
+		}
+		var cw = &countingWriter{ResponseWriter: w, n: read}
+		http.ServeContent(cw, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(srv.Close)
+
+	return &WebController{
+		apiHTTPClient: srv.Client(),
+		config:        Config{APIURLInternal: srv.URL},
+	}, read
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n.Add(int64(len(p)))
+	return w.ResponseWriter.Write(p)
+}
+
+var archiveTestTD = &TemplateData{sessionKey: "key", realIP: "203.0.113.1", UserAgent: "Test/1.0"}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	var b = make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func testZip(t *testing.T, files map[string][]byte, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var zw = zip.NewWriter(&buf)
+	for _, name := range names {
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Store,
+			Modified: time.Date(2024, 5, 6, 7, 8, 10, 0, time.UTC),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testTar(t *testing.T, files map[string][]byte, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var tw = tar.NewWriter(&buf)
+	for _, name := range names {
+		var hdr = &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(files[name])),
+			ModTime: time.Date(2024, 5, 6, 7, 8, 10, 0, time.UTC),
+		}
+		if strings.HasSuffix(name, "/") {
+			hdr.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func checkListing(t *testing.T, l archiveListing, want []archiveEntry) {
+	t.Helper()
+	if len(l.Entries) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(l.Entries), len(want), l.Entries)
+	}
+	var size int64
+	for i, e := range want {
+		size += e.Size
+		if got := l.Entries[i]; got.Name != e.Name || got.Size != e.Size || got.Dir != e.Dir || !got.Modified.Equal(e.Modified) {
+			t.Errorf("entry %d is %+v, want %+v", i, got, e)
+		}
+	}
+	if l.Total != len(want) || l.TotalSize != size || l.Truncated {
+		t.Errorf("got total %d, size %d, truncated %t, want %d, %d, false", l.Total, l.TotalSize, l.Truncated, len(want), size)
+	}
+}
+
+var archiveTestFiles = map[string][]byte{
+	"dir/":          nil,
+	"dir/small.txt": []byte("hello"),
+}
+
+func archiveTestEntries(bigSize int64) []archiveEntry {
+	var mod = time.Date(2024, 5, 6, 7, 8, 10, 0, time.UTC)
+	return []archiveEntry{
+		{Name: "dir/", Modified: mod, Dir: true},
+		{Name: "dir/small.txt", Size: 5, Modified: mod},
+		{Name: "dir/big.bin", Size: bigSize, Modified: mod},
+		{Name: "last.txt", Size: 5, Modified: mod},
+	}
+}
+
+func TestArchiveZip(t *testing.T) {
+	var files = map[string][]byte{"dir/big.bin": randomBytes(t, 4<<20), "last.txt": []byte("world")}
+	for k, v := range archiveTestFiles {
+		files[k] = v
+	}
+	var data = testZip(t, files, "dir/", "dir/small.txt", "dir/big.bin", "last.txt")
+
+	var wc, read = archiveTestServer(t, data)
+	var file = pixelapi.FileInfo{ID: "test", Name: "test.zip", Size: int64(len(data))}
+	var l archiveListing
+	if err := l.readZip(wc.newRangeReader(context.Background(), archiveTestTD, file, archiveMaxRead), file.Size); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	checkListing(t, l, archiveTestEntries(4<<20))
+
+	// Only the central directory at the end of the file is downloaded
+	if n := read.Load(); n > 2*rangeBlockSize {
+		t.Errorf("read %d bytes of a %d byte archive", n, len(data))
+	}
+}
+
+func TestArchiveZipErrors(t *testing.T) {
+	var valid = testZip(t, archiveTestFiles, "dir/", "dir/small.txt")
+	for _, tt := range []struct {
+		name  string
+		data  []byte
+		limit int64
+	}{
+		{"not a zip", []byte(strings.Repeat("not a zip file ", 100)), archiveMaxRead},
+		{"empty", []byte{}, archiveMaxRead},
+		{"truncated central directory", valid[:len(valid)-30], archiveMaxRead},
+		{"corrupt end record", append(valid[:len(valid)-22:len(valid)-22], bytes.Repeat([]byte{0xff}, 22)...), archiveMaxRead},
+		{"read limit", valid, 10},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var wc, _ = archiveTestServer(t, tt.data)
+			var file = pixelapi.FileInfo{ID: "test", Size: int64(len(tt.data))}
+			var l archiveListing
+			err := l.readZip(wc.newRangeReader(context.Background(), archiveTestTD, file, tt.limit), file.Size)
+			if err == nil {
+				t.Fatalf("expected an error, got listing %+v", l)
+			}
+			if tt.limit < archiveMaxRead && !errors.Is(err, errPreviewTooLarge) {
+				t.Errorf("expected errPreviewTooLarge, got %s", err)
+			}
+		})
+	}
+}
+
+func TestArchiveZipEntryLimit(t *testing.T) {
+	var buf bytes.Buffer
+	var zw = zip.NewWriter(&buf)
+	for i := 0; i < archiveMaxEntries+10; i++ {
+		if _, err := zw.CreateHeader(&zip.FileHeader{Name: "f", Method: zip.Store}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var l archiveListing
+	if err := l.readZip(bytes.NewReader(buf.Bytes()), int64(buf.Len())); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(l.Entries) != archiveMaxEntries || l.Total != archiveMaxEntries+10 || !l.Truncated {
+		t.Errorf("got %d entries, total %d, truncated %t", len(l.Entries), l.Total, l.Truncated)
+	}
+}
+
+func TestArchiveTar(t *testing.T) {
+	var files = map[string][]byte{"dir/big.bin": randomBytes(t, 4<<20), "last.txt": []byte("world")}
+	for k, v := range archiveTestFiles {
+		files[k] = v
+	}
+	var data = testTar(t, files, "dir/", "dir/small.txt", "dir/big.bin", "last.txt")
+
+	var wc, read = archiveTestServer(t, data)
+	var file = pixelapi.FileInfo{ID: "test", Name: "test.tar", Size: int64(len(data))}
+	l, err := wc.listArchive(archiveTestTD, file)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if l.Format != "tar" {
+		t.Errorf("got format %q", l.Format)
+	}
+	checkListing(t, l, archiveTestEntries(4<<20))
+
+	// The contents of the big file are skipped
+	if n := read.Load(); n > 4*rangeBlockSize {
+		t.Errorf("read %d bytes of a %d byte archive", n, len(data))
+	}
+}
+
+func TestArchiveTarReadLimit(t *testing.T) {
+	var files = map[string][]byte{"a": randomBytes(t, 1000), "b": randomBytes(t, 3*rangeBlockSize), "c": nil}
+	var data = testTar(t, files, "a", "b", "c")
+
+	// The header of the last file is past the read limit, the files before it
+	// are listed
+	var wc, _ = archiveTestServer(t, data)
+	var file = pixelapi.FileInfo{ID: "test", Size: int64(len(data))}
+	var l archiveListing
+	var ra = wc.newRangeReader(context.Background(), archiveTestTD, file, rangeBlockSize)
+	if err := l.readTar(io.NewSectionReader(ra, 0, file.Size)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if l.Total != 2 || !l.Truncated {
+		t.Errorf("got %d entries, truncated %t, want 2 and true", l.Total, l.Truncated)
+	}
+
+	// If not even the first header could be read the archive can't be listed
+	ra = wc.newRangeReader(context.Background(), archiveTestTD, file, 0)
+	l = archiveListing{}
+	if err := l.readTar(io.NewSectionReader(ra, 0, file.Size)); !errors.Is(err, errPreviewTooLarge) {
+		t.Errorf("expected errPreviewTooLarge, got %v", err)
+	}
+}
+
+func TestArchiveTarErrors(t *testing.T) {
+	var valid = testTar(t, archiveTestFiles, "dir/", "dir/small.txt")
+	var corrupt = bytes.Clone(valid)
+	copy(corrupt[148:156], "garbage!") // Header checksum
+
+	for name, data := range map[string][]byte{
+		"not a tar":        []byte(strings.Repeat("not a tar file ", 100)),
+		"corrupt checksum": corrupt,
+		"truncated header": valid[:300],
+		"truncated data":   valid[:512+512+2],
+	} {
+		t.Run(name, func(t *testing.T) {
+			var l archiveListing
+			if err := l.readTar(bytes.NewReader(data)); err == nil {
+				t.Errorf("expected an error, got listing %+v", l)
+			}
+		})
+	}
+}
+
+func TestRangeReaderStatus(t *testing.T) {
+	// A server which ignores the range header would send the whole file
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("whole file"))
+	}))
+	defer srv.Close()
+
+	var wc = &WebController{apiHTTPClient: srv.Client(), config: Config{APIURLInternal: srv.URL}}
+	var ra = wc.newRangeReader(context.Background(), archiveTestTD, pixelapi.FileInfo{ID: "test", Size: 10}, archiveMaxRead)
+	if _, err := ra.ReadAt(make([]byte, 4), 0); err == nil {
+		t.Error("expected an error for a response without status 206")
+	}
+}
+
+func TestArchiveListingCache(t *testing.T) {
+	// An archive which can't be listed is not downloaded again
+	var wc, read = archiveTestServer(t, []byte(strings.Repeat("not a zip file ", 100)))
+	wc.cache = newAPICache()
+	var file = pixelapi.FileInfo{ID: "test", Name: "test.zip", Size: 1500}
+	for i := 0; i < 2; i++ {
+		if _, err := wc.getArchiveListing(archiveTestTD, file); err == nil || errors.Is(err, errAPIRequest) {
+			t.Fatalf("expected an archive error, got %v", err)
+		}
+		if i == 0 && read.Load() == 0 {
+			t.Fatal("archive was not read")
+		} else if i == 1 && read.Load() > 1500 {
+			t.Errorf("archive was read again, %d bytes in total", read.Load())
+		}
+	}
+
+	// Failed API requests are tried again
+	var requests atomic.Int64
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	wc = &WebController{apiHTTPClient: srv.Client(), config: Config{APIURLInternal: srv.URL}, cache: newAPICache()}
+	for i := 0; i < 2; i++ {
+		if _, err := wc.getArchiveListing(archiveTestTD, file); !errors.Is(err, errAPIRequest) {
+			t.Fatalf("expected errAPIRequest, got %v", err)
+		}
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("got %d requests, want 2", n)
+	}
+}
@@ -0,0 +1,118 @@
+package webcontroller
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"fornaxian.tech/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// assetManifest maps the files in the static resource directory to URLs which
+// contain a hash of the file contents. When a file changes its URL changes too,
+// so the hashed URLs can be cached by browsers forever
+type assetManifest struct {
+	// Asset path relative to the static dir (style/layout.css) to hashed URL
+	// (/res/style/layout.0123456789abcdef.css)
+	urls map[string]string
+
+	// Asset path to Subresource Integrity hash (sha384-...)
+	integrity map[string]string
+
+	// Hashed path (/style/layout.0123456789abcdef.css) to the path on disk
+	// (/style/layout.css)
+	hashed map[string]string
+}
+
+// buildAssetManifest hashes every file in the static resource directory
+func (tm *TemplateManager) buildAssetManifest() {
+	var m = &assetManifest{
+		urls:      make(map[string]string),
+		integrity: make(map[string]string),
+		hashed:    make(map[string]string),
+	}
+	var staticDir = filepath.Join(tm.resourceDir, "static")
+
+	if err := filepath.Walk(staticDir, func(file string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			return nil
+		}
+
+		fd, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+
+		var hasher = sha512.New384()
+		if _, err = io.Copy(hasher, fd); err != nil {
+			return err
+		}
+		var sum = hasher.Sum(nil)
+
+		rel, err := filepath.Rel(staticDir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		// The hash is inserted before the file extension so relative links
+		// in CSS and JS files keep working
+		var ext = path.Ext(rel)
+		var hashedPath = "/" + strings.TrimSuffix(rel, ext) + "." + hex.EncodeToString(sum[:8]) + ext
+
+		m.urls[rel] = "/res" + hashedPath
+		m.integrity[rel] = "sha384-" + base64.StdEncoding.EncodeToString(sum)
+		m.hashed[hashedPath] = "/" + rel
+		return nil
+	}); err != nil {
+		log.Error("Failed to build asset manifest: %s", err)
+	}
+
+	tm.assets.Store(m)
+}
+
+// asset returns the content-hashed URL of a static resource. The path is
+// relative to the static directory, like "style/layout.css"
+func (tm *TemplateManager) asset(name string) string {
+	if u, ok := tm.assets.Load().urls[strings.TrimPrefix(name, "/")]; ok {
+		return u
+	}
+	// The file is not in the manifest, this can happen in debug mode when the
+	// file was added after the last scan. Fall back to the cache ID
+	log.Debug("Asset not found in manifest: %s", name)
+	return "/res/" + strings.TrimPrefix(name, "/") + "?v" + strconv.FormatInt(cacheID, 10)
+}
+
+// assetIntegrity returns the Subresource Integrity hash of a static resource
+func (tm *TemplateManager) assetIntegrity(name string) string {
+	return tm.assets.Load().integrity[strings.TrimPrefix(name, "/")]
+}
+
+// serveResource serves the static resources. Content-hashed URLs can be cached
+// forever, the plain URLs only get a short cache time because they can change
+// on every deploy
+func (wc *WebController) serveResource(fs http.Handler) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		var file = p.ByName("filepath")
+		if orig, ok := wc.templates.assets.Load().hashed[file]; ok {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+			file = orig
+		} else {
+			w.Header().Set("Cache-Control", "public, max-age=600")
+		}
+		r.URL.Path = file
+		fs.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,285 @@
+package webcontroller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+	"github.com/julienschmidt/httprouter"
+)
+
+// lookupCache is a small in-process cache for API responses. Concurrent
+// lookups for the same key are coalesced into a single backend request. When
+// the backend fails, an expired entry may still be served for a grace period
+// so that a short API outage doesn't take the whole website down with it
+type lookupCache[V any] struct {
+	ttl      time.Duration // How long an entry is considered fresh
+	grace    time.Duration // How long after expiry an entry may be served on errors
+	maxItems int           // Upper bound on the number of entries in the cache
+
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry[V]
+	inflight map[string]*cacheCall[V]
+
+	stats cacheStats
+}
+
+type cacheEntry[V any] struct {
+	val     V
+	fetched time.Time
+}
+
+type cacheCall[V any] struct {
+	done chan struct{}
+	val  V
+	err  error
+}
+
+type cacheStats struct {
+	Hits      atomic.Uint64
+	Misses    atomic.Uint64
+	Coalesced atomic.Uint64
+	Stale     atomic.Uint64
+	Evictions atomic.Uint64
+}
+
+func newLookupCache[V any](ttl, grace time.Duration, maxItems int) *lookupCache[V] {
+	return &lookupCache[V]{
+		ttl:      ttl,
+		grace:    grace,
+		maxItems: maxItems,
+		entries:  make(map[string]*cacheEntry[V]),
+		inflight: make(map[string]*cacheCall[V]),
+	}
+}
+
+// errCacheFetchPanic is returned to the callers which were waiting for a fetch
+// which panicked
+var errCacheFetchPanic = errors.New("cache fetch panicked")
+
+// get returns the cached value for key. If there is no fresh value the fetch
+// function is called. Only one fetch per key will be running at any time, other
+// callers wait for the running fetch to complete and share its result
+func (c *lookupCache[V]) get(key string, fetch func() (V, error)) (V, error) {
+	c.mu.Lock()
+	var entry, cached = c.entries[key]
+	if cached && time.Since(entry.fetched) < c.ttl {
+		c.mu.Unlock()
+		c.stats.Hits.Add(1)
+		return entry.val, nil
+	}
+
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		c.stats.Coalesced.Add(1)
+		<-call.done
+		return call.val, call.err
+	}
+
+	var call = &cacheCall[V]{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mu.Unlock()
+	c.stats.Misses.Add(1)
+
+	var completed bool
+	defer func() {
+		if !completed {
+			// The fetch function panicked. The waiting callers get an error
+			// instead of blocking forever, the panic continues in this caller
+			c.mu.Lock()
+			delete(c.inflight, key)
+			c.mu.Unlock()
+			call.err = errCacheFetchPanic
+			close(call.done)
+		}
+	}()
+	call.val, call.err = fetch()
+	completed = true
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if call.err == nil {
+		c.store(key, call.val)
+	} else if cached && errIsBackendFailure(call.err) &&
+		time.Since(entry.fetched) < c.ttl+c.grace {
+		// The backend is having trouble, serve the old value until it
+		// recovers or the grace period runs out
+		log.Debug("Serving stale cache entry for '%s': %s", key, call.err)
+		c.stats.Stale.Add(1)
+		call.val, call.err = entry.val, nil
+	}
+	c.mu.Unlock()
+
+	close(call.done)
+	return call.val, call.err
+}
+
+// store saves a value in the cache. The caller must hold the lock
+func (c *lookupCache[V]) store(key string, val V) {
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxItems {
+		// The cache is full. First try to make room by removing entries which
+		// are past their grace period. If that doesn't free up anything we
+		// drop a random entry, map iteration order is random in Go
+		for k, v := range c.entries {
+			if time.Since(v.fetched) > c.ttl+c.grace {
+				delete(c.entries, k)
+				c.stats.Evictions.Add(1)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.maxItems {
+				break
+			}
+			delete(c.entries, k)
+			c.stats.Evictions.Add(1)
+		}
+	}
+
+	c.entries[key] = &cacheEntry[V]{val: val, fetched: time.Now()}
+}
+
+// peek returns the cached value for key if it is fresh, without fetching it
+func (c *lookupCache[V]) peek(key string) (val V, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, cached := c.entries[key]; cached && time.Since(entry.fetched) < c.ttl {
+		c.stats.Hits.Add(1)
+		return entry.val, true
+	}
+	return val, false
+}
+
+// invalidate removes a key from the cache
+func (c *lookupCache[V]) invalidate(key string) {
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.mu.Unlock()
+}
+
+func (c *lookupCache[V]) metrics() map[string]uint64 {
+	c.mu.Lock()
+	var entries = len(c.entries)
+	c.mu.Unlock()
+
+	return map[string]uint64{
+		"entries":   uint64(entries),
+		"hits":      c.stats.Hits.Load(),
+		"misses":    c.stats.Misses.Load(),
+		"coalesced": c.stats.Coalesced.Load(),
+		"stale":     c.stats.Stale.Load(),
+		"evictions": c.stats.Evictions.Load(),
+	}
+}
+
+// errIsBackendFailure returns true if the error was not caused by the request,
+// but by the API being unreachable or broken
+func errIsBackendFailure(err error) bool {
+	if _, ok := err.(pixelapi.Error); ok {
+		return pixelapi.ErrIsServerError(err)
+	}
+	return true
+}
+
+// apiCache holds the caches for the API lookups which are done on nearly every
+// page view
+type apiCache struct {
+	// User info keyed by session key
+	user *lookupCache[pixelapi.UserInfo]
+
+	// These are only used for anonymous requests, authenticated users can get
+	// different responses depending on their permissions
+	file   *lookupCache[pixelapi.FileInfo]
+	list   *lookupCache[pixelapi.ListInfo]
+	fsPath *lookupCache[pixelapi.FilesystemPath]
+
+	// Global settings of the API, used for showing limits in the docs
+	globals *lookupCache[map[string]string]
+
+	// Archive listings keyed by file ID. Files can't be changed, so these are
+	// kept for a long time
+	archive *lookupCache[archiveResult]
+
+	// Video dimensions keyed by file ID, or by filesystem path and
+	// modification date
+	videoSize *lookupCache[videoSize]
+
+	// Image dimensions keyed by file ID
+	imageSize *lookupCache[imageSize]
+
+	// Rendered preview cards keyed by the card key. When cards are stored in
+	// the card cache directory this only coalesces the renders
+	card *lookupCache[[]byte]
+}
+
+func newAPICache() *apiCache {
+	return &apiCache{
+		user:   newLookupCache[pixelapi.UserInfo](time.Second*10, time.Minute*5, 10000),
+		file:   newLookupCache[pixelapi.FileInfo](time.Second*30, time.Minute*5, 10000),
+		list:   newLookupCache[pixelapi.ListInfo](time.Second*30, time.Minute*5, 1000),
+		fsPath: newLookupCache[pixelapi.FilesystemPath](time.Second*10, time.Minute*5, 1000),
+
+		globals: newLookupCache[map[string]string](time.Minute, time.Hour, 1),
+		archive: newLookupCache[archiveResult](time.Hour, time.Hour, 100),
+
+		videoSize: newLookupCache[videoSize](time.Hour, time.Hour, 10000),
+		imageSize: newLookupCache[imageSize](time.Hour, time.Hour, 10000),
+		card:      newLookupCache[[]byte](time.Hour, time.Hour, 100),
+	}
+}
+
+func (wc *WebController) getFileInfo(td *TemplateData, id string) (pixelapi.FileInfo, error) {
+	if td.sessionKey != "" {
+		return td.PixelAPI.GetFileInfo(id)
+	}
+	return wc.cache.file.get(id, func() (pixelapi.FileInfo, error) {
+		return td.PixelAPI.GetFileInfo(id)
+	})
+}
+
+func (wc *WebController) getListID(td *TemplateData, id string) (pixelapi.ListInfo, error) {
+	if td.sessionKey != "" {
+		return td.PixelAPI.GetListID(id)
+	}
+	return wc.cache.list.get(id, func() (pixelapi.ListInfo, error) {
+		return td.PixelAPI.GetListID(id)
+	})
+}
+
+func (wc *WebController) getFilesystemPath(td *TemplateData, path string) (pixelapi.FilesystemPath, error) {
+	if td.sessionKey != "" {
+		return td.PixelAPI.GetFilesystemPath(path)
+	}
+	return wc.cache.fsPath.get(path, func() (pixelapi.FilesystemPath, error) {
+		return td.PixelAPI.GetFilesystemPath(path)
+	})
+}
+
+func (wc *WebController) serveCacheStats(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var td = wc.newTemplateData(w, r)
+	if !td.Authenticated || !td.User.IsAdmin {
+		wc.serveForbidden(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	var enc = json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(map[string]map[string]uint64{
+		"user":            wc.cache.user.metrics(),
+		"file":            wc.cache.file.metrics(),
+		"list":            wc.cache.list.metrics(),
+		"filesystem_path": wc.cache.fsPath.metrics(),
+		"globals":         wc.cache.globals.metrics(),
+		"archive":         wc.cache.archive.metrics(),
+		"video_size":      wc.cache.videoSize.metrics(),
+		"image_size":      wc.cache.imageSize.metrics(),
+		"card":            wc.cache.card.metrics(),
+	}); err != nil {
+		log.Error("Failed to encode cache stats: %s", err)
+	}
+}
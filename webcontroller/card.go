@@ -0,0 +1,446 @@
+package webcontroller
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"fornaxian.tech/log"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Cards are the images shown in link previews for files which don't have a
+// useful thumbnail, like documents and archives. They are rendered once and
+// stored in the card cache directory. The file name of a card is a hash of
+// everything on it, so a card is rendered again when the file is renamed or
+// the branding changes
+const (
+	cardWidth    = 1200
+	cardHeight   = 630
+	cardMargin   = 80
+	cardIconSize = 240
+	cardMaxAge   = 7 * 24 * time.Hour // Cards which were not used for this long are removed
+	cardVersion  = "1"                // Increase to render all cards again after changing the layout
+)
+
+// cardIcons maps mime type prefixes to the icons in res/static/img/mime. The
+// first match is used
+var cardIcons = []struct{ prefix, icon string }{
+	{"image/", "photo"},
+	{"video/", "video"},
+	{"audio/", "audio"},
+	{"text/", "text"},
+	{"font/", "font"},
+	{"application/pdf", "pdf"},
+	{"application/zip", "archive"},
+	{"application/x-7z", "archive"},
+	{"application/x-rar", "archive"},
+	{"application/vnd.rar", "archive"},
+	{"application/x-tar", "archive"},
+	{"application/gzip", "archive"},
+	{"application/x-bzip", "archive"},
+	{"application/x-xz", "archive"},
+	{"application/msword", "ms-word"},
+	{"application/vnd.openxmlformats-officedocument.wordprocessingml", "ms-word"},
+	{"application/vnd.oasis.opendocument.text", "textdocument"},
+	{"application/vnd.ms-excel", "spreadsheet"},
+	{"application/vnd.openxmlformats-officedocument.spreadsheetml", "spreadsheet"},
+	{"application/vnd.oasis.opendocument.spreadsheet", "spreadsheet"},
+	{"application/vnd.ms-powerpoint", "presentation"},
+	{"application/vnd.openxmlformats-officedocument.presentationml", "presentation"},
+	{"application/vnd.oasis.opendocument.presentation", "presentation"},
+	{"application/x-python", "python"},
+	{"application/x-sh", "terminal"},
+	{"application/json", "text"},
+}
+
+// cardFonts are the font faces for drawing a card. Faces are not safe for
+// concurrent use, so every card gets its own
+type cardFonts struct {
+	title    font.Face
+	subtitle font.Face
+	footer   font.Face
+}
+
+var (
+	cardFontsOnce sync.Once
+	cardBold      *opentype.Font
+	cardRegular   *opentype.Font
+	cardFontsErr  error
+)
+
+// newCardFonts creates the faces for drawing a card. The Go fonts are compiled
+// into the binary, they're only parsed once
+func newCardFonts() (fonts cardFonts, err error) {
+	cardFontsOnce.Do(func() {
+		if cardBold, cardFontsErr = opentype.Parse(gobold.TTF); cardFontsErr == nil {
+			cardRegular, cardFontsErr = opentype.Parse(goregular.TTF)
+		}
+	})
+	if cardFontsErr != nil {
+		return fonts, cardFontsErr
+	}
+
+	var face = func(f *opentype.Font, size float64) font.Face {
+		if err != nil {
+			return nil
+		}
+		var fc font.Face
+		fc, err = opentype.NewFace(f, &opentype.FaceOptions{
+			Size:    size,
+			DPI:     72,
+			Hinting: font.HintingFull,
+		})
+		return fc
+	}
+	fonts.title = face(cardBold, 64)
+	fonts.subtitle = face(cardRegular, 40)
+	fonts.footer = face(cardBold, 44)
+	return fonts, err
+}
+
+// card is the content of a preview card
+type card struct {
+	Title    string
+	Subtitle string
+	Icon     string // Name of the icon in res/static/img/mime
+	Theme    string
+	Hue      int
+}
+
+// key returns the cache key of a card, which changes when anything on the card
+// changes
+func (c card) key() string {
+	var sum = sha256.Sum256([]byte(strings.Join([]string{
+		cardVersion, c.Title, c.Subtitle, c.Icon, c.Theme, strconv.Itoa(c.Hue),
+	}, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// cardIcon returns the icon for a mime type
+func cardIcon(mimeType string) string {
+	for _, ci := range cardIcons {
+		if strings.HasPrefix(mimeType, ci.prefix) {
+			return ci.icon
+		}
+	}
+	return "application"
+}
+
+// cardBranding returns the theme and hue from the branding of a file
+func cardBranding(branding map[string]string) (theme string, hue int) {
+	hue = -1
+	if branding != nil {
+		theme = branding["theme"]
+		if h, err := strconv.Atoi(branding["hue"]); err == nil {
+			hue = h
+		}
+	}
+	return theme, hue
+}
+
+// setCard replaces the image of a link preview with a preview card
+func (og *ogData) setCard(cardURL string) {
+	og.MetaPropRules = filterProps(og.MetaPropRules, func(k string) bool { return strings.HasPrefix(k, "og:image") })
+	og.MetaNameRules = filterProps(og.MetaNameRules, func(k string) bool { return k == "twitter:card" || k == "twitter:image" })
+	og.LinkRules = filterProps(og.LinkRules, func(k string) bool { return k == "image_src" })
+
+	og.addProp("og:image", cardURL)
+	og.addProp("og:image:url", cardURL)
+	og.addProp("og:image:secure_url", cardURL)
+	og.addProp("og:image:type", "image/png")
+	og.addProp("og:image:width", strconv.Itoa(cardWidth))
+	og.addProp("og:image:height", strconv.Itoa(cardHeight))
+	og.addName("twitter:card", "summary_large_image")
+	og.addName("twitter:image", cardURL)
+	og.addLink("image_src", cardURL)
+}
+
+// useCard returns true if a file should get a preview card. Images, videos and
+// audio files have their own previews
+func useCard(mimeType string) bool {
+	return !strings.HasPrefix(mimeType, "image/") &&
+		!strings.HasPrefix(mimeType, "video/") &&
+		!strings.HasPrefix(mimeType, "audio/")
+}
+
+func (wc *WebController) serveFileCard(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var td = wc.newTemplateData(w, r)
+	file, err := wc.getFileInfo(td, p.ByName("id"))
+	if err != nil {
+		wc.serveAPIError(w, r, td, err, "")
+		return
+	} else if file.AbuseType != "" {
+		wc.serveError(w, r, td, errorFor(http.StatusUnavailableForLegalReasons, nil))
+		return
+	}
+
+	var c = card{
+		Title: file.Name,
+		Subtitle: td.Locale.formatNumber(wc.templates.formatData(file.Size)) +
+			" · " + file.MimeType,
+		Icon: cardIcon(file.MimeType),
+	}
+	c.Theme, c.Hue = cardBranding(file.Branding)
+	wc.serveCard(w, r, c)
+}
+
+func (wc *WebController) serveListCard(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var td = wc.newTemplateData(w, r)
+	list, err := wc.getListID(td, p.ByName("id"))
+	if err != nil {
+		wc.serveAPIError(w, r, td, err, "")
+		return
+	}
+	for _, file := range list.Files {
+		if file.AbuseType != "" {
+			wc.serveError(w, r, td, errorFor(http.StatusUnavailableForLegalReasons, nil))
+			return
+		}
+	}
+
+	var size int64
+	for _, f := range list.Files {
+		size += f.Size
+	}
+	var c = card{
+		Title: list.Title,
+		Subtitle: td.Locale.T("card.list_files", list.FileCount) +
+			" · " + td.Locale.formatNumber(wc.templates.formatData(size)),
+		Icon: "folder",
+	}
+	if len(list.Files) > 0 {
+		c.Theme, c.Hue = cardBranding(list.Files[0].Branding)
+	}
+	wc.serveCard(w, r, c)
+}
+
+// serveCard sends a card from the cache, or renders it if it's not cached yet.
+// Link previews of a popular file are requested by many chat clients at once,
+// concurrent renders of the same card are coalesced by the card cache. Without
+// a cache directory the rendered cards are kept in memory for a while
+func (wc *WebController) serveCard(w http.ResponseWriter, r *http.Request, c card) {
+	var key = c.key()
+	if wc.config.CardCacheDir == "" {
+		png, err := wc.cache.card.get(key, func() ([]byte, error) {
+			var buf bytes.Buffer
+			err := wc.renderCard(&buf, c)
+			return buf.Bytes(), err
+		})
+		if err != nil {
+			wc.serveError(w, r, nil, errorFor(http.StatusInternalServerError, err))
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		http.ServeContent(w, r, key+".png", time.Time{}, bytes.NewReader(png))
+		return
+	}
+
+	var file = filepath.Join(wc.config.CardCacheDir, key+".png")
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		if _, err = wc.cache.card.get(key, func() ([]byte, error) {
+			return nil, wc.writeCard(file, c)
+		}); err != nil {
+			wc.serveError(w, r, nil, errorFor(http.StatusInternalServerError, err))
+			return
+		}
+	} else {
+		// The modification time is used to clean up cards which are not
+		// used anymore
+		var now = time.Now()
+		os.Chtimes(file, now, now)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		wc.serveError(w, r, nil, errorFor(http.StatusInternalServerError, err))
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		wc.serveError(w, r, nil, errorFor(http.StatusInternalServerError, err))
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, file, info.ModTime(), f)
+}
+
+// writeCard renders a card to a temporary file and moves it in place, so a
+// card which is being written is never served
+func (wc *WebController) writeCard(file string, c card) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".card_*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = wc.renderCard(tmp, c); err != nil {
+		tmp.Close()
+		return err
+	} else if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// cleanCardCache removes cards which have not been requested for a while
+func (wc *WebController) cleanCardCache() {
+	for {
+		entries, err := os.ReadDir(wc.config.CardCacheDir)
+		if err != nil {
+			log.Error("Failed to read card cache: %s", err)
+		}
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > cardMaxAge {
+				if err = os.Remove(filepath.Join(wc.config.CardCacheDir, entry.Name())); err != nil {
+					log.Warn("Failed to remove card: %s", err)
+				}
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// renderCard draws a card and encodes it as PNG
+func (wc *WebController) renderCard(w io.Writer, c card) error {
+	fonts, err := newCardFonts()
+	if err != nil {
+		return err
+	}
+
+	def, _, _, customHue := styleSheets(c.Theme)
+	if customHue && c.Hue >= 0 && c.Hue <= 360 {
+		def = def.withHue(c.Hue)
+	}
+	def = def.withDefaults()
+
+	var rgb = func(c Color) color.Color {
+		var v = c.RGB()
+		return color.RGBA{v.R, v.G, v.B, 255}
+	}
+	var (
+		background = rgb(def.BodyColor)
+		text       = rgb(def.BodyText)
+		dimmed     = rgb(def.BodyText.Add(0, 0, (def.BodyColor.Lightness-def.BodyText.Lightness)*.35))
+		highlight  = rgb(def.Highlight)
+	)
+
+	var img = image.NewRGBA(image.Rect(0, 0, cardWidth, cardHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+
+	// Bar in the highlight colour at the bottom of the card
+	draw.Draw(img, image.Rect(0, cardHeight-16, cardWidth, cardHeight), image.NewUniform(highlight), image.Point{}, draw.Src)
+
+	// The icon is scaled up, they're only 100 pixels in size
+	var iconRect = image.Rect(cardMargin, cardMargin, cardMargin+cardIconSize, cardMargin+cardIconSize)
+	if icon, err := wc.loadCardIcon(c.Icon); err != nil {
+		log.Warn("Failed to load card icon %s: %s", c.Icon, err)
+	} else {
+		draw.CatmullRom.Scale(img, iconRect, icon, icon.Bounds(), draw.Over, nil)
+	}
+
+	var textX = iconRect.Max.X + cardMargin/2
+	var textWidth = cardWidth - textX - cardMargin
+	var y = cardMargin + fonts.title.Metrics().Ascent.Ceil()
+	for _, line := range wrapText(fonts.title, c.Title, textWidth, 3) {
+		drawText(img, fonts.title, text, textX, y, line)
+		y += fonts.title.Metrics().Height.Ceil()
+	}
+
+	y += fonts.subtitle.Metrics().Height.Ceil() / 2
+	for _, line := range wrapText(fonts.subtitle, c.Subtitle, textWidth, 2) {
+		drawText(img, fonts.subtitle, dimmed, textX, y, line)
+		y += fonts.subtitle.Metrics().Height.Ceil()
+	}
+
+	drawText(img, fonts.footer, highlight, cardMargin, cardHeight-cardMargin, "pixeldrain")
+
+	return png.Encode(w, img)
+}
+
+func (wc *WebController) loadCardIcon(name string) (image.Image, error) {
+	f, err := os.Open(filepath.Join(wc.config.ResourceDir, "static", "img", "mime", name+".png"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+func drawText(dst draw.Image, face font.Face, c color.Color, x, y int, s string) {
+	var d = font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(c),
+		Face: face,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(s)
+}
+
+// wrapText breaks text into lines which fit in width. File names often don't
+// have spaces, so lines are broken at punctuation or in the middle of words if
+// needed. If the text does not fit in maxLines the last line is shortened
+// with an ellipsis
+func wrapText(face font.Face, s string, width, maxLines int) (lines []string) {
+	var limit = fixed.I(width)
+	for s != "" {
+		if font.MeasureString(face, s) <= limit {
+			return append(lines, s)
+		}
+
+		if len(lines) == maxLines-1 {
+			// Last line, cut the text and add an ellipsis
+			for s != "" && font.MeasureString(face, s+"…") > limit {
+				_, size := utf8.DecodeLastRuneInString(s)
+				s = s[:len(s)-size]
+			}
+			return append(lines, s+"…")
+		}
+
+		// Find the longest prefix which fits, then go back to the last
+		// separator in that prefix if there is one
+		var end = 0
+		for i, r := range s {
+			var next = i + utf8.RuneLen(r)
+			if font.MeasureString(face, s[:next]) > limit {
+				break
+			}
+			end = next
+		}
+		if end == 0 {
+			_, end = utf8.DecodeRuneInString(s)
+		}
+		if sep := strings.LastIndexAny(s[:end], " _-.,"); sep > end/2 {
+			end = sep + 1
+		}
+
+		lines = append(lines, strings.TrimRight(s[:end], " "))
+		s = strings.TrimLeft(s[end:], " ")
+	}
+	return lines
+}
+
+// cardURL returns the URL of the preview card of a file or list
+func cardURL(addr, kind, id string) string {
+	return fmt.Sprintf("%s/%s/%s/card.png", addr, kind, id)
+}
@@ -0,0 +1,49 @@
+package webcontroller
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestRenderCardParallel renders different cards at the same time, run it with
+// -race to check that the font faces are not shared
+func TestRenderCardParallel(t *testing.T) {
+	var wc = &WebController{config: Config{ResourceDir: "../res"}}
+	var cards []card
+	for i := 0; i < 8; i++ {
+		cards = append(cards, card{
+			Title:    fmt.Sprintf("Card number %d with a title which is long enough to be wrapped", i),
+			Subtitle: fmt.Sprintf("%d MB · %d views", i, i*100),
+			Icon:     []string{"image", "video", "audio", "archive"}[i%4],
+		})
+	}
+
+	// Reference images, rendered one by one
+	var want = make([][]byte, len(cards))
+	for i, c := range cards {
+		var buf bytes.Buffer
+		if err := wc.renderCard(&buf, c); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		want[i] = buf.Bytes()
+	}
+
+	var wg sync.WaitGroup
+	for round := 0; round < 4; round++ {
+		for i, c := range cards {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var buf bytes.Buffer
+				if err := wc.renderCard(&buf, c); err != nil {
+					t.Errorf("unexpected error: %s", err)
+				} else if !bytes.Equal(buf.Bytes(), want[i]) {
+					t.Errorf("card %d is different when rendered in parallel", i)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,113 @@
+package webcontroller
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/util"
+	"github.com/julienschmidt/httprouter"
+)
+
+// crawlerMaxAge is how long link previews can be cached, in seconds. Bots and
+// the CDN in front of us can cache the page because it doesn't contain
+// anything specific to the visitor
+const crawlerMaxAge = "600"
+
+type crawlerPage struct {
+	Title       string
+	Description string
+	URL         string
+	Image       string
+}
+
+// isCrawler returns true if the request comes from a bot which fetches pages
+// to show a link preview. These only need the metadata of a page
+func (wc *WebController) isCrawler(r *http.Request) bool {
+	return userAgentMatches(r.UserAgent(), wc.crawlerAgents)
+}
+
+// newCrawlerTemplateData returns template data for an anonymous visitor. The
+// response is cached, so session cookies are ignored and the user is not
+// looked up
+func (wc *WebController) newCrawlerTemplateData(r *http.Request) *TemplateData {
+	return &TemplateData{
+		tpm:         wc.templates,
+		UserAgent:   r.UserAgent(),
+		realIP:      util.RemoteAddress(r),
+		APIEndpoint: template.URL(wc.config.APIURLExternal),
+		PixelAPI:    wc.api.RealIP(util.RemoteAddress(r)).RealAgent(r.UserAgent()),
+		Hostname:    template.HTML(wc.hostname),
+		URLQuery:    r.URL.Query(),
+		Locale:      wc.templates.localeFromRequest(r),
+	}
+}
+
+// serveCrawlerPage serves a page with only the link preview metadata
+func (wc *WebController) serveCrawlerPage(w http.ResponseWriter, r *http.Request, td *TemplateData, og ogData) {
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	w.Header().Set("Cache-Control", "public, max-age="+crawlerMaxAge)
+	// The page is translated with the locale from the cookie or the
+	// Accept-Language header
+	w.Header().Add("Vary", "User-Agent, Accept-Language, Cookie")
+
+	td.Title = og.prop("og:title")
+	td.OGData = og
+	td.Other = crawlerPage{
+		Title:       og.prop("og:title"),
+		Description: og.prop("og:description"),
+		URL:         og.prop("og:url"),
+		Image:       og.prop("og:image"),
+	}
+	if err := wc.templates.Run(w, r, "crawler", td); err != nil && !util.IsNetError(err) {
+		log.Error("Error executing template crawler: %s", err)
+	}
+}
+
+// serveFileCrawler serves the link preview of a file. When there are multiple
+// file IDs in the URL the preview is of the first file, like in the viewer
+func (wc *WebController) serveFileCrawler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var td = wc.newCrawlerTemplateData(r)
+	file, err := wc.getFileInfo(td, strings.Split(p.ByName("id"), ",")[0])
+	if err != nil {
+		wc.serveAPIError(w, r, td, err, "file_not_found")
+		return
+	} else if file.AbuseType != "" {
+		wc.serveError(w, r, td, errorFor(http.StatusUnavailableForLegalReasons, nil))
+		return
+	}
+
+	wc.serveCrawlerPage(w, r, td, wc.metadataFromFile(r, td, file))
+}
+
+func (wc *WebController) serveListCrawler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var td = wc.newCrawlerTemplateData(r)
+	list, err := wc.getListID(td, p.ByName("id"))
+	if err != nil {
+		wc.serveAPIError(w, r, td, err, "list_not_found")
+		return
+	}
+	for _, file := range list.Files {
+		if file.AbuseType != "" {
+			wc.serveError(w, r, td, errorFor(http.StatusUnavailableForLegalReasons, nil))
+			return
+		}
+	}
+
+	wc.serveCrawlerPage(w, r, td, wc.metadataFromList(r, list))
+}
+
+func (wc *WebController) serveFilesystemCrawler(w http.ResponseWriter, r *http.Request, path string) {
+	var td = wc.newCrawlerTemplateData(r)
+	node, err := wc.getFilesystemPath(td, path)
+	if err != nil {
+		wc.serveAPIError(w, r, td, err, "")
+		return
+	} else if wc.redirectToSite(w, r, node) {
+		// Sites have their own metadata
+		return
+	}
+
+	wc.serveCrawlerPage(w, r, td, wc.metadataFromFilesystem(r, td, node))
+}
@@ -0,0 +1,177 @@
+package webcontroller
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+	"fornaxian.tech/util"
+)
+
+// errorResponse describes how an error is shown to the user
+type errorResponse struct {
+	status   int                                   // HTTP status code
+	template string                                // Template for HTML clients
+	value    string                                // Error code for JSON clients
+	message  string                                // Error message for JSON clients
+	log      func(format string, v ...interface{}) // Log function for the error level
+	err      error                                 // The error which was classified, may be nil
+}
+
+// classifyError maps an error returned by the pixeldrain API to the response
+// which should be sent to the client. Client errors are logged at debug level,
+// server errors at error level
+func classifyError(err error) (res errorResponse) {
+	res = errorResponse{
+		status:   http.StatusInternalServerError,
+		template: "500",
+		value:    "internal",
+		message:  "An internal server error occurred",
+		log:      log.Error,
+		err:      err,
+	}
+
+	apiErr, ok := err.(pixelapi.Error)
+	if !ok {
+		// The API client refuses to request URLs with control characters in
+		// them. Those can't exist, so it's a 404
+		if err != nil && strings.HasSuffix(err.Error(), "invalid control character in URL") {
+			return errorFor(http.StatusNotFound, err)
+		}
+		return res
+	}
+
+	switch apiErr.StatusCode {
+	case "not_found", "path_not_found":
+		res = errorFor(http.StatusNotFound, err)
+	case "forbidden", "permission_denied":
+		res = errorFor(http.StatusForbidden, err)
+	case "authentication_required", "authentication_failed":
+		res = errorFor(http.StatusUnauthorized, err)
+	case "unavailable_for_legal_reasons":
+		res = errorFor(http.StatusUnavailableForLegalReasons, err)
+	default:
+		switch {
+		case apiErr.Status >= 500 || apiErr.Status == 0:
+			return res
+		case apiErr.Status == http.StatusNotFound,
+			apiErr.Status == http.StatusForbidden,
+			apiErr.Status == http.StatusUnauthorized,
+			apiErr.Status == http.StatusUnavailableForLegalReasons:
+			res = errorFor(apiErr.Status, err)
+		default:
+			// A client error we don't have a page for. This is probably a
+			// bug in the web server, so it's logged as a warning
+			res = errorFor(apiErr.Status, err)
+			res.template, res.log = "500", log.Warn
+		}
+	}
+
+	res.value, res.message = apiErr.StatusCode, apiErr.Message
+	return res
+}
+
+// errorFor returns the default response for an HTTP status code
+func errorFor(status int, err error) errorResponse {
+	var res = errorResponse{
+		status:  status,
+		value:   strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_"),
+		message: http.StatusText(status),
+		log:     log.Debug,
+		err:     err,
+	}
+
+	switch status {
+	case http.StatusForbidden:
+		res.template = "403"
+	case http.StatusNotFound:
+		res.template = "404"
+	case http.StatusUnavailableForLegalReasons:
+		res.template = "451"
+	case http.StatusUnauthorized:
+		res.template = "" // HTML clients are sent to the login page
+	default:
+		res.template = "500"
+		if status >= 500 {
+			res.log = log.Error
+		}
+	}
+	return res
+}
+
+// wantsJSON returns true if the client prefers a JSON response over HTML.
+// Errors on JSON endpoints are always sent as JSON
+func wantsJSON(r *http.Request) bool {
+	if strings.HasSuffix(r.URL.Path, ".json") {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			return true
+		case "text/html", "application/xhtml+xml":
+			return false
+		}
+	}
+	return false
+}
+
+// serveAPIError classifies an error from the API and sends the response. The
+// notFound template replaces the 404 page if it's not empty, some pages have
+// their own not found message
+func (wc *WebController) serveAPIError(
+	w http.ResponseWriter,
+	r *http.Request,
+	td *TemplateData,
+	err error,
+	notFound string,
+) {
+	var res = classifyError(err)
+	if res.status == http.StatusNotFound && notFound != "" {
+		res.template = notFound
+	}
+	wc.serveError(w, r, td, res)
+}
+
+// serveError sends an error response. JSON clients get the error code and
+// message, HTML clients get the error page
+func (wc *WebController) serveError(w http.ResponseWriter, r *http.Request, td *TemplateData, res errorResponse) {
+	if res.err != nil {
+		res.log("%d %s: %s", res.status, r.URL, res.err)
+	} else {
+		res.log("%d %s", res.status, r.URL)
+	}
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(res.status)
+		if err := json.NewEncoder(w).Encode(map[string]any{
+			"success": false,
+			"value":   res.value,
+			"message": res.message,
+		}); err != nil && !util.IsNetError(err) {
+			log.Error("Failed to encode error response: %s", err)
+		}
+		return
+	}
+
+	if res.status == http.StatusUnauthorized {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if td == nil {
+		td = wc.newTemplateData(w, r)
+	}
+	w.WriteHeader(res.status)
+	if err := wc.templates.Run(w, r, res.template, td); err != nil && !util.IsNetError(err) {
+		log.Error("Error executing template '%s': %s", res.template, err)
+	}
+}
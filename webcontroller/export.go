@@ -0,0 +1,284 @@
+package webcontroller
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+	"fornaxian.tech/util"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Lists and directories can be exported as playlists and as input files for
+// download managers, which can resume large downloads. The format is chosen
+// with the format parameter on the viewer URL. Directories are not exported
+// recursively, only the files directly in the directory are included
+type exportFormat struct {
+	contentType string
+	extension   string
+	mediaOnly   bool // Playlists only contain audio and video files
+	write       func(w io.Writer, e export) error
+}
+
+var exportFormats = map[string]exportFormat{
+	"m3u8":     {"application/vnd.apple.mpegurl", ".m3u8", true, writeM3U8},
+	"xspf":     {"application/xspf+xml", ".xspf", true, writeXSPF},
+	"metalink": {"application/metalink4+xml", ".meta4", false, writeMetalink},
+	"aria2":    {"text/plain; charset=utf-8", ".aria2", false, writeAria2},
+	"urls":     {"text/plain; charset=utf-8", ".txt", false, writeURLList},
+}
+
+type export struct {
+	Title string
+	Link  string // Page of the list or directory
+	Files []exportFile
+}
+
+type exportFile struct {
+	Name     string
+	URL      string // Direct download link on the API
+	Image    string // Thumbnail, only used in playlists
+	Size     int64
+	MimeType string
+	SHA256   string
+}
+
+func isMedia(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "audio/") || strings.HasPrefix(mimeType, "video/")
+}
+
+func (wc *WebController) serveListExport(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var td = wc.newTemplateData(w, r)
+	list, err := wc.getListID(td, p.ByName("id"))
+	if err != nil {
+		wc.serveAPIError(w, r, td, err, "list_not_found")
+		return
+	}
+
+	var addr = getRequestAddress(r)
+	var e = export{Title: list.Title, Link: addr + "/l/" + list.ID}
+	for _, file := range list.Files {
+		if file.AbuseType != "" {
+			continue // Blocked files can't be downloaded
+		}
+		e.Files = append(e.Files, exportFile{
+			Name:     file.Name,
+			URL:      addr + "/api/file/" + file.ID,
+			Image:    addr + "/api/file/" + file.ID + "/thumbnail",
+			Size:     file.Size,
+			MimeType: file.MimeType,
+			SHA256:   file.HashSHA256,
+		})
+	}
+
+	wc.serveExport(w, r, td, e)
+}
+
+func (wc *WebController) serveFilesystemExport(
+	w http.ResponseWriter,
+	r *http.Request,
+	td *TemplateData,
+	fsPath pixelapi.FilesystemPath,
+) {
+	var addr = getRequestAddress(r)
+	var base = fsPath.Path[fsPath.BaseIndex]
+	var e = export{Title: base.Name, Link: addr + "/d" + fsEscapePath(base.Path)}
+
+	// A file is exported as a list with only that file
+	var nodes = fsPath.Children
+	if base.Type == "file" {
+		nodes = []pixelapi.FilesystemNode{base}
+	}
+	for _, node := range nodes {
+		if node.Type != "file" || node.AbuseType != "" {
+			continue
+		}
+		e.Files = append(e.Files, exportFile{
+			Name:     node.Name,
+			URL:      addr + "/api/filesystem" + fsEscapePath(node.Path),
+			Image:    addr + "/api/filesystem" + fsEscapePath(node.Path) + "?thumbnail",
+			Size:     node.FileSize,
+			MimeType: node.FileType,
+			SHA256:   node.SHA256Sum,
+		})
+	}
+
+	wc.serveExport(w, r, td, e)
+}
+
+func (wc *WebController) serveExport(w http.ResponseWriter, r *http.Request, td *TemplateData, e export) {
+	var name = r.URL.Query().Get("format")
+	var format, ok = exportFormats[name]
+	if !ok {
+		var res = errorFor(http.StatusBadRequest, nil)
+		res.value, res.message = "unknown_format", "Supported formats are m3u8, xspf, metalink, aria2 and urls"
+		wc.serveError(w, r, td, res)
+		return
+	}
+
+	if format.mediaOnly {
+		var media []exportFile
+		for _, f := range e.Files {
+			if isMedia(f.MimeType) {
+				media = append(media, f)
+			}
+		}
+		e.Files = media
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(
+		"attachment", map[string]string{"filename": exportName(e.Title) + format.extension},
+	))
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	var buf = bufio.NewWriter(w)
+	var err = format.write(buf, e)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err != nil && !util.IsNetError(err) {
+		log.Error("Failed to write %s export: %s", name, err)
+	}
+}
+
+// exportName makes a name safe for use as a file name. The names of files in
+// lists can contain anything
+func exportName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || r == '/' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+	if name = strings.TrimSpace(name); name == "" || name == "." || name == ".." {
+		return "pixeldrain"
+	}
+	return name
+}
+
+// uniqueNames returns safe and unique file names for the files in an export.
+// Lists can contain files with the same name, download managers would
+// overwrite them
+func uniqueNames(files []exportFile) []string {
+	var names = make([]string, len(files))
+	var seen = make(map[string]bool, len(files))
+	for i, f := range files {
+		var name = exportName(f.Name)
+		var ext = path.Ext(name)
+		for n := 2; seen[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(exportName(f.Name), ext), n, ext)
+		}
+		seen[strings.ToLower(name)] = true
+		names[i] = name
+	}
+	return names
+}
+
+func writeM3U8(w io.Writer, e export) error {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#PLAYLIST:" + exportName(e.Title) + "\n")
+	for _, f := range e.Files {
+		// Duration is unknown
+		b.WriteString("#EXTINF:-1," + exportName(f.Name) + "\n")
+		b.WriteString(f.URL + "\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeXSPF(w io.Writer, e export) error {
+	type track struct {
+		Location string `xml:"location"`
+		Title    string `xml:"title"`
+		Image    string `xml:"image,omitempty"`
+	}
+	var playlist = struct {
+		XMLName xml.Name `xml:"http://xspf.org/ns/0/ playlist"`
+		Version string   `xml:"version,attr"`
+		Title   string   `xml:"title"`
+		Info    string   `xml:"info"`
+		Tracks  []track  `xml:"trackList>track"`
+	}{Version: "1", Title: e.Title, Info: e.Link}
+
+	for _, f := range e.Files {
+		playlist.Tracks = append(playlist.Tracks, track{Location: f.URL, Title: f.Name, Image: f.Image})
+	}
+	return encodeExportXML(w, playlist)
+}
+
+// writeMetalink writes a Metalink 4 file, RFC 5854. The hashes let download
+// managers verify the files after resuming
+func writeMetalink(w io.Writer, e export) error {
+	type hash struct {
+		Type  string `xml:"type,attr"`
+		Value string `xml:",chardata"`
+	}
+	type file struct {
+		Name string `xml:"name,attr"`
+		Size int64  `xml:"size"`
+		Hash *hash  `xml:"hash,omitempty"`
+		URL  string `xml:"url"`
+	}
+	var metalink = struct {
+		XMLName   xml.Name `xml:"urn:ietf:params:xml:ns:metalink metalink"`
+		Generator string   `xml:"generator"`
+		Files     []file   `xml:"file"`
+	}{Generator: "pixeldrain"}
+
+	for i, name := range uniqueNames(e.Files) {
+		var f = file{Name: name, Size: e.Files[i].Size, URL: e.Files[i].URL}
+		if e.Files[i].SHA256 != "" {
+			f.Hash = &hash{Type: "sha-256", Value: e.Files[i].SHA256}
+		}
+		metalink.Files = append(metalink.Files, f)
+	}
+	return encodeExportXML(w, metalink)
+}
+
+// writeAria2 writes an input file for aria2's --input-file option. The options
+// of a download are on the indented lines below its URL
+func writeAria2(w io.Writer, e export) error {
+	var b strings.Builder
+	for i, name := range uniqueNames(e.Files) {
+		b.WriteString(e.Files[i].URL + "\n")
+		b.WriteString("  out=" + name + "\n")
+		if e.Files[i].SHA256 != "" {
+			b.WriteString("  checksum=sha-256=" + e.Files[i].SHA256 + "\n")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeURLList(w io.Writer, e export) error {
+	var b strings.Builder
+	for _, f := range e.Files {
+		b.WriteString(f.URL + "\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func encodeExportXML(w io.Writer, v any) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	var enc = xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
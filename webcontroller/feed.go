@@ -0,0 +1,401 @@
+package webcontroller
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+	"fornaxian.tech/util"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Lists and directories can be subscribed to with a feed reader or a podcast
+// app. Feeds with audio or video files are RSS feeds with the iTunes podcast
+// extensions, because podcast apps don't support Atom. Other feeds are Atom
+// feeds. The format can be chosen with format=atom or format=rss on lists and
+// with feed=atom or feed=rss on directories
+const (
+	feedMaxEntries      = 500
+	feedContentTypeAtom = "application/atom+xml"
+	feedContentTypeRSS  = "application/rss+xml"
+
+	// Feedly's extension for the colour and logo of a feed
+	webfeedsNamespace = "http://webfeeds.org/rss/1.0"
+	itunesNamespace   = "http://www.itunes.com/dtds/podcast-1.0.dtd"
+)
+
+// feed is a list or directory which can be written as an Atom or RSS feed
+type feed struct {
+	Title       string
+	Description string
+	Link        string // Page of the list or directory
+	FeedURL     string
+	Image       string
+	Colour      string
+	Author      string
+	AuthorURL   string
+	Entries     []feedEntry
+}
+
+type feedEntry struct {
+	Title       string
+	Description string
+	Link        string // Page of the file
+	Download    string
+	Size        int64
+	MimeType    string
+	Date        time.Time
+}
+
+// updated returns the date of the newest entry
+func (f *feed) updated() (t time.Time) {
+	for _, e := range f.Entries {
+		if e.Date.After(t) {
+			t = e.Date
+		}
+	}
+	return t
+}
+
+// isPodcast returns true if the feed contains audio or video files
+func (f *feed) isPodcast() bool {
+	for _, e := range f.Entries {
+		if isMedia(e.MimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// feedType returns the content type of the feed in the requested format
+func (f *feed) feedType(format string) string {
+	if format == "rss" || (format != "atom" && f.isPodcast()) {
+		return feedContentTypeRSS
+	}
+	return feedContentTypeAtom
+}
+
+// setAuthor uses the header link from the branding as the author of the feed
+func (f *feed) setAuthor(link string) {
+	f.Author = "pixeldrain"
+	if u, err := url.Parse(link); err == nil && link != "" && (u.Scheme == "http" || u.Scheme == "https") {
+		f.Author, f.AuthorURL = u.Host, u.String()
+	}
+}
+
+func (wc *WebController) listFeed(r *http.Request, list pixelapi.ListInfo) (f feed) {
+	var addr = getRequestAddress(r)
+	f = feed{
+		Title:       list.Title,
+		Description: wc.templates.localeFromRequest(r).T("og.list_description"),
+		Link:        addr + "/l/" + list.ID,
+		FeedURL:     addr + "/l/" + list.ID + "/feed.xml",
+		Image:       addr + "/api/list/" + list.ID + "/thumbnail",
+		Colour:      defaultThemeColour,
+	}
+
+	var branding map[string]string
+	if len(list.Files) > 0 {
+		branding = list.Files[0].Branding
+	}
+	if branding["header_image"] != "" {
+		f.Image = addr + "/api/file/" + branding["header_image"]
+	}
+	if theme, hue := cardBranding(branding); theme != "" || hue >= 0 {
+		def, _, _, customHue := styleSheets(theme)
+		if customHue && hue >= 0 && hue <= 360 {
+			def = def.withHue(hue)
+		}
+		f.Colour = def.withDefaults().Highlight.CSS()
+	}
+	f.setAuthor(branding["header_link"])
+
+	for _, file := range list.Files[:min(len(list.Files), feedMaxEntries)] {
+		f.Entries = append(f.Entries, feedEntry{
+			Title:       file.Name,
+			Description: file.Description,
+			Link:        addr + "/u/" + file.ID,
+			Download:    addr + "/api/file/" + file.ID,
+			Size:        file.Size,
+			MimeType:    file.MimeType,
+			Date:        file.DateUpload,
+		})
+	}
+	return f
+}
+
+// filesystemFeed returns a feed of the files in a directory, newest first
+func (wc *WebController) filesystemFeed(r *http.Request, fsPath pixelapi.FilesystemPath) (f feed) {
+	var addr = getRequestAddress(r)
+	var base = fsPath.Path[fsPath.BaseIndex]
+	var branding = fsBranding(fsPath.Path)
+	f = feed{
+		Title:       base.Name,
+		Description: wc.templates.localeFromRequest(r).T("og.directory_description"),
+		Link:        addr + "/d" + fsEscapePath(base.Path),
+		FeedURL:     addr + "/d" + fsEscapePath(base.Path) + "?feed",
+		Image:       addr + "/res/img/pixeldrain_256.png",
+		Colour:      defaultThemeColour,
+	}
+	if branding["brand_header_image"] != "" {
+		f.Image = addr + "/api/filesystem/" + branding["brand_header_image"]
+	}
+	if branding["brand_highlight_color"] != "" {
+		f.Colour = branding["brand_highlight_color"]
+	}
+	f.setAuthor(branding["brand_header_link"])
+
+	var files []pixelapi.FilesystemNode
+	for _, node := range fsPath.Children {
+		if node.Type == "file" && node.AbuseType == "" {
+			files = append(files, node)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Modified.After(files[j].Modified) })
+
+	for _, node := range files[:min(len(files), feedMaxEntries)] {
+		f.Entries = append(f.Entries, feedEntry{
+			Title:    node.Name,
+			Link:     addr + "/d" + fsEscapePath(node.Path),
+			Download: addr + "/api/filesystem" + fsEscapePath(node.Path),
+			Size:     node.FileSize,
+			MimeType: node.FileType,
+			Date:     node.Modified,
+		})
+	}
+	return f
+}
+
+func (wc *WebController) serveListFeed(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var td = wc.newTemplateData(w, r)
+	list, err := wc.getListID(td, p.ByName("id"))
+	if err != nil {
+		wc.serveAPIError(w, r, td, err, "list_not_found")
+		return
+	}
+	for _, file := range list.Files {
+		if file.AbuseType != "" {
+			wc.serveError(w, r, td, errorFor(http.StatusUnavailableForLegalReasons, nil))
+			return
+		}
+	}
+
+	writeFeed(w, r, wc.listFeed(r, list), r.URL.Query().Get("format"))
+}
+
+func (wc *WebController) serveFilesystemFeed(
+	w http.ResponseWriter,
+	r *http.Request,
+	td *TemplateData,
+	fsPath pixelapi.FilesystemPath,
+) {
+	if fsPath.Path[fsPath.BaseIndex].Type != "dir" {
+		var res = errorFor(http.StatusNotFound, nil)
+		res.value, res.message = "not_a_directory", "Only directories have a feed"
+		wc.serveError(w, r, td, res)
+		return
+	} else if fsPath.Path[fsPath.BaseIndex].AbuseType != "" {
+		wc.serveError(w, r, td, errorFor(http.StatusUnavailableForLegalReasons, nil))
+		return
+	}
+
+	writeFeed(w, r, wc.filesystemFeed(r, fsPath), r.URL.Query().Get("feed"))
+}
+
+func writeFeed(w http.ResponseWriter, r *http.Request, f feed, format string) {
+	// The self link points at the format which was requested
+	f.FeedURL = getRequestAddress(r) + r.URL.RequestURI()
+
+	var v any
+	var contentType = f.feedType(format)
+	if contentType == feedContentTypeRSS {
+		v = f.rss()
+	} else {
+		v = f.atom()
+	}
+
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	w.Write([]byte(xml.Header))
+	var enc = xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(v); err != nil && !util.IsNetError(err) {
+		log.Error("Failed to encode feed: %s", err)
+	}
+}
+
+type atomFeed struct {
+	XMLName     xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	WebfeedsNS  string      `xml:"xmlns:webfeeds,attr"`
+	ID          string      `xml:"id"`
+	Title       string      `xml:"title"`
+	Subtitle    string      `xml:"subtitle"`
+	Updated     string      `xml:"updated"`
+	Links       []atomLink  `xml:"link"`
+	Author      atomAuthor  `xml:"author"`
+	Generator   string      `xml:"generator"`
+	Logo        string      `xml:"logo,omitempty"`
+	AccentColor string      `xml:"webfeeds:accentColor,omitempty"`
+	Entries     []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published"`
+	Summary   string     `xml:"summary,omitempty"`
+	Links     []atomLink `xml:"link"`
+}
+
+func (f *feed) atom() (af atomFeed) {
+	af = atomFeed{
+		WebfeedsNS:  webfeedsNamespace,
+		ID:          f.Link,
+		Title:       f.Title,
+		Subtitle:    f.Description,
+		Updated:     f.updated().UTC().Format(time.RFC3339),
+		Author:      atomAuthor{Name: f.Author, URI: f.AuthorURL},
+		Generator:   "pixeldrain",
+		Logo:        f.Image,
+		AccentColor: f.Colour,
+		Links: []atomLink{
+			{Rel: "alternate", Type: "text/html", Href: f.Link},
+			{Rel: "self", Type: feedContentTypeAtom, Href: f.FeedURL},
+		},
+	}
+
+	for _, e := range f.Entries {
+		var date = e.Date.UTC().Format(time.RFC3339)
+		af.Entries = append(af.Entries, atomEntry{
+			ID:        e.Link,
+			Title:     e.Title,
+			Updated:   date,
+			Published: date,
+			Summary:   e.Description,
+			Links: []atomLink{
+				{Rel: "alternate", Type: "text/html", Href: e.Link},
+				{Rel: "enclosure", Type: e.MimeType, Href: e.Download, Length: e.Size},
+			},
+		})
+	}
+	return af
+}
+
+type rssFeed struct {
+	XMLName    xml.Name   `xml:"rss"`
+	Version    string     `xml:"version,attr"`
+	AtomNS     string     `xml:"xmlns:atom,attr"`
+	ITunesNS   string     `xml:"xmlns:itunes,attr"`
+	WebfeedsNS string     `xml:"xmlns:webfeeds,attr"`
+	Channel    rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title          string      `xml:"title"`
+	Link           string      `xml:"link"`
+	Description    string      `xml:"description"`
+	LastBuildDate  string      `xml:"lastBuildDate"`
+	Generator      string      `xml:"generator"`
+	Self           atomLink    `xml:"atom:link"`
+	Image          rssImage    `xml:"image"`
+	ITunesImage    itunesImage `xml:"itunes:image"`
+	ITunesAuthor   string      `xml:"itunes:author"`
+	ITunesExplicit string      `xml:"itunes:explicit"`
+	ITunesType     string      `xml:"itunes:type"`
+	AccentColor    string      `xml:"webfeeds:accentColor,omitempty"`
+	Items          []rssItem   `xml:"item"`
+}
+
+type rssImage struct {
+	URL   string `xml:"url"`
+	Title string `xml:"title"`
+	Link  string `xml:"link"`
+}
+
+type itunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+type rssItem struct {
+	Title       string       `xml:"title"`
+	Link        string       `xml:"link"`
+	Description string       `xml:"description,omitempty"`
+	GUID        rssGUID      `xml:"guid"`
+	PubDate     string       `xml:"pubDate"`
+	Enclosure   rssEnclosure `xml:"enclosure"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+func (f *feed) rss() (rf rssFeed) {
+	rf = rssFeed{
+		Version:    "2.0",
+		AtomNS:     "http://www.w3.org/2005/Atom",
+		ITunesNS:   itunesNamespace,
+		WebfeedsNS: webfeedsNamespace,
+		Channel: rssChannel{
+			Title:          f.Title,
+			Link:           f.Link,
+			Description:    f.Description,
+			LastBuildDate:  f.updated().UTC().Format(time.RFC1123Z),
+			Generator:      "pixeldrain",
+			Self:           atomLink{Rel: "self", Type: feedContentTypeRSS, Href: f.FeedURL},
+			Image:          rssImage{URL: f.Image, Title: f.Title, Link: f.Link},
+			ITunesImage:    itunesImage{Href: f.Image},
+			ITunesAuthor:   f.Author,
+			ITunesExplicit: "false",
+			ITunesType:     "episodic",
+			AccentColor:    f.Colour,
+		},
+	}
+
+	for _, e := range f.Entries {
+		rf.Channel.Items = append(rf.Channel.Items, rssItem{
+			Title:       e.Title,
+			Link:        e.Link,
+			Description: e.Description,
+			GUID:        rssGUID{IsPermaLink: true, Value: e.Link},
+			PubDate:     e.Date.UTC().Format(time.RFC1123Z),
+			Enclosure: rssEnclosure{
+				URL:    e.Download,
+				Length: e.Size,
+				Type:   e.MimeType,
+			},
+		})
+	}
+	return rf
+}
+
+// addFeed adds the feed discovery link to the metadata of a list or directory
+func (og *ogData) addFeed(f feed) {
+	og.addAlternate(f.feedType(""), f.FeedURL)
+}
@@ -1,25 +1,120 @@
 package webcontroller
 
 import (
+	"encoding/json"
 	"fmt"
 	"html/template"
-	"io"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"fornaxian.tech/log"
 	"fornaxian.tech/pixeldrain_api_client/pixelapi"
 	"fornaxian.tech/util"
 	"github.com/julienschmidt/httprouter"
-	"github.com/microcosm-cc/bluemonday"
-	blackfriday "github.com/russross/blackfriday/v2"
 )
 
 func browserCompat(ua string) bool {
 	return strings.Contains(ua, "MSIE") || strings.Contains(ua, "Trident/7.0")
 }
 
+// lowerUserAgents prepares a list of user agents from the config for
+// userAgentMatches
+func lowerUserAgents(agents []string) (lower []string) {
+	for _, ua := range agents {
+		if ua = strings.ToLower(strings.TrimSpace(ua)); ua != "" {
+			lower = append(lower, ua)
+		}
+	}
+	return lower
+}
+
+// userAgentMatches returns true if the user agent contains one of the agents.
+// The agents need to be lowercase
+func userAgentMatches(ua string, agents []string) bool {
+	ua = strings.ToLower(ua)
+	for _, agent := range agents {
+		if strings.Contains(ua, agent) {
+			return true
+		}
+	}
+	return false
+}
+
+// viewerResponse is the representation of a file, list or directory which is
+// sent to the client
+type viewerResponse int
+
+const (
+	viewerHTML     viewerResponse = iota
+	viewerJSON                    // The info from the API
+	viewerDownload                // A redirect to the download
+)
+
+// negotiateViewer decides what to send to a client which opens a viewer page.
+// Download tools get the file. Other clients can ask for the API info or the
+// file with the Accept header, the known type with the highest quality wins
+func (wc *WebController) negotiateViewer(w http.ResponseWriter, r *http.Request) viewerResponse {
+	w.Header().Add("Vary", "Accept")
+	if userAgentMatches(r.UserAgent(), wc.downloadAgents) {
+		return viewerDownload
+	}
+
+	var resp, bestQ = viewerHTML, 0.0
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+
+		var q = 1.0
+		if qs, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qs, 64); err != nil {
+				continue
+			}
+		}
+		// Types with equal quality are ranked by their order in the header
+		if q <= bestQ {
+			continue
+		}
+
+		switch mediaType {
+		case "application/json":
+			resp, bestQ = viewerJSON, q
+		case "application/octet-stream":
+			resp, bestQ = viewerDownload, q
+		case "text/html", "application/xhtml+xml":
+			resp, bestQ = viewerHTML, q
+		}
+	}
+	return resp
+}
+
+// filesBlocked returns true if any of the files was blocked for abuse
+func filesBlocked(files []pixelapi.ListFile) bool {
+	for _, file := range files {
+		if file.AbuseType != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// serveViewerJSON writes the API info of a viewer page. Blocked content is
+// served with status 451
+func serveViewerJSON(w http.ResponseWriter, blocked bool, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if blocked {
+		w.WriteHeader(http.StatusUnavailableForLegalReasons)
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil && !util.IsNetError(err) {
+		log.Error("Failed to encode viewer JSON: %s", err)
+	}
+}
+
 type fileViewerData struct {
 	Type           string       `json:"type"` // file or list
 	APIResponse    interface{}  `json:"api_response"`
@@ -27,6 +122,10 @@ type fileViewerData struct {
 	Embedded       bool         `json:"embedded"`
 	UserAdsEnabled bool         `json:"user_ads_enabled"`
 	ThemeURI       template.URL `json:"theme_uri"`
+
+	// IDs from the URL which could not be found. Only used for lists of files
+	// in the /u/ URL
+	MissingFiles []string `json:"missing_files,omitempty"`
 }
 
 func (vd *fileViewerData) themeOverride(r *http.Request, files []pixelapi.ListFile) {
@@ -53,45 +152,62 @@ func (vd *fileViewerData) themeOverride(r *http.Request, files []pixelapi.ListFi
 
 // ServeFileViewer controller for GET /u/:id
 func (wc *WebController) serveFileViewer(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	// If the user agent is Wget we redirect it to the API so that the file can
-	// be downloaded directly
-	if strings.HasPrefix(r.UserAgent(), "Wget/") {
+	// Download tools are redirected to the API so that the file can be
+	// downloaded directly
+	var resp = wc.negotiateViewer(w, r)
+	if resp == viewerDownload {
 		http.Redirect(w, r, "/api/file/"+p.ByName("id"), http.StatusSeeOther)
 		return
+	} else if resp == viewerHTML && wc.isCrawler(r) {
+		wc.serveFileCrawler(w, r, p)
+		return
 	}
 
 	// Prevent search engines from indexing this page for privacy reasons
 	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
 
-	var err error
-	var ids = strings.Split(p.ByName("id"), ",")
+	var ids = uniqueIDs(strings.Split(p.ByName("id"), ","))
 	var templateData = wc.newTemplateData(w, r)
 
-	var files []pixelapi.ListFile
-	for _, id := range ids {
-		inf, err := templateData.PixelAPI.GetFileInfo(id)
-		if err != nil {
-			if pixelapi.ErrIsServerError(err) {
-				wc.templates.Run(w, r, "500", templateData)
-				return
-			}
-			continue
-		}
-		files = append(files, pixelapi.ListFile{FileInfo: inf})
+	if len(ids) > wc.config.MaxViewerFiles {
+		w.WriteHeader(http.StatusBadRequest)
+		templateData.Other = wc.config.MaxViewerFiles
+		wc.templates.Run(w, r, "too_many_files", templateData)
+		return
+	}
+
+	files, missing, err := wc.getFileInfos(templateData, ids)
+	if err != nil {
+		wc.serveAPIError(w, r, templateData, err, "file_not_found")
+		return
 	}
 
 	if len(files) == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		wc.templates.Run(w, r, "file_not_found", templateData)
+		var res = errorFor(http.StatusNotFound, nil)
+		res.template = "file_not_found"
+		wc.serveError(w, r, templateData, res)
 		return
 	}
 
-	if files[0].SkipFileViewer {
+	// Multiple files are shown as a list
+	var info any = files[0].FileInfo
+	if len(ids) > 1 {
+		info = pixelapi.ListInfo{
+			Title:       "Multiple files",
+			DateCreated: time.Now(),
+			Files:       files,
+		}
+	}
+
+	if resp == viewerJSON {
+		serveViewerJSON(w, filesBlocked(files), info)
+		return
+	} else if files[0].SkipFileViewer {
 		http.Redirect(w, r, "/api/file/"+p.ByName("id"), http.StatusSeeOther)
 		return
 	}
 
-	templateData.OGData = wc.metadataFromFile(r, files[0].FileInfo)
+	templateData.OGData = wc.metadataFromFile(r, templateData, files[0].FileInfo)
 
 	var vd = fileViewerData{
 		CaptchaKey:     wc.captchaKey(),
@@ -101,16 +217,12 @@ func (wc *WebController) serveFileViewer(w http.ResponseWriter, r *http.Request,
 	if len(ids) > 1 {
 		templateData.Title = fmt.Sprintf("%d files on pixeldrain", len(files))
 		vd.Type = "list"
-		vd.APIResponse = pixelapi.ListInfo{
-			Title:       "Multiple files",
-			DateCreated: time.Now(),
-			Files:       files,
-		}
+		vd.MissingFiles = missing
 	} else {
 		templateData.Title = fmt.Sprintf("%s ~ pixeldrain", files[0].Name)
 		vd.Type = "file"
-		vd.APIResponse = files[0].FileInfo
 	}
+	vd.APIResponse = info
 
 	if _, ok := r.URL.Query()["embed"]; ok {
 		vd.Embedded = true
@@ -119,11 +231,8 @@ func (wc *WebController) serveFileViewer(w http.ResponseWriter, r *http.Request,
 	vd.themeOverride(r, files)
 	templateData.Other = vd
 
-	for _, file := range files {
-		if file.AbuseType != "" {
-			w.WriteHeader(http.StatusUnavailableForLegalReasons)
-			break
-		}
+	if filesBlocked(files) {
+		w.WriteHeader(http.StatusUnavailableForLegalReasons)
 	}
 
 	var templateName = "file_viewer_svelte"
@@ -137,36 +246,98 @@ func (wc *WebController) serveFileViewer(w http.ResponseWriter, r *http.Request,
 	}
 }
 
+// uniqueIDs removes empty and duplicate IDs from the list, the order of the IDs
+// is preserved
+func uniqueIDs(ids []string) (unique []string) {
+	var seen = make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok || id == "" {
+			continue
+		}
+		seen[id] = struct{}{}
+		unique = append(unique, id)
+	}
+	return unique
+}
+
+// The number of file info requests which can be running at the same time for a
+// single file viewer request
+const fileInfoConcurrency = 8
+
+// getFileInfos fetches the info of multiple files concurrently. The returned
+// files are in the same order as the IDs. IDs which could not be found are
+// returned in missing. An error is only returned when the API failed
+func (wc *WebController) getFileInfos(td *TemplateData, ids []string) (
+	files []pixelapi.ListFile,
+	missing []string,
+	err error,
+) {
+	type result struct {
+		info pixelapi.FileInfo
+		err  error
+	}
+	var (
+		results = make([]result, len(ids))
+		sem     = make(chan struct{}, fileInfoConcurrency)
+		wg      sync.WaitGroup
+	)
+
+	for i, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, id string) {
+			defer func() { <-sem; wg.Done() }()
+			results[i].info, results[i].err = wc.getFileInfo(td, id)
+		}(i, id)
+	}
+	wg.Wait()
+
+	for i, res := range results {
+		if res.err != nil {
+			if pixelapi.ErrIsServerError(res.err) {
+				return nil, nil, res.err
+			}
+			missing = append(missing, ids[i])
+			continue
+		}
+		files = append(files, pixelapi.ListFile{FileInfo: res.info})
+	}
+	return files, missing, nil
+}
+
 func (wc *WebController) serveListViewer(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	// If the user agent is Wget we redirect it to the API so that the file can
-	// be downloaded directly
-	if strings.HasPrefix(r.UserAgent(), "Wget/") {
+	if _, ok := r.URL.Query()["format"]; ok {
+		wc.serveListExport(w, r, p)
+		return
+	}
+
+	// Download tools are redirected to the API so that the list can be
+	// downloaded as a zip file
+	var resp = wc.negotiateViewer(w, r)
+	if resp == viewerDownload {
 		http.Redirect(w, r, "/api/list/"+p.ByName("id")+"/zip", http.StatusSeeOther)
 		return
+	} else if resp == viewerHTML && wc.isCrawler(r) {
+		wc.serveListCrawler(w, r, p)
+		return
 	}
 
 	// Prevent search engines from indexing this page for privacy reasons
 	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
 
 	var templateData = wc.newTemplateData(w, r)
-	var list, err = templateData.PixelAPI.GetListID(p.ByName("id"))
+	var list, err = wc.getListID(templateData, p.ByName("id"))
 	if err != nil {
-		if apiErr, ok := err.(pixelapi.Error); ok && apiErr.Status == http.StatusNotFound {
-			w.WriteHeader(http.StatusNotFound)
-			wc.templates.Run(w, r, "list_not_found", templateData)
-		} else if strings.HasSuffix(err.Error(), "invalid control character in URL") {
-			w.WriteHeader(http.StatusNotFound)
-			wc.templates.Run(w, r, "list_not_found", templateData)
-		} else {
-			log.Error("API request error occurred: %s", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			wc.templates.Run(w, r, "500", templateData)
-		}
+		wc.serveAPIError(w, r, templateData, err, "list_not_found")
+		return
+	} else if resp == viewerJSON {
+		serveViewerJSON(w, filesBlocked(list.Files), list)
 		return
 	}
 	if len(list.Files) == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		wc.templates.Run(w, r, "list_not_found", templateData)
+		var res = errorFor(http.StatusNotFound, nil)
+		res.template = "list_not_found"
+		wc.serveError(w, r, templateData, res)
 		return
 	}
 
@@ -186,11 +357,8 @@ func (wc *WebController) serveListViewer(w http.ResponseWriter, r *http.Request,
 	vd.themeOverride(r, list.Files)
 	templateData.Other = vd
 
-	for _, file := range list.Files {
-		if file.AbuseType != "" {
-			w.WriteHeader(http.StatusUnavailableForLegalReasons)
-			break
-		}
+	if filesBlocked(list.Files) {
+		w.WriteHeader(http.StatusUnavailableForLegalReasons)
 	}
 
 	var templateName = "file_viewer_svelte"
@@ -203,39 +371,3 @@ func (wc *WebController) serveListViewer(w http.ResponseWriter, r *http.Request,
 		log.Error("Error executing template file_viewer: %s", err)
 	}
 }
-
-func (wc *WebController) serveFilePreview(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	apiKey, _ := wc.getAPIKey(r)
-	api := wc.api.Login(apiKey).RealIP(util.RemoteAddress(r)).RealAgent(r.UserAgent())
-
-	file, err := api.GetFileInfo(p.ByName("id")) // TODO: Error handling
-	if err != nil {
-		wc.serveNotFound(w, r)
-		return
-	}
-
-	if strings.HasPrefix(file.MimeType, "text") &&
-		(strings.HasSuffix(file.Name, ".md") || strings.HasSuffix(file.Name, ".markdown")) {
-		if file.Size > 1<<22 { // Prevent out of memory errors
-			w.Write([]byte("File is too large to view online.\nPlease download and view it locally."))
-			return
-		}
-
-		body, err := api.GetFile(file.ID)
-		if err != nil {
-			log.Error("Can't download text file for preview: %s", err)
-			w.Write([]byte("An error occurred while downloading this file."))
-			return
-		}
-		defer body.Close()
-
-		bodyBytes, err := io.ReadAll(body)
-		if err != nil {
-			log.Error("Can't read text file for preview: %s", err)
-			w.Write([]byte("An error occurred while reading this file."))
-			return
-		}
-
-		w.Write(bluemonday.UGCPolicy().SanitizeBytes(blackfriday.Run(bodyBytes)))
-	}
-}
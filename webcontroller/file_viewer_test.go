@@ -0,0 +1,42 @@
+package webcontroller
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateViewer(t *testing.T) {
+	var wc = &WebController{downloadAgents: []string{"wget/"}}
+	for _, tt := range []struct {
+		name   string
+		accept string
+		agent  string
+		want   viewerResponse
+	}{
+		{"browser", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "Mozilla/5.0", viewerHTML},
+		{"no header", "", "", viewerHTML},
+		{"json", "application/json", "", viewerJSON},
+		{"octet stream", "application/octet-stream", "", viewerDownload},
+		{"download tool", "*/*", "Wget/1.21", viewerDownload},
+		{"first of equal quality", "application/json, text/html", "", viewerJSON},
+		{"html with low quality", "text/html;q=0.1, application/json", "", viewerJSON},
+		{"json with low quality", "application/json;q=0.5, text/html", "", viewerHTML},
+		{"quality with spaces", "text/html; q=0.2, application/octet-stream; q=0.3", "", viewerDownload},
+		{"not acceptable", "application/json;q=0", "", viewerHTML},
+		{"bad quality", "application/json;q=high, text/html;q=0.5", "", viewerHTML},
+		{"unknown types", "image/png, text/plain", "", viewerHTML},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var r = httptest.NewRequest("GET", "/u/test", nil)
+			r.Header.Set("Accept", tt.accept)
+			r.Header.Set("User-Agent", tt.agent)
+			var w = httptest.NewRecorder()
+			if got := wc.negotiateViewer(w, r); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+			if w.Header().Get("Vary") != "Accept" {
+				t.Errorf("response varies on %q", w.Header().Get("Vary"))
+			}
+		})
+	}
+}
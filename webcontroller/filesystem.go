@@ -1,52 +1,274 @@
 package webcontroller
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"path"
 	"strings"
 
 	"fornaxian.tech/log"
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
 	"fornaxian.tech/util"
 	"github.com/julienschmidt/httprouter"
+	blackfriday "github.com/russross/blackfriday/v2"
 )
 
+// fsMarkdownMaxSize is the largest markdown file which is rendered in a
+// filesystem preview
+const fsMarkdownMaxSize = 4 << 20
+
+// fsReadmeNames are the files which are shown below a directory listing, in
+// order of preference. Names are compared case-insensitively
+var fsReadmeNames = []string{"readme.md", "readme.markdown"}
+
 func (wc *WebController) serveDirectory(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	var err error
-	var td = wc.newTemplateData(w, r)
 	var path = strings.TrimPrefix(p.ByName("path"), "/")
 
-	// Prevent search engines from indexing this page for privacy reasons
-	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	// The sites domain only serves hosted sites
+	if wc.isSiteRequest(r) {
+		wc.serveSitePath(w, r, path)
+		return
+	}
+
+	// The preview and player pages are for browsers, only the directory page
+	// gets a link preview
+	var resp = wc.negotiateViewer(w, r)
+	if path != "" && r.URL.RawQuery == "" && resp == viewerHTML && wc.isCrawler(r) {
+		wc.serveFilesystemCrawler(w, r, path)
+		return
+	}
+
+	var td = wc.newTemplateData(w, r)
 
 	if path == "" {
-		wc.templates.Run(w, r, "404", td)
+		wc.serveError(w, r, td, errorFor(http.StatusNotFound, nil))
 		return
 	}
 
-	node, err := td.PixelAPI.GetFilesystemPath(path)
+	node, err := wc.getFilesystemPath(td, path)
 	if err != nil {
-		if err.Error() == "not_found" || err.Error() == "path_not_found" {
-			wc.serveNotFound(w, r)
-		} else if err.Error() == "forbidden" {
-			wc.serveForbidden(w, r)
-		} else if err.Error() == "authentication_required" {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-		} else if err.Error() == "unavailable_for_legal_reasons" {
-			wc.serveUnavailableForLegalReasons(w, r)
-		} else if err.Error() == "permission_denied" {
-			wc.serveForbidden(w, r)
-		} else {
-			log.Error("Failed to get path: %s", err)
-			wc.templates.Run(w, r, "500", td)
+		wc.serveAPIError(w, r, td, err, "")
+		return
+	} else if resp == viewerHTML && wc.redirectToSite(w, r, node) {
+		return
+	}
+
+	// Prevent search engines from indexing this page for privacy reasons
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+
+	if _, ok := r.URL.Query()["feed"]; ok {
+		wc.serveFilesystemFeed(w, r, td, node)
+		return
+	} else if _, ok := r.URL.Query()["format"]; ok {
+		wc.serveFilesystemExport(w, r, td, node)
+		return
+	}
+
+	switch resp {
+	case viewerJSON:
+		serveViewerJSON(w, node.Path[node.BaseIndex].AbuseType != "", node)
+		return
+	case viewerDownload:
+		// Directories are downloaded as a zip file
+		var base = node.Path[node.BaseIndex]
+		var download = "/api/filesystem" + fsEscapePath(base.Path) + "?attach"
+		if base.Type == "dir" {
+			download = "/api/filesystem" + fsEscapePath(base.Path) + "?bulk_download"
 		}
+		http.Redirect(w, r, download, http.StatusSeeOther)
+		return
+	}
+
+	if _, ok := r.URL.Query()["preview"]; ok {
+		wc.serveFilesystemPreview(w, r, td, node)
+		return
+	} else if _, ok := r.URL.Query()["player"]; ok {
+		wc.serveFilesystemPlayer(w, r, td, node)
+		return
+	} else if _, ok := r.URL.Query()["html"]; ok || browserCompat(r.UserAgent()) {
+		wc.serveFilesystemListing(w, r, td, node)
 		return
 	}
 
 	td.Title = fmt.Sprintf("%s ~ pixeldrain", node.Path[node.BaseIndex].Name)
 	td.Other = node
-	td.OGData = wc.metadataFromFilesystem(r, node)
+	td.SitesDomain = wc.config.SitesDomain
+	td.OGData = wc.metadataFromFilesystem(r, td, node)
 	err = wc.templates.Run(w, r, "filesystem", td)
 	if err != nil && !util.IsNetError(err) {
 		log.Error("Error executing template filesystem: %s", err)
 	}
 }
+
+// fsEscapePath escapes the elements of a filesystem path separately, so the
+// slashes are preserved
+func fsEscapePath(p string) string {
+	var split = strings.Split(p, "/")
+	for i := range split {
+		split[i] = url.PathEscape(split[i])
+	}
+	return strings.Join(split, "/")
+}
+
+// fsReadme returns the README file in a directory listing
+func fsReadme(children []pixelapi.FilesystemNode) (pixelapi.FilesystemNode, bool) {
+	for _, name := range fsReadmeNames {
+		for _, child := range children {
+			if child.Type == "file" && strings.ToLower(child.Name) == name {
+				return child, true
+			}
+		}
+	}
+	return pixelapi.FilesystemNode{}, false
+}
+
+// fsBranding returns the branding properties of a path. Branding can be enabled
+// on any directory, the properties of deeper directories take precedence
+func fsBranding(path []pixelapi.FilesystemNode) map[string]string {
+	var branding = make(map[string]string)
+	for _, node := range path {
+		if node.Properties["branding_enabled"] != "true" {
+			continue
+		}
+		for k, v := range node.Properties {
+			if strings.HasPrefix(k, "brand_") && v != "" {
+				branding[k] = v
+			}
+		}
+	}
+	return branding
+}
+
+func fsIsMarkdown(node pixelapi.FilesystemNode) bool {
+	var name = strings.ToLower(node.Name)
+	return strings.HasPrefix(node.FileType, "text/markdown") ||
+		strings.HasSuffix(name, ".md") ||
+		strings.HasSuffix(name, ".markdown")
+}
+
+// serveFilesystemPreview renders a markdown file from the filesystem. The
+// preview of a directory is its README file, which is shown below the
+// directory listing
+func (wc *WebController) serveFilesystemPreview(
+	w http.ResponseWriter,
+	r *http.Request,
+	td *TemplateData,
+	fsPath pixelapi.FilesystemPath,
+) {
+	var node = fsPath.Path[fsPath.BaseIndex]
+	if node.Type == "dir" {
+		var ok bool
+		if node, ok = fsReadme(fsPath.Children); !ok {
+			var res = errorFor(http.StatusNotFound, nil)
+			res.value, res.message = "no_readme", "This directory does not have a README file"
+			wc.serveError(w, r, td, res)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if !fsIsMarkdown(node) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		writePreviewMessage(w, td.Locale.T("preview.unsupported"))
+		return
+	} else if node.FileSize > fsMarkdownMaxSize {
+		writePreviewMessage(w, td.Locale.T("preview.too_large"))
+		return
+	}
+
+	body, err := wc.getFilesystemFile(r.Context(), td, node.Path, fsMarkdownMaxSize)
+	if errors.Is(err, errPreviewTooLarge) {
+		writePreviewMessage(w, td.Locale.T("preview.too_large"))
+		return
+	} else if err != nil {
+		log.Error("Can't download filesystem file for preview: %s", err)
+		writePreviewMessage(w, td.Locale.T("preview.error"))
+		return
+	}
+
+	var out = getMarkdownBuf()
+	defer putMarkdownBuf(out)
+	renderFilesystemMarkdown(out, body, path.Dir(node.Path))
+
+	if _, err = w.Write(previewPolicy.SanitizeBytes(out.Bytes())); err != nil && !util.IsNetError(err) {
+		log.Error("Failed to write filesystem preview: %s", err)
+	}
+}
+
+// getFilesystemFile downloads a file from the filesystem with the credentials
+// of the user. Files larger than limit are not read
+func (wc *WebController) getFilesystemFile(
+	ctx context.Context,
+	td *TemplateData,
+	filePath string,
+	limit int64,
+) ([]byte, error) {
+	req, err := newAPIRequest(ctx, td, http.MethodGet, wc.config.APIURLInternal+"/filesystem"+fsEscapePath(filePath))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := wc.apiHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("filesystem request returned status %s", resp.Status)
+	}
+
+	return io.ReadAll(&limitReader{r: resp.Body, n: limit})
+}
+
+// renderFilesystemMarkdown renders a markdown file from the filesystem.
+// Relative links are resolved against the directory of the file. Links open in
+// the filesystem viewer and images are loaded from the API
+func renderFilesystemMarkdown(out *bytes.Buffer, body []byte, dir string) {
+	var renderer = blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
+		Flags: blackfriday.CommonHTMLFlags,
+	})
+	var doc = blackfriday.New(
+		blackfriday.WithRenderer(renderer),
+		blackfriday.WithExtensions(blackfriday.CommonExtensions),
+	).Parse(body)
+
+	renderer.RenderHeader(out, doc)
+	doc.Walk(func(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		if entering {
+			switch node.Type {
+			case blackfriday.Link:
+				node.LinkData.Destination = fsResolveLink(dir, node.LinkData.Destination, "/d")
+			case blackfriday.Image:
+				node.LinkData.Destination = fsResolveLink(dir, node.LinkData.Destination, "/api/filesystem")
+			}
+		}
+		return renderer.RenderNode(out, node, entering)
+	})
+	renderer.RenderFooter(out, doc)
+}
+
+// fsResolveLink resolves a relative link in a filesystem document to a URL
+// starting with prefix. Absolute URLs, absolute paths and fragments are
+// returned unchanged
+func fsResolveLink(dir string, dest []byte, prefix string) []byte {
+	u, err := url.Parse(string(dest))
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" || strings.HasPrefix(u.Path, "/") {
+		return dest
+	}
+
+	var link = prefix + fsEscapePath(path.Join(dir, u.Path))
+	if u.RawQuery != "" {
+		link += "?" + u.RawQuery
+	}
+	if u.Fragment != "" {
+		link += "#" + u.EscapedFragment()
+	}
+	return []byte(link)
+}
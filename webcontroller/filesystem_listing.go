@@ -0,0 +1,152 @@
+package webcontroller
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+	"fornaxian.tech/util"
+)
+
+// fsListingPageSize is the number of nodes on a page of the HTML directory
+// listing
+const fsListingPageSize = 100
+
+// fsListing is a directory listing which is rendered completely on the server,
+// for browsers which can't run the filesystem app. The listing can be sorted
+// and filtered with the sort, order and filter parameters
+type fsListing struct {
+	Base        pixelapi.FilesystemNode
+	Breadcrumbs []pixelapi.FilesystemNode
+	Children    []pixelapi.FilesystemNode
+
+	Sort   string // name, size or date
+	Desc   bool
+	Filter string
+
+	Page      int
+	Pages     int
+	Prev      int // Previous page, 0 on the first page
+	Next      int // Next page, 0 on the last page
+	Total     int // Number of nodes after filtering
+	TotalSize int64
+}
+
+// fsListingSorts are the supported sort parameters and their comparison
+// functions. Directories are always listed before files
+var fsListingSorts = map[string]func(a, b pixelapi.FilesystemNode) bool{
+	"name": func(a, b pixelapi.FilesystemNode) bool {
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	},
+	"size": func(a, b pixelapi.FilesystemNode) bool { return a.FileSize < b.FileSize },
+	"date": func(a, b pixelapi.FilesystemNode) bool { return a.Modified.Before(b.Modified) },
+}
+
+func (wc *WebController) serveFilesystemListing(
+	w http.ResponseWriter,
+	r *http.Request,
+	td *TemplateData,
+	fsPath pixelapi.FilesystemPath,
+) {
+	var query = r.URL.Query()
+	var l = fsListing{
+		Base:        fsPath.Path[fsPath.BaseIndex],
+		Breadcrumbs: fsPath.Path[:fsPath.BaseIndex+1],
+		Sort:        query.Get("sort"),
+		Desc:        query.Get("order") == "desc",
+		Filter:      strings.TrimSpace(query.Get("filter")),
+	}
+	if _, ok := fsListingSorts[l.Sort]; !ok {
+		l.Sort = "name"
+	}
+
+	var filter = strings.ToLower(l.Filter)
+	var children = make([]pixelapi.FilesystemNode, 0, len(fsPath.Children))
+	for _, node := range fsPath.Children {
+		if filter == "" || strings.Contains(strings.ToLower(node.Name), filter) {
+			children = append(children, node)
+			l.TotalSize += node.FileSize
+		}
+	}
+
+	var less = fsListingSorts[l.Sort]
+	sort.SliceStable(children, func(i, j int) bool {
+		if (children[i].Type == "dir") != (children[j].Type == "dir") {
+			return children[i].Type == "dir"
+		} else if l.Desc {
+			return less(children[j], children[i])
+		}
+		return less(children[i], children[j])
+	})
+
+	// Pages start at 1, like in the file previews
+	l.Total = len(children)
+	l.Pages = max((l.Total+fsListingPageSize-1)/fsListingPageSize, 1)
+	l.Page, _ = strconv.Atoi(query.Get("page"))
+	l.Page = min(max(l.Page, 1), l.Pages)
+	if l.Page > 1 {
+		l.Prev = l.Page - 1
+	}
+	if l.Page < l.Pages {
+		l.Next = l.Page + 1
+	}
+	l.Children = children[(l.Page-1)*fsListingPageSize : min(l.Page*fsListingPageSize, l.Total)]
+
+	td.Title = fmt.Sprintf("%s ~ pixeldrain", l.Base.Name)
+	td.Other = l
+	td.OGData = wc.metadataFromFilesystem(r, td, fsPath)
+	if err := wc.templates.Run(w, r, "filesystem_listing", td); err != nil && !util.IsNetError(err) {
+		log.Error("Error executing template filesystem_listing: %s", err)
+	}
+}
+
+// Link returns the URL of a node in the listing. Directories keep the sort
+// order of the current listing
+func (l fsListing) Link(node pixelapi.FilesystemNode) string {
+	if node.Type != "dir" {
+		return "/d" + fsEscapePath(node.Path) + "?html"
+	}
+	return "/d" + fsEscapePath(node.Path) + "?" + l.query(l.Sort, l.Desc, "", 1)
+}
+
+// DownloadLink returns the download URL of the base node. Directories are
+// downloaded as a zip file
+func (l fsListing) DownloadLink() string {
+	if l.Base.Type == "file" {
+		return "/api/filesystem" + fsEscapePath(l.Base.Path) + "?attach"
+	}
+	return "/api/filesystem" + fsEscapePath(l.Base.Path) + "?bulk_download"
+}
+
+// SortLink returns the URL which sorts the listing by a column. Clicking the
+// current sort column reverses the order
+func (l fsListing) SortLink(sort string) string {
+	return "?" + l.query(sort, sort == l.Sort && !l.Desc, l.Filter, 1)
+}
+
+// PageLink returns the URL of a page of the listing
+func (l fsListing) PageLink(page int) string {
+	return "?" + l.query(l.Sort, l.Desc, l.Filter, page)
+}
+
+func (l fsListing) query(sort string, desc bool, filter string, page int) string {
+	var v = url.Values{"html": {""}}
+	if sort != "name" {
+		v.Set("sort", sort)
+	}
+	if desc {
+		v.Set("order", "desc")
+	}
+	if filter != "" {
+		v.Set("filter", filter)
+	}
+	if page > 1 {
+		v.Set("page", strconv.Itoa(page))
+	}
+	return v.Encode()
+}
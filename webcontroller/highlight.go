@@ -0,0 +1,349 @@
+package webcontroller
+
+import (
+	"bytes"
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// syntaxRules describe the tokens of a programming language well enough to
+// colour them. This is not a real parser, it only needs to look good in the
+// examples in our documentation
+type syntaxRules struct {
+	lineComments []string  // Prefixes which start a comment until the end of the line
+	blockComment [2]string // Start and end of block comments, empty if not supported
+	quotes       string    // Characters which start and end a string
+	multiline    string    // Quotes which can span multiple lines (Go raw strings)
+	keywords     map[string]bool
+	literals     map[string]bool // Constants like true, false and nil
+	variables    bool            // Shell variables like $HOME and ${HOME}
+	keys         bool            // Strings followed by a colon are object keys (JSON)
+}
+
+func wordSet(words string) map[string]bool {
+	var set = make(map[string]bool)
+	for _, w := range strings.Fields(words) {
+		set[w] = true
+	}
+	return set
+}
+
+var (
+	syntaxGo = &syntaxRules{
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+		multiline:    "`",
+		keywords: wordSet(`break case chan const continue default defer else
+			fallthrough for func go goto if import interface map package range
+			return select struct switch type var`),
+		literals: wordSet("true false nil iota"),
+	}
+	syntaxJSON = &syntaxRules{
+		// JSON doesn't have comments, but we use them to explain the fields in
+		// the API examples
+		lineComments: []string{"//"},
+		quotes:       `"`,
+		literals:     wordSet("true false null"),
+		keys:         true,
+	}
+	syntaxShell = &syntaxRules{
+		lineComments: []string{"#"},
+		quotes:       `"'`,
+		keywords: wordSet(`if then else elif fi for while until do done case esac
+			in function return export local sudo`),
+		literals:  wordSet("true false"),
+		variables: true,
+	}
+	syntaxJavaScript = &syntaxRules{
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+		multiline:    "`",
+		keywords: wordSet(`async await break case catch class const continue
+			default delete do else export extends finally for function if import
+			in instanceof let new of return switch this throw try typeof var void
+			while yield`),
+		literals: wordSet("true false null undefined NaN Infinity"),
+	}
+	syntaxPython = &syntaxRules{
+		lineComments: []string{"#"},
+		quotes:       `"'`,
+		keywords: wordSet(`and as assert async await break class continue def del
+			elif else except finally for from global if import in is lambda
+			nonlocal not or pass raise return try while with yield`),
+		literals: wordSet("True False None"),
+	}
+	// syntaxC covers the languages with C-like syntax. The keywords are a mix
+	// of C, C++, Java, C# and Rust, which is close enough for a preview
+	syntaxC = &syntaxRules{
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       `"'`,
+		keywords: wordSet(`abstract as auto break case catch char class const
+			continue default delete do double else enum extends extern final
+			finally float fn for if impl implements import include int let long
+			loop match mod mut namespace new package private protected pub public
+			return short signed sizeof static struct super switch template this
+			throw trait try typedef union unsigned use using virtual void
+			volatile where while`),
+		literals: wordSet("true false null nullptr NULL None Some self"),
+	}
+)
+
+// syntaxLanguages maps the info string of a fenced code block to the rules for
+// the language
+var syntaxLanguages = map[string]*syntaxRules{
+	"go":         syntaxGo,
+	"golang":     syntaxGo,
+	"json":       syntaxJSON,
+	"sh":         syntaxShell,
+	"bash":       syntaxShell,
+	"shell":      syntaxShell,
+	"console":    syntaxShell,
+	"js":         syntaxJavaScript,
+	"javascript": syntaxJavaScript,
+	"py":         syntaxPython,
+	"python":     syntaxPython,
+	"c":          syntaxC,
+	"cpp":        syntaxC,
+	"c++":        syntaxC,
+	"java":       syntaxC,
+	"cs":         syntaxC,
+	"csharp":     syntaxC,
+	"rust":       syntaxC,
+	"rs":         syntaxC,
+}
+
+// The CSS classes for the highlighted tokens. The colours are defined in the
+// theme, see styleSheet
+const (
+	hlKeyword = "hl_keyword"
+	hlString  = "hl_string"
+	hlNumber  = "hl_number"
+	hlComment = "hl_comment"
+	hlName    = "hl_name"
+)
+
+// renderCodeBlock writes a fenced code block with syntax highlighting and a
+// button for copying the code to the clipboard. The language is taken from the
+// first word of the info string, unknown languages are not highlighted
+func renderCodeBlock(out *bytes.Buffer, info, code []byte) {
+	var lang string
+	if fields := strings.Fields(string(info)); len(fields) > 0 {
+		lang = strings.ToLower(fields[0])
+	}
+
+	out.WriteString(`<div class="code_block">`)
+	out.WriteString(`<button class="code_copy button_highlight" type="button" ` +
+		`onclick="navigator.clipboard.writeText(this.nextElementSibling.innerText)">` +
+		`<i class="icon small">content_copy</i></button>`)
+	out.WriteString(`<pre><code`)
+	if lang != "" {
+		out.WriteString(` class="language-` + html.EscapeString(lang) + `"`)
+	}
+	out.WriteString(`>`)
+
+	if lang == "http" {
+		highlightHTTP(out, string(code))
+	} else if rules, ok := syntaxLanguages[lang]; ok {
+		rules.highlight(out, string(code))
+	} else {
+		out.WriteString(html.EscapeString(string(code)))
+	}
+
+	out.WriteString("</code></pre></div>\n")
+}
+
+func writeToken(out *bytes.Buffer, class, text string) {
+	out.WriteString(`<span class="` + class + `">`)
+	out.WriteString(html.EscapeString(text))
+	out.WriteString(`</span>`)
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// highlight splits the code in tokens and writes them to the output buffer
+func (rules *syntaxRules) highlight(out *bytes.Buffer, code string) {
+	var plainStart = 0
+	var flushPlain = func(end int) {
+		out.WriteString(html.EscapeString(code[plainStart:end]))
+	}
+
+	for i := 0; i < len(code); {
+		var class string
+		var end int
+
+		switch c := code[i]; {
+		case rules.blockComment[0] != "" && strings.HasPrefix(code[i:], rules.blockComment[0]):
+			class = hlComment
+			if idx := strings.Index(code[i+len(rules.blockComment[0]):], rules.blockComment[1]); idx != -1 {
+				end = i + len(rules.blockComment[0]) + idx + len(rules.blockComment[1])
+			} else {
+				end = len(code)
+			}
+
+		case rules.isLineComment(code, i):
+			class = hlComment
+			if idx := strings.IndexByte(code[i:], '\n'); idx != -1 {
+				end = i + idx
+			} else {
+				end = len(code)
+			}
+
+		case strings.IndexByte(rules.quotes, c) != -1:
+			class, end = hlString, rules.stringEnd(code, i)
+			if rules.keys && strings.HasPrefix(strings.TrimLeft(code[end:], " \t"), ":") {
+				class = hlName
+			}
+
+		case c >= '0' && c <= '9' && (i == 0 || !isIdentRune(rune(code[i-1]))):
+			class, end = hlNumber, i+1
+			for end < len(code) && (isIdentRune(rune(code[end])) || code[end] == '.') {
+				end++
+			}
+
+		case rules.variables && c == '$' && i+1 < len(code):
+			class, end = hlName, i+1
+			if code[end] == '{' {
+				if idx := strings.IndexByte(code[end:], '}'); idx != -1 {
+					end += idx + 1
+				}
+			} else {
+				for end < len(code) && isIdentRune(rune(code[end])) {
+					end++
+				}
+			}
+			if end == i+1 {
+				end = i // A lone dollar sign is not a variable
+			}
+
+		default:
+			var r, size = utf8.DecodeRuneInString(code[i:])
+			if !isIdentRune(r) || (i > 0 && isIdentRune(rune(code[i-1]))) {
+				i += size
+				continue
+			}
+
+			end = i
+			for end < len(code) {
+				r, size = utf8.DecodeRuneInString(code[end:])
+				if !isIdentRune(r) {
+					break
+				}
+				end += size
+			}
+
+			var word = code[i:end]
+			if rules.keywords[word] {
+				class = hlKeyword
+			} else if rules.literals[word] {
+				class = hlNumber
+			} else if strings.HasPrefix(code[end:], "(") {
+				class = hlName // Function call
+			} else {
+				i = end
+				continue
+			}
+		}
+
+		if end <= i {
+			// Nothing matched, treat the character as plain text
+			i++
+			continue
+		}
+
+		flushPlain(i)
+		writeToken(out, class, code[i:end])
+		i, plainStart = end, end
+	}
+
+	flushPlain(len(code))
+}
+
+func (rules *syntaxRules) isLineComment(code string, i int) bool {
+	for _, prefix := range rules.lineComments {
+		if !strings.HasPrefix(code[i:], prefix) {
+			continue
+		}
+		// In shell scripts a # is only a comment at the start of a word,
+		// otherwise it's part of an argument
+		if prefix == "#" && rules.variables && i > 0 && !unicode.IsSpace(rune(code[i-1])) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// stringEnd returns the index after the closing quote of the string starting at
+// i. Unterminated strings end at the end of the line
+func (rules *syntaxRules) stringEnd(code string, i int) int {
+	var quote = code[i]
+	var multiline = strings.IndexByte(rules.multiline, quote) != -1
+	for j := i + 1; j < len(code); j++ {
+		switch code[j] {
+		case '\\':
+			if !multiline {
+				j++ // Skip the escaped character
+			}
+		case '\n':
+			if !multiline {
+				return j
+			}
+		case quote:
+			return j + 1
+		}
+	}
+	return len(code)
+}
+
+// highlightHTTP highlights an HTTP request or response. The start line and
+// headers get their own colours, a JSON body is highlighted as JSON
+func highlightHTTP(out *bytes.Buffer, code string) {
+	var head, body, hasBody = strings.Cut(code, "\n\n")
+	var lines = strings.Split(head, "\n")
+
+	for i, line := range lines {
+		if i > 0 {
+			out.WriteByte('\n')
+		}
+
+		if i == 0 {
+			// Request line (GET /api/file HTTP/1.1) or status line
+			// (HTTP/1.1 200 OK)
+			var first, rest, _ = strings.Cut(line, " ")
+			writeToken(out, hlKeyword, first)
+			if rest != "" {
+				out.WriteByte(' ')
+				if strings.HasPrefix(first, "HTTP/") {
+					var status, reason, _ = strings.Cut(rest, " ")
+					writeToken(out, hlNumber, status)
+					if reason != "" {
+						out.WriteString(" " + html.EscapeString(reason))
+					}
+				} else {
+					out.WriteString(html.EscapeString(rest))
+				}
+			}
+		} else if name, val, ok := strings.Cut(line, ":"); ok {
+			writeToken(out, hlName, name)
+			out.WriteString(":" + html.EscapeString(val))
+		} else {
+			out.WriteString(html.EscapeString(line))
+		}
+	}
+
+	if hasBody {
+		out.WriteString("\n\n")
+		if trimmed := strings.TrimSpace(body); strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+			syntaxJSON.highlight(out, body)
+		} else {
+			out.WriteString(html.EscapeString(body))
+		}
+	}
+}
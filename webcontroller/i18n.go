@@ -0,0 +1,346 @@
+package webcontroller
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"fornaxian.tech/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// The locale which is used when the user's language is not supported. All
+// messages must be present in this locale
+const defaultLocale = "en"
+
+// locale is a message catalog for a single language. Catalogs are loaded from
+// JSON files in resource_dir/locale, the name of the file is the language tag.
+// A message is either a string or an object with plural forms:
+//
+//	"file_count": {"one": "%d file", "other": "%d files"}
+//
+// Keys starting with an underscore configure number and date formatting
+type locale struct {
+	Tag string
+
+	messages map[string]message
+	fallback *locale
+
+	decimalSep  string
+	thousandSep string
+	dateFormat  string
+}
+
+type message struct {
+	text   string
+	plural map[string]string
+}
+
+func (m *message) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '{' {
+		return json.Unmarshal(b, &m.plural)
+	}
+	return json.Unmarshal(b, &m.text)
+}
+
+// loadLocales reads all message catalogs from the locale directory
+func loadLocales(dir string) (locales map[string]*locale) {
+	locales = make(map[string]*locale)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		log.Error("Failed to find locales: %s", err)
+	}
+
+	for _, file := range files {
+		var l = &locale{
+			Tag:      strings.TrimSuffix(filepath.Base(file), ".json"),
+			messages: make(map[string]message),
+		}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Error("Failed to read locale '%s': %s", file, err)
+			continue
+		}
+		if err = json.Unmarshal(data, &l.messages); err != nil {
+			log.Error("Failed to parse locale '%s': %s", file, err)
+			continue
+		}
+
+		l.decimalSep = l.messages["_decimal_separator"].text
+		l.thousandSep = l.messages["_thousand_separator"].text
+		l.dateFormat = l.messages["_date_format"].text
+		locales[l.Tag] = l
+	}
+
+	// Make sure there's always a default locale, even if it's empty
+	if _, ok := locales[defaultLocale]; !ok {
+		log.Error("Default locale '%s' not found in %s", defaultLocale, dir)
+		locales[defaultLocale] = &locale{Tag: defaultLocale, messages: make(map[string]message)}
+	}
+
+	// Fall back to the default locale for messages which are not translated
+	for tag, l := range locales {
+		if tag != defaultLocale {
+			l.fallback = locales[defaultLocale]
+		}
+	}
+	return locales
+}
+
+func (l *locale) lookup(key string) (message, bool) {
+	for ; l != nil; l = l.fallback {
+		if msg, ok := l.messages[key]; ok {
+			return msg, true
+		}
+	}
+	return message{}, false
+}
+
+// pluralForm returns the CLDR plural category for n. Only the rules for the
+// languages we have catalogs for are implemented
+func (l *locale) pluralForm(n int) string {
+	switch l.Tag {
+	case "fr", "pt":
+		if n == 0 || n == 1 {
+			return "one"
+		}
+	default:
+		if n == 1 {
+			return "one"
+		}
+	}
+	return "other"
+}
+
+// T translates a message. If the message has plural forms the first integer
+// argument picks the form. The arguments are formatted into the message with
+// fmt.Sprintf
+func (l *locale) T(key string, args ...any) string {
+	msg, ok := l.lookup(key)
+	if !ok {
+		log.Debug("Missing translation for '%s' in locale '%s'", key, l.Tag)
+		return key
+	}
+
+	var text = msg.text
+	if msg.plural != nil {
+		var form = "other"
+		for _, arg := range args {
+			if n, ok := pluralCount(arg); ok {
+				if _, ok := msg.plural["zero"]; ok && n == 0 {
+					form = "zero"
+				} else {
+					form = l.pluralForm(n)
+				}
+				break
+			}
+		}
+		if text, ok = msg.plural[form]; !ok {
+			text = msg.plural["other"]
+		}
+	}
+
+	if len(args) == 0 {
+		return text
+	}
+	return fmt.Sprintf(text, args...)
+}
+
+// pluralCount returns the value of an argument which can be used for picking a
+// plural form
+func pluralCount(arg any) (int, bool) {
+	switch v := arg.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return detectInt(v), true
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), true
+		}
+	}
+	return 0, false
+}
+
+// HTML translates a message which contains HTML markup. The arguments are
+// escaped before they are inserted
+func (l *locale) HTML(key string, args ...any) template.HTML {
+	for i, arg := range args {
+		if s, ok := arg.(string); ok {
+			args[i] = template.HTMLEscapeString(s)
+		}
+	}
+	return template.HTML(l.T(key, args...))
+}
+
+// formatNumber replaces the decimal separator in a formatted number with the
+// one used by this locale
+func (l *locale) formatNumber(s string) string {
+	if l.decimalSep == "" || l.decimalSep == "." {
+		return s
+	}
+	return strings.Replace(s, ".", l.decimalSep, 1)
+}
+
+// formatInt formats an integer with the locale's thousands separator
+func (l *locale) formatInt(i interface{}) string {
+	var s = strconv.Itoa(detectInt(i))
+	if l.thousandSep == "" {
+		return s
+	}
+
+	var neg = strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	var b strings.Builder
+	for i, c := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteString(l.thousandSep)
+		}
+		b.WriteRune(c)
+	}
+	if neg {
+		return "-" + b.String()
+	}
+	return b.String()
+}
+
+func (l *locale) formatDate(t time.Time) string {
+	if l.dateFormat == "" {
+		return t.Format("2006-01-02 15:04")
+	}
+	return t.Format(l.dateFormat)
+}
+
+// localeFromRequest picks the locale for a request. A locale cookie set by the
+// user takes priority, then the Accept-Language header is used
+func (tm *TemplateManager) localeFromRequest(r *http.Request) *locale {
+	var locales = tm.tpl.Load().locales
+
+	if cookie, err := r.Cookie("locale"); err == nil {
+		if l, ok := locales[cookie.Value]; ok {
+			return l
+		}
+	}
+
+	for _, tag := range parseAcceptLanguage(r.Header.Get("Accept-Language")) {
+		if l, ok := locales[tag]; ok {
+			return l
+		}
+		// Try the base language if there's no catalog for the region
+		if base, _, ok := strings.Cut(tag, "-"); ok {
+			if l, ok := locales[base]; ok {
+				return l
+			}
+		}
+	}
+
+	return locales[defaultLocale]
+}
+
+// parseAcceptLanguage returns the language tags from an Accept-Language header
+// sorted by preference
+func parseAcceptLanguage(header string) (tags []string) {
+	type langQ struct {
+		tag string
+		q   float64
+	}
+	var langs []langQ
+
+	for _, part := range strings.Split(header, ",") {
+		var tag, params, _ = strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		var q = 1.0
+		if qs, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(qs, 64); err == nil {
+				q = v
+			}
+		}
+		langs = append(langs, langQ{strings.ToLower(tag), q})
+	}
+
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+	for _, l := range langs {
+		tags = append(tags, l.tag)
+	}
+	return tags
+}
+
+type localeName struct {
+	Tag  string
+	Name string
+}
+
+// localeNames lists the available locales, for showing a language picker
+func (tm *TemplateManager) localeNames() (names []localeName) {
+	for tag, l := range tm.tpl.Load().locales {
+		names = append(names, localeName{Tag: tag, Name: l.T("_name")})
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].Tag < names[j].Tag })
+	return names
+}
+
+// localeFuncs returns the template functions which depend on the locale. Every
+// locale gets its own copy of the template set with these functions
+func (tm *TemplateManager) localeFuncs(l *locale) template.FuncMap {
+	return template.FuncMap{
+		"t":           l.HTML,
+		"locale":      func() string { return l.Tag },
+		"formatData":  func(i interface{}) string { return l.formatNumber(tm.formatData(i)) },
+		"formatSC":    func(amt float64) string { return l.formatNumber(tm.formatSC(amt)) },
+		"formatInt":   l.formatInt,
+		"formatDate":  l.formatDate,
+		"markdownNav": func() []markdownNavItem { return tm.markdownNav(l) },
+	}
+}
+
+// localizedTemplate returns the name of the translated version of a template if
+// it exists. For about.md in locale de this would be about.de.md
+func (tm *TemplateManager) localizedTemplate(name string, l *locale) string {
+	if l.Tag == defaultLocale {
+		return name
+	}
+
+	var ext = filepath.Ext(name)
+	var localized = strings.TrimSuffix(name, ext) + "." + l.Tag + ext
+	var set = tm.tpl.Load()
+	if _, ok := set.markdown[localized]; ok || set.templates[l.Tag].Lookup(localized) != nil {
+		return localized
+	}
+	return name
+}
+
+// serveSetLocale stores the chosen locale in a cookie and sends the user back
+// to the page they came from
+func (wc *WebController) serveSetLocale(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var tag = r.FormValue("locale")
+	if _, ok := wc.templates.tpl.Load().locales[tag]; !ok {
+		http.Error(w, "unknown locale", http.StatusBadRequest)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "locale",
+		Value:    tag,
+		Path:     "/",
+		Expires:  time.Now().AddDate(1, 0, 0),
+		Domain:   wc.config.SessionCookieDomain,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	var redirect = "/"
+	if ref, err := url.Parse(r.Referer()); err == nil && ref.Host == r.Host {
+		redirect = ref.RequestURI()
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
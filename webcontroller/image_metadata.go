@@ -0,0 +1,957 @@
+package webcontroller
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+)
+
+// Image metadata is read from the headers of JPEG, PNG, WebP and HEIF files.
+// Only the start of the file is downloaded, the metadata is nearly always
+// stored before the image data. The preview warns about GPS coordinates and
+// serial numbers, uploaders often don't know that their photos contain those.
+// The values are only shown to the uploader, other visitors get a warning
+const imageMetadataMaxRead = 512 << 10
+
+func init() {
+	registerPreviewRenderer(&previewRenderer{
+		name:       "image_metadata",
+		extensions: []string{".jpg", ".jpeg", ".jfif", ".png", ".webp", ".heic", ".heif"},
+		mimeTypes:  []string{"image/jpeg", "image/png", "image/webp", "image/heic", "image/heif"},
+		stream:     true,
+		render:     previewImageMetadata,
+	})
+}
+
+type imageMetadata struct {
+	Format      string
+	Width       int
+	Height      int
+	Orientation int
+	Make        string
+	Model       string
+	Lens        string
+	Software    string
+	Taken       string
+	Exposure    string
+	FNumber     string
+	ISO         int
+	FocalLength string
+	Latitude    float64
+	Longitude   float64
+	HasGPS      bool
+	Serial      string // Serial number of the camera body
+	LensSerial  string
+	Creator     string
+	Copyright   string
+	Caption     string
+	City        string
+	Country     string
+}
+
+// setString sets a field if it has no value yet. The same property can be in
+// the EXIF, XMP and IPTC data, the first one found wins
+func setString(dst *string, val string) {
+	val = strings.TrimSpace(strings.ToValidUTF8(strings.TrimRight(val, "\x00"), ""))
+	if *dst == "" {
+		*dst = val
+	}
+}
+
+// readImageMetadata detects the format of an image and reads the metadata from
+// its headers. When the read limit is reached the metadata which was found so
+// far is returned
+func (wc *WebController) readImageMetadata(
+	ctx context.Context,
+	td *TemplateData,
+	file pixelapi.FileInfo,
+) (md imageMetadata, err error) {
+	var ra = wc.newRangeReader(ctx, td, file, imageMetadataMaxRead)
+	head, err := readAt(ra, 0, 16)
+	if err != nil {
+		return md, err
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		md.Format = "JPEG"
+		err = md.readJPEG(ra)
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		md.Format = "PNG"
+		err = md.readPNG(ra)
+	case string(head[0:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		md.Format = "WebP"
+		err = md.readWebP(ra)
+	case string(head[4:8]) == "ftyp":
+		md.Format = "HEIF"
+		err = md.readHEIF(ra, file.Size)
+	default:
+		return md, errors.New("unsupported image format")
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, errPreviewTooLarge) {
+		err = nil
+	}
+	return md, err
+}
+
+// imageSize is the display size of an image, with the orientation applied. It's
+// zero if the size could not be read from the file
+type imageSize struct {
+	Width  int
+	Height int
+}
+
+// getImageSize returns the display size of an image. Files can't be changed,
+// so the sizes are cached like the video sizes
+func (wc *WebController) getImageSize(td *TemplateData, file pixelapi.FileInfo) imageSize {
+	size, err := wc.cache.imageSize.get(file.ID, func() (size imageSize, err error) {
+		// The result is shared by everyone who requests it at the same
+		// time, so it doesn't use the context of the request
+		var ctx, cancel = context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+
+		md, err := wc.readImageMetadata(ctx, td, file)
+		if err != nil {
+			return size, err
+		}
+		size = imageSize{Width: md.Width, Height: md.Height}
+		if md.Orientation >= 5 {
+			// The image is rotated by 90 or 270 degrees when it's shown
+			size.Width, size.Height = size.Height, size.Width
+		}
+		return size, nil
+	})
+	if err != nil {
+		log.Debug("Can't read size of image %s: %s", file.ID, err)
+	}
+	return size
+}
+
+// readAt reads n bytes at offset off. The lengths come from the file, so they
+// are checked before allocating the buffer
+func readAt(ra io.ReaderAt, off, n int64) ([]byte, error) {
+	if n < 0 || n > imageMetadataMaxRead {
+		return nil, errPreviewTooLarge
+	}
+	var b = make([]byte, n)
+	if read, err := ra.ReadAt(b, off); read < len(b) {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// readJPEG walks the segments of a JPEG file until the image data starts
+func (md *imageMetadata) readJPEG(ra io.ReaderAt) error {
+	var off int64 = 2
+	for i := 0; i < 1000; i++ {
+		hdr, err := readAt(ra, off, 4)
+		if err != nil {
+			return err
+		} else if hdr[0] != 0xFF {
+			return errors.New("invalid JPEG marker")
+		}
+
+		var marker = hdr[1]
+		switch {
+		case marker == 0xFF:
+			off++ // Fill byte
+			continue
+		case marker == 0xD9 || marker == 0xDA:
+			return nil // End of image or start of the image data
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			off += 2 // Markers without a length
+			continue
+		}
+
+		var length = int64(binary.BigEndian.Uint16(hdr[2:]))
+		if length < 2 {
+			return errors.New("invalid JPEG segment length")
+		}
+
+		// Start of frame markers contain the dimensions. C4, C8 and CC
+		// are other segments in the same range
+		var sof = marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC
+		if marker == 0xE1 || marker == 0xED || sof {
+			data, err := readAt(ra, off+4, length-2)
+			if err != nil {
+				return err
+			}
+
+			switch {
+			case sof && len(data) >= 5:
+				md.Height = int(binary.BigEndian.Uint16(data[1:]))
+				md.Width = int(binary.BigEndian.Uint16(data[3:]))
+			case bytes.HasPrefix(data, []byte("Exif\x00\x00")):
+				md.readTIFF(data[6:])
+			case bytes.HasPrefix(data, []byte("http://ns.adobe.com/xap/1.0/\x00")):
+				md.readXMP(data[29:])
+			case bytes.HasPrefix(data, []byte("Photoshop 3.0\x00")):
+				md.readPhotoshop(data[14:])
+			}
+		}
+		off += 2 + length
+	}
+	return nil
+}
+
+// readPNG walks the chunks of a PNG file until the image data starts
+func (md *imageMetadata) readPNG(ra io.ReaderAt) error {
+	var off int64 = 8
+	for i := 0; i < 1000; i++ {
+		hdr, err := readAt(ra, off, 8)
+		if err != nil {
+			return err
+		}
+		var length = int64(binary.BigEndian.Uint32(hdr))
+
+		switch string(hdr[4:8]) {
+		case "IHDR", "eXIf", "iTXt":
+			data, err := readAt(ra, off+8, length)
+			if err != nil {
+				return err
+			}
+			switch string(hdr[4:8]) {
+			case "IHDR":
+				if len(data) >= 8 {
+					md.Width = int(binary.BigEndian.Uint32(data))
+					md.Height = int(binary.BigEndian.Uint32(data[4:]))
+				}
+			case "eXIf":
+				md.readTIFF(data)
+			case "iTXt":
+				md.readPNGText(data)
+			}
+		case "IDAT", "IEND":
+			return nil
+		}
+		off += 12 + length
+	}
+	return nil
+}
+
+// readPNGText reads XMP data from an international text chunk. The text can be
+// compressed
+func (md *imageMetadata) readPNGText(data []byte) {
+	keyword, rest, _ := bytes.Cut(data, []byte{0})
+	if string(keyword) != "XML:com.adobe.xmp" || len(rest) < 2 {
+		return
+	}
+	var compressed = rest[0] == 1
+	_, rest, _ = bytes.Cut(rest[2:], []byte{0}) // Language
+	_, text, _ := bytes.Cut(rest, []byte{0})    // Translated keyword
+
+	if compressed {
+		zr, err := zlib.NewReader(bytes.NewReader(text))
+		if err != nil {
+			return
+		}
+		defer zr.Close()
+		if text, err = io.ReadAll(io.LimitReader(zr, imageMetadataMaxRead)); err != nil {
+			return
+		}
+	}
+	md.readXMP(text)
+}
+
+// readWebP walks the chunks of a WebP file
+func (md *imageMetadata) readWebP(ra io.ReaderAt) error {
+	var off int64 = 12
+	for i := 0; i < 100; i++ {
+		hdr, err := readAt(ra, off, 8)
+		if err != nil {
+			return err
+		}
+		var size = int64(binary.LittleEndian.Uint32(hdr[4:]))
+
+		// The image chunks can be large, only the header is needed
+		var read = size
+		switch string(hdr[:4]) {
+		case "VP8X", "VP8 ":
+			read = 10
+		case "VP8L":
+			read = 5
+		case "EXIF", "XMP ":
+		default:
+			read = 0
+		}
+
+		if read > 0 && read <= size {
+			data, err := readAt(ra, off+8, read)
+			if err != nil {
+				return err
+			}
+
+			switch string(hdr[:4]) {
+			case "VP8X":
+				// Canvas size minus one, 24 bit little endian
+				md.Width = 1 + (int(data[4]) | int(data[5])<<8 | int(data[6])<<16)
+				md.Height = 1 + (int(data[7]) | int(data[8])<<8 | int(data[9])<<16)
+			case "VP8 ":
+				if md.Width == 0 && bytes.Equal(data[3:6], []byte{0x9D, 0x01, 0x2A}) {
+					md.Width = int(binary.LittleEndian.Uint16(data[6:]) & 0x3FFF)
+					md.Height = int(binary.LittleEndian.Uint16(data[8:]) & 0x3FFF)
+				}
+			case "VP8L":
+				if md.Width == 0 && data[0] == 0x2F {
+					var bits = binary.LittleEndian.Uint32(data[1:])
+					md.Width = int(bits&0x3FFF) + 1
+					md.Height = int(bits>>14&0x3FFF) + 1
+				}
+			case "EXIF":
+				md.readTIFF(bytes.TrimPrefix(data, []byte("Exif\x00\x00")))
+			case "XMP ":
+				md.readXMP(data)
+			}
+		}
+		off += 8 + size + size%2
+	}
+	return nil
+}
+
+// byteCursor reads big endian integers from a byte slice. Reading past the end
+// returns zero and sets the error flag
+type byteCursor struct {
+	b   []byte
+	p   int
+	err bool
+}
+
+func (c *byteCursor) uint(n int) uint64 {
+	if n < 0 || c.p+n > len(c.b) {
+		c.err = true
+		return 0
+	}
+	var v uint64
+	for _, b := range c.b[c.p : c.p+n] {
+		v = v<<8 | uint64(b)
+	}
+	c.p += n
+	return v
+}
+
+// eachBox calls fn for every ISO base media box in b
+func eachBox(b []byte, fn func(typ string, body []byte)) {
+	for i := 0; len(b) >= 8 && i < 1000; i++ {
+		var size = uint64(binary.BigEndian.Uint32(b))
+		var hdr uint64 = 8
+		if size == 1 && len(b) >= 16 {
+			size, hdr = binary.BigEndian.Uint64(b[8:]), 16
+		} else if size == 0 {
+			size = uint64(len(b))
+		}
+		if size < hdr || size > uint64(len(b)) {
+			return
+		}
+		fn(string(b[4:8]), b[hdr:size])
+		b = b[size:]
+	}
+}
+
+// readHEIF finds the meta box of a HEIF file. The EXIF and XMP data are stored
+// as items, the meta box says where those items are in the file
+func (md *imageMetadata) readHEIF(ra io.ReaderAt, size int64) error {
+	var off int64
+	for i := 0; i < 100 && off < size; i++ {
+		hdr, err := readAt(ra, off, 16)
+		if err != nil {
+			return err
+		}
+
+		var boxSize, hdrSize = int64(binary.BigEndian.Uint32(hdr)), int64(8)
+		if boxSize == 1 {
+			boxSize, hdrSize = int64(binary.BigEndian.Uint64(hdr[8:])), 16
+		} else if boxSize == 0 {
+			boxSize = size - off
+		}
+		if boxSize < hdrSize {
+			return errors.New("invalid box size")
+		}
+
+		if string(hdr[4:8]) == "meta" {
+			meta, err := readAt(ra, off+hdrSize, boxSize-hdrSize)
+			if err != nil {
+				return err
+			} else if len(meta) < 4 {
+				return errors.New("meta box is too small")
+			}
+			return md.readHEIFMeta(ra, meta[4:]) // Skip version and flags
+		}
+		off += boxSize
+	}
+	return nil
+}
+
+func (md *imageMetadata) readHEIFMeta(ra io.ReaderAt, meta []byte) error {
+	var exifItems, xmpItems []uint64
+	var locations = make(map[uint64][2]uint64) // Item ID to offset and length
+
+	eachBox(meta, func(typ string, body []byte) {
+		switch typ {
+		case "iinf":
+			var c = byteCursor{b: body}
+			var version = c.uint(1)
+			c.uint(3)
+			if version == 0 {
+				c.uint(2)
+			} else {
+				c.uint(4)
+			}
+			if c.err {
+				return
+			}
+			eachBox(body[c.p:], func(typ string, infe []byte) {
+				var c = byteCursor{b: infe}
+				var version = c.uint(1)
+				c.uint(3)
+				if typ != "infe" || version < 2 {
+					return
+				}
+				var id = c.uint(2)
+				if version > 2 {
+					id = id<<16 | c.uint(2)
+				}
+				c.uint(2) // Protection index
+				var itemType = string(infe[min(c.p, len(infe)):min(c.p+4, len(infe))])
+				c.uint(4)
+				if c.err {
+					return
+				}
+
+				_, rest, _ := bytes.Cut(infe[c.p:], []byte{0}) // Item name
+				contentType, _, _ := bytes.Cut(rest, []byte{0})
+				if itemType == "Exif" {
+					exifItems = append(exifItems, id)
+				} else if itemType == "mime" && string(contentType) == "application/rdf+xml" {
+					xmpItems = append(xmpItems, id)
+				}
+			})
+
+		case "iloc":
+			var c = byteCursor{b: body}
+			var version = c.uint(1)
+			c.uint(3)
+			var sizes = c.uint(2)
+			var offsetSize, lengthSize = int(sizes >> 12 & 0xF), int(sizes >> 8 & 0xF)
+			var baseOffsetSize, indexSize = int(sizes >> 4 & 0xF), int(sizes & 0xF)
+			if version == 0 {
+				indexSize = 0
+			}
+
+			var count uint64
+			if version < 2 {
+				count = c.uint(2)
+			} else {
+				count = c.uint(4)
+			}
+			for i := uint64(0); i < count && !c.err; i++ {
+				var id uint64
+				if version < 2 {
+					id = c.uint(2)
+				} else {
+					id = c.uint(4)
+				}
+				var method uint64
+				if version == 1 || version == 2 {
+					method = c.uint(2) & 0xF
+				}
+				c.uint(2) // Data reference index
+				var base = c.uint(baseOffsetSize)
+				var extents = c.uint(2)
+				for e := uint64(0); e < extents && !c.err; e++ {
+					c.uint(indexSize)
+					var offset, length = c.uint(offsetSize), c.uint(lengthSize)
+					// Only items stored in the file itself in a single
+					// piece are supported
+					if e == 0 && extents == 1 && method == 0 && !c.err {
+						locations[id] = [2]uint64{base + offset, length}
+					}
+				}
+			}
+
+		case "iprp":
+			eachBox(body, func(typ string, ipco []byte) {
+				if typ != "ipco" {
+					return
+				}
+				// There is a size property for every image in the file,
+				// like the thumbnails and tiles. The largest one is the
+				// full image
+				eachBox(ipco, func(typ string, ispe []byte) {
+					if typ != "ispe" || len(ispe) < 12 {
+						return
+					}
+					var w = int(binary.BigEndian.Uint32(ispe[4:]))
+					var h = int(binary.BigEndian.Uint32(ispe[8:]))
+					if w*h > md.Width*md.Height {
+						md.Width, md.Height = w, h
+					}
+				})
+			})
+		}
+	})
+
+	var item = func(id uint64) []byte {
+		loc, ok := locations[id]
+		if !ok || loc[0] > math.MaxInt64 || loc[1] > imageMetadataMaxRead {
+			return nil
+		}
+		data, err := readAt(ra, int64(loc[0]), int64(loc[1]))
+		if err != nil {
+			log.Debug("Failed to read HEIF item %d: %s", id, err)
+			return nil
+		}
+		return data
+	}
+	for _, id := range exifItems {
+		// The EXIF item starts with the offset of the TIFF header
+		if data := item(id); len(data) >= 4 {
+			var start = 4 + uint64(binary.BigEndian.Uint32(data))
+			if start < uint64(len(data)) {
+				md.readTIFF(data[start:])
+			}
+		}
+	}
+	for _, id := range xmpItems {
+		md.readXMP(item(id))
+	}
+	return nil
+}
+
+// tiffEntry is a field in a TIFF image file directory
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+// tiffTypeSizes are the sizes of the TIFF field types in bytes
+var tiffTypeSizes = map[uint16]uint64{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8,
+}
+
+type tiffReader struct {
+	b     []byte
+	order binary.ByteOrder
+}
+
+// ifd reads the entries of the image file directory at offset off
+func (t *tiffReader) ifd(off uint32) map[uint16]tiffEntry {
+	var entries = make(map[uint16]tiffEntry)
+	if uint64(off)+2 > uint64(len(t.b)) {
+		return entries
+	}
+
+	var n = int(t.order.Uint16(t.b[off:]))
+	for i := 0; i < n && i < 1000; i++ {
+		var e = uint64(off) + 2 + uint64(i)*12
+		if e+12 > uint64(len(t.b)) {
+			break
+		}
+		var tag, typ = t.order.Uint16(t.b[e:]), t.order.Uint16(t.b[e+2:])
+		var count = t.order.Uint32(t.b[e+4:])
+		var size = tiffTypeSizes[typ] * uint64(count)
+		if size == 0 {
+			continue
+		}
+
+		var start = e + 8
+		if size > 4 {
+			start = uint64(t.order.Uint32(t.b[e+8:]))
+		}
+		if start+size > uint64(len(t.b)) {
+			continue
+		}
+		entries[tag] = tiffEntry{typ: typ, count: count, data: t.b[start : start+size]}
+	}
+	return entries
+}
+
+func (t *tiffReader) str(e tiffEntry) string {
+	if e.typ != 2 && e.typ != 7 {
+		return ""
+	}
+	return string(e.data)
+}
+
+func (t *tiffReader) uint(e tiffEntry, i int) (uint32, bool) {
+	switch e.typ {
+	case 1, 7:
+		if i < len(e.data) {
+			return uint32(e.data[i]), true
+		}
+	case 3:
+		if (i+1)*2 <= len(e.data) {
+			return uint32(t.order.Uint16(e.data[i*2:])), true
+		}
+	case 4:
+		if (i+1)*4 <= len(e.data) {
+			return t.order.Uint32(e.data[i*4:]), true
+		}
+	}
+	return 0, false
+}
+
+func (t *tiffReader) rational(e tiffEntry, i int) (float64, bool) {
+	if (e.typ != 5 && e.typ != 10) || (i+1)*8 > len(e.data) {
+		return 0, false
+	}
+	var num, den = t.order.Uint32(e.data[i*8:]), t.order.Uint32(e.data[i*8+4:])
+	if den == 0 {
+		return 0, false
+	} else if e.typ == 10 {
+		return float64(int32(num)) / float64(int32(den)), true
+	}
+	return float64(num) / float64(den), true
+}
+
+// readTIFF reads EXIF data, which is stored in the TIFF format
+func (md *imageMetadata) readTIFF(b []byte) {
+	if len(b) < 8 {
+		return
+	}
+	var t = &tiffReader{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return
+	}
+	if t.order.Uint16(b[2:]) != 42 {
+		return
+	}
+
+	var ifd0 = t.ifd(t.order.Uint32(b[4:]))
+	setString(&md.Make, t.str(ifd0[0x010F]))
+	setString(&md.Model, t.str(ifd0[0x0110]))
+	setString(&md.Software, t.str(ifd0[0x0131]))
+	setString(&md.Creator, t.str(ifd0[0x013B]))
+	setString(&md.Copyright, t.str(ifd0[0x8298]))
+	if o, ok := t.uint(ifd0[0x0112], 0); ok && md.Orientation == 0 {
+		md.Orientation = int(o)
+	}
+
+	if off, ok := t.uint(ifd0[0x8769], 0); ok {
+		var exif = t.ifd(off)
+		setString(&md.Taken, exifDate(t.str(exif[0x9003])))
+		setString(&md.Serial, t.str(exif[0xA431]))
+		setString(&md.Lens, t.str(exif[0xA434]))
+		setString(&md.LensSerial, t.str(exif[0xA435]))
+		setString(&md.Creator, t.str(exif[0xA430])) // Camera owner
+
+		if v, ok := t.rational(exif[0x829A], 0); ok && v > 0 {
+			if v < 1 {
+				setString(&md.Exposure, fmt.Sprintf("1/%.0fs", 1/v))
+			} else {
+				setString(&md.Exposure, strconv.FormatFloat(v, 'f', -1, 64)+"s")
+			}
+		}
+		if v, ok := t.rational(exif[0x829D], 0); ok && v > 0 {
+			setString(&md.FNumber, "f/"+strconv.FormatFloat(v, 'f', 1, 64))
+		}
+		if v, ok := t.rational(exif[0x920A], 0); ok && v > 0 {
+			setString(&md.FocalLength, strconv.FormatFloat(math.Round(v*10)/10, 'f', -1, 64)+"mm")
+		}
+		if v, ok := t.uint(exif[0x8827], 0); ok && md.ISO == 0 {
+			md.ISO = int(v)
+		}
+		if w, ok := t.uint(exif[0xA002], 0); ok && md.Width == 0 {
+			h, _ := t.uint(exif[0xA003], 0)
+			md.Width, md.Height = int(w), int(h)
+		}
+	}
+	setString(&md.Taken, exifDate(t.str(ifd0[0x0132])))
+
+	if off, ok := t.uint(ifd0[0x8825], 0); ok && !md.HasGPS {
+		var gps = t.ifd(off)
+		var coordinate = func(ref, val uint16, negative string) (float64, bool) {
+			var deg, ok1 = t.rational(gps[val], 0)
+			var min, ok2 = t.rational(gps[val], 1)
+			var sec, ok3 = t.rational(gps[val], 2)
+			var v = deg + min/60 + sec/3600
+			if strings.HasPrefix(t.str(gps[ref]), negative) {
+				v = -v
+			}
+			return v, ok1 && ok2 && ok3
+		}
+		var lat, okLat = coordinate(1, 2, "S")
+		var lon, okLon = coordinate(3, 4, "W")
+
+		// Some cameras write zeroes when they don't have a location
+		if okLat && okLon && (lat != 0 || lon != 0) {
+			md.Latitude, md.Longitude, md.HasGPS = lat, lon, true
+		}
+	}
+}
+
+// exifDate converts an EXIF date (2006:01:02 15:04:05) to the ISO format
+func exifDate(s string) string {
+	s = strings.TrimRight(s, "\x00 ")
+	if len(s) >= 10 && s[4] == ':' && s[7] == ':' {
+		return s[:4] + "-" + s[5:7] + "-" + s[8:]
+	}
+	return s
+}
+
+// xmpProperties are the XMP properties which are read. A property can be an
+// attribute or an element, elements can contain a list of values
+var xmpProperties = func() map[string]*regexp.Regexp {
+	var m = make(map[string]*regexp.Regexp)
+	for _, name := range []string{
+		"tiff:Make", "tiff:Model", "tiff:Orientation", "xmp:CreatorTool",
+		"exif:DateTimeOriginal", "photoshop:DateCreated",
+		"exif:GPSLatitude", "exif:GPSLongitude",
+		"aux:SerialNumber", "exifEX:BodySerialNumber",
+		"aux:Lens", "exifEX:LensModel",
+		"aux:LensSerialNumber", "exifEX:LensSerialNumber",
+		"dc:creator", "dc:rights", "dc:description",
+		"photoshop:City", "photoshop:Country",
+	} {
+		var q = regexp.QuoteMeta(name)
+		m[name] = regexp.MustCompile(`(?s)\s` + q + `\s*=\s*"([^"]*)"|<` + q + `>(.*?)</` + q + `>`)
+	}
+	return m
+}()
+
+func xmpValue(xmp []byte, name string) string {
+	var match = xmpProperties[name].FindSubmatch(xmp)
+	if match == nil {
+		return ""
+	}
+	var val = string(match[1]) + string(match[2])
+	val = htmlTagRegex.ReplaceAllString(val, " ") // rdf:Alt and rdf:Seq lists
+	return strings.Join(strings.Fields(html.UnescapeString(val)), " ")
+}
+
+// readXMP reads the properties from an XMP packet. XMP is RDF in XML, but the
+// properties are found with regular expressions. Writing a real RDF parser for
+// this is not worth it
+func (md *imageMetadata) readXMP(xmp []byte) {
+	if len(xmp) == 0 {
+		return
+	}
+	setString(&md.Make, xmpValue(xmp, "tiff:Make"))
+	setString(&md.Model, xmpValue(xmp, "tiff:Model"))
+	setString(&md.Software, xmpValue(xmp, "xmp:CreatorTool"))
+	setString(&md.Taken, xmpValue(xmp, "exif:DateTimeOriginal"))
+	setString(&md.Taken, xmpValue(xmp, "photoshop:DateCreated"))
+	setString(&md.Serial, xmpValue(xmp, "exifEX:BodySerialNumber"))
+	setString(&md.Serial, xmpValue(xmp, "aux:SerialNumber"))
+	setString(&md.Lens, xmpValue(xmp, "exifEX:LensModel"))
+	setString(&md.Lens, xmpValue(xmp, "aux:Lens"))
+	setString(&md.LensSerial, xmpValue(xmp, "exifEX:LensSerialNumber"))
+	setString(&md.LensSerial, xmpValue(xmp, "aux:LensSerialNumber"))
+	setString(&md.Creator, xmpValue(xmp, "dc:creator"))
+	setString(&md.Copyright, xmpValue(xmp, "dc:rights"))
+	setString(&md.Caption, xmpValue(xmp, "dc:description"))
+	setString(&md.City, xmpValue(xmp, "photoshop:City"))
+	setString(&md.Country, xmpValue(xmp, "photoshop:Country"))
+
+	if o, err := strconv.Atoi(xmpValue(xmp, "tiff:Orientation")); err == nil && md.Orientation == 0 {
+		md.Orientation = o
+	}
+
+	if !md.HasGPS {
+		var lat, okLat = xmpCoordinate(xmpValue(xmp, "exif:GPSLatitude"))
+		var lon, okLon = xmpCoordinate(xmpValue(xmp, "exif:GPSLongitude"))
+		if okLat && okLon && (lat != 0 || lon != 0) {
+			md.Latitude, md.Longitude, md.HasGPS = lat, lon, true
+		}
+	}
+}
+
+// xmpCoordinate parses a GPS coordinate in the XMP format, which is degrees
+// and minutes with a direction: 52,22.5N or 52,22,30N
+func xmpCoordinate(s string) (float64, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	var dir = s[len(s)-1]
+	var parts = strings.Split(s[:len(s)-1], ",")
+	var v float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(part, 64)
+		if err != nil || i > 2 {
+			return 0, false
+		}
+		v += f / math.Pow(60, float64(i))
+	}
+	switch dir {
+	case 'S', 'W':
+		return -v, true
+	case 'N', 'E':
+		return v, true
+	}
+	return 0, false
+}
+
+// readPhotoshop reads the image resource blocks of a Photoshop APP13 segment.
+// The IPTC data is in resource 0x0404
+func (md *imageMetadata) readPhotoshop(b []byte) {
+	for p, i := 0, 0; p+12 <= len(b) && i < 1000; i++ {
+		if string(b[p:p+4]) != "8BIM" {
+			return
+		}
+		var id = binary.BigEndian.Uint16(b[p+4:])
+
+		// The name is a pascal string padded to an even length
+		var nameLength = int(b[p+6])
+		p += 7 + nameLength + (nameLength+1)%2
+		if p+4 > len(b) {
+			return
+		}
+		var size = int(binary.BigEndian.Uint32(b[p:]))
+		p += 4
+		if size < 0 || p+size > len(b) {
+			return
+		}
+		if id == 0x0404 {
+			md.readIPTC(b[p : p+size])
+		}
+		p += size + size%2
+	}
+}
+
+// readIPTC reads the IPTC datasets from the application record
+func (md *imageMetadata) readIPTC(b []byte) {
+	for p := 0; p+5 <= len(b); {
+		if b[p] != 0x1C {
+			return
+		}
+		var record, dataset = b[p+1], b[p+2]
+		var size = int(binary.BigEndian.Uint16(b[p+3:]))
+		p += 5
+		if size&0x8000 != 0 || p+size > len(b) {
+			return // Extended datasets are not used for text
+		}
+
+		var val = string(b[p : p+size])
+		if record == 2 {
+			switch dataset {
+			case 80:
+				setString(&md.Creator, val)
+			case 90:
+				setString(&md.City, val)
+			case 101:
+				setString(&md.Country, val)
+			case 116:
+				setString(&md.Copyright, val)
+			case 120:
+				setString(&md.Caption, val)
+			}
+		}
+		p += size
+	}
+}
+
+// previewImageMetadata shows the metadata of an image in a table, with
+// warnings for the properties which can identify the uploader
+func previewImageMetadata(wc *WebController, out *bytes.Buffer, r *http.Request, td *TemplateData, file pixelapi.FileInfo, body []byte) error {
+	md, err := wc.readImageMetadata(r.Context(), td, file)
+	if err != nil {
+		return err
+	}
+
+	var t = func(key string, args ...any) string { return html.EscapeString(td.Locale.T(key, args...)) }
+
+	var personal = md.Creator != "" || md.City != "" || md.Country != ""
+	var private = md.HasGPS || md.Serial != "" || md.LensSerial != "" || personal
+
+	out.WriteString(`<div class="preview_image_metadata">`)
+	if private && !file.CanEdit {
+		// Visitors are not shown where the uploader lives, who they are or
+		// which camera they own, but they should know the download contains it
+		out.WriteString(`<p class="preview_warning">` + t("preview.image.private_data_warning") + "</p>\n")
+		md.HasGPS, md.Serial, md.LensSerial = false, "", ""
+		md.Creator, md.City, md.Country = "", "", ""
+		personal = false
+	}
+	if md.HasGPS {
+		var coords = fmt.Sprintf("%.5f, %.5f", md.Latitude, md.Longitude)
+		out.WriteString(`<p class="preview_warning">` + t("preview.image.gps_warning") + ` <a href="` +
+			html.EscapeString(fmt.Sprintf(
+				"https://www.openstreetmap.org/?mlat=%.5f&mlon=%.5f#map=15/%.5f/%.5f",
+				md.Latitude, md.Longitude, md.Latitude, md.Longitude,
+			)) + `">` + coords + "</a></p>\n")
+	}
+	if md.Serial != "" || md.LensSerial != "" {
+		out.WriteString(`<p class="preview_warning">` + t("preview.image.serial_warning") + "</p>\n")
+	}
+	if personal {
+		out.WriteString(`<p class="preview_warning">` + t("preview.image.personal_warning") + "</p>\n")
+	}
+
+	var camera = md.Model
+	if md.Make != "" && !strings.HasPrefix(strings.ToLower(md.Model), strings.ToLower(md.Make)) {
+		camera = strings.TrimSpace(md.Make + " " + md.Model)
+	}
+	var exposure []string
+	for _, v := range []string{md.Exposure, md.FNumber, md.FocalLength} {
+		if v != "" {
+			exposure = append(exposure, v)
+		}
+	}
+	if md.ISO > 0 {
+		exposure = append(exposure, "ISO "+strconv.Itoa(md.ISO))
+	}
+	var location []string
+	for _, v := range []string{md.City, md.Country} {
+		if v != "" {
+			location = append(location, v)
+		}
+	}
+
+	var rows = [][2]string{{"format", md.Format}}
+	if md.Width > 0 && md.Height > 0 {
+		rows = append(rows, [2]string{"dimensions", fmt.Sprintf("%d × %d", md.Width, md.Height)})
+	}
+	if md.Orientation >= 1 && md.Orientation <= 8 {
+		rows = append(rows, [2]string{"orientation", td.Locale.T("preview.image.orientation_" + strconv.Itoa(md.Orientation))})
+	}
+	rows = append(rows,
+		[2]string{"camera", camera},
+		[2]string{"lens", md.Lens},
+		[2]string{"exposure", strings.Join(exposure, " · ")},
+		[2]string{"taken", md.Taken},
+		[2]string{"software", md.Software},
+		[2]string{"creator", md.Creator},
+		[2]string{"copyright", md.Copyright},
+		[2]string{"caption", md.Caption},
+		[2]string{"location", strings.Join(location, ", ")},
+		[2]string{"serial", md.Serial},
+		[2]string{"lens_serial", md.LensSerial},
+	)
+
+	out.WriteString("<table><tbody>\n")
+	for _, row := range rows {
+		if row[1] != "" {
+			out.WriteString("<tr><td>" + t("preview.image."+row[0]) + "</td><td>" + html.EscapeString(row[1]) + "</td></tr>\n")
+		}
+	}
+	out.WriteString("</tbody></table>\n")
+
+	if !private {
+		out.WriteString(`<p>` + t("preview.image.no_private_data") + "</p>\n")
+	}
+	out.WriteString("</div>\n")
+	return nil
+}
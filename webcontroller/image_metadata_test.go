@@ -0,0 +1,489 @@
+package webcontroller
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+)
+
+type testByteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// testTag is a field in a TIFF image file directory
+type testTag struct {
+	tag, typ uint16
+	count    uint32
+	data     []byte
+}
+
+func asciiTag(tag uint16, s string) testTag {
+	return testTag{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func shortTag(order testByteOrder, tag uint16, v uint16) testTag {
+	return testTag{tag, 3, 1, order.AppendUint16(nil, v)}
+}
+
+func rationalTag(order testByteOrder, tag uint16, v ...uint32) testTag {
+	var b []byte
+	for _, n := range v {
+		b = order.AppendUint32(b, n)
+	}
+	return testTag{tag, 5, uint32(len(v) / 2), b}
+}
+
+// buildTIFF writes a TIFF file with an IFD0 and optionally the EXIF and GPS
+// IFDs. The pointers to the EXIF and GPS IFDs are added to IFD0
+func buildTIFF(order testByteOrder, ifd0, exif, gps []testTag) []byte {
+	var ifds = [][]testTag{append([]testTag(nil), ifd0...), exif, gps}
+	if len(exif) > 0 {
+		ifds[0] = append(ifds[0], testTag{0x8769, 4, 1, nil})
+	}
+	if len(gps) > 0 {
+		ifds[0] = append(ifds[0], testTag{0x8825, 4, 1, nil})
+	}
+
+	var offsets [3]uint32
+	var end = uint32(8)
+	for i, ifd := range ifds {
+		offsets[i] = end
+		end += 2 + 12*uint32(len(ifd)) + 4
+	}
+	for i, e := range ifds[0] {
+		switch e.tag {
+		case 0x8769:
+			ifds[0][i].data = order.AppendUint32(nil, offsets[1])
+		case 0x8825:
+			ifds[0][i].data = order.AppendUint32(nil, offsets[2])
+		}
+	}
+
+	var b = make([]byte, end)
+	if order == binary.LittleEndian {
+		copy(b, "II")
+	} else {
+		copy(b, "MM")
+	}
+	order.PutUint16(b[2:], 42)
+	order.PutUint32(b[4:], 8)
+	for i, ifd := range ifds {
+		var p = offsets[i]
+		order.PutUint16(b[p:], uint16(len(ifd)))
+		for j, e := range ifd {
+			var q = p + 2 + 12*uint32(j)
+			order.PutUint16(b[q:], e.tag)
+			order.PutUint16(b[q+2:], e.typ)
+			order.PutUint32(b[q+4:], e.count)
+			if len(e.data) <= 4 {
+				copy(b[q+8:], e.data)
+			} else {
+				order.PutUint32(b[q+8:], uint32(len(b)))
+				b = append(b, e.data...)
+			}
+		}
+	}
+	return b
+}
+
+func testEXIF(order testByteOrder, latRef, lonRef string) []byte {
+	return buildTIFF(order, []testTag{
+		asciiTag(0x010F, "Canon"),
+		asciiTag(0x0110, "Canon EOS R5"),
+		shortTag(order, 0x0112, 6),
+		asciiTag(0x0131, "Firmware 1.0"),
+	}, []testTag{
+		asciiTag(0x9003, "2024:05:06 07:08:09"),
+		asciiTag(0xA431, "012345678"),
+		asciiTag(0xA434, "RF50mm F1.8 STM"),
+		rationalTag(order, 0x829A, 1, 250),
+		rationalTag(order, 0x829D, 18, 10),
+		rationalTag(order, 0x920A, 50, 1),
+		shortTag(order, 0x8827, 400),
+	}, []testTag{
+		asciiTag(1, latRef),
+		rationalTag(order, 2, 52, 1, 22, 1, 30, 1),
+		asciiTag(3, lonRef),
+		rationalTag(order, 4, 4, 1, 53, 1, 0, 1),
+	})
+}
+
+func checkMetadata(t *testing.T, got, want imageMetadata) {
+	t.Helper()
+	var gotLat, gotLon = got.Latitude, got.Longitude
+	got.Latitude, got.Longitude = math.Round(gotLat*1e5)/1e5, math.Round(gotLon*1e5)/1e5
+	if got != want {
+		t.Errorf("got metadata\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestReadTIFF(t *testing.T) {
+	var want = imageMetadata{
+		Orientation: 6,
+		Make:        "Canon",
+		Model:       "Canon EOS R5",
+		Lens:        "RF50mm F1.8 STM",
+		Software:    "Firmware 1.0",
+		Taken:       "2024-05-06 07:08:09",
+		Exposure:    "1/250s",
+		FNumber:     "f/1.8",
+		ISO:         400,
+		FocalLength: "50mm",
+		Latitude:    52.375,
+		Longitude:   4.88333,
+		HasGPS:      true,
+		Serial:      "012345678",
+	}
+
+	for _, order := range []testByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run(order.String(), func(t *testing.T) {
+			var md imageMetadata
+			md.readTIFF(testEXIF(order, "N", "E"))
+			checkMetadata(t, md, want)
+
+			// Southern and western coordinates are negative
+			md = imageMetadata{}
+			md.readTIFF(testEXIF(order, "S", "W"))
+			if md.Latitude >= 0 || md.Longitude >= 0 {
+				t.Errorf("got coordinates %f, %f, want negative", md.Latitude, md.Longitude)
+			}
+		})
+	}
+}
+
+func TestReadTIFFGPS(t *testing.T) {
+	var le = binary.LittleEndian
+	for _, tt := range []struct {
+		name string
+		gps  []testTag
+	}{
+		{"zero coordinates", []testTag{
+			rationalTag(le, 2, 0, 1, 0, 1, 0, 1),
+			rationalTag(le, 4, 0, 1, 0, 1, 0, 1),
+		}},
+		{"missing longitude", []testTag{
+			rationalTag(le, 2, 52, 1, 22, 1, 30, 1),
+		}},
+		{"zero denominator", []testTag{
+			rationalTag(le, 2, 52, 0, 22, 1, 30, 1),
+			rationalTag(le, 4, 4, 1, 53, 1, 0, 1),
+		}},
+		{"too few values", []testTag{
+			rationalTag(le, 2, 52, 1),
+			rationalTag(le, 4, 4, 1),
+		}},
+		{"wrong type", []testTag{
+			asciiTag(2, "52 22 30"),
+			asciiTag(4, "4 53 0"),
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var md imageMetadata
+			md.readTIFF(buildTIFF(le, []testTag{asciiTag(0x010F, "Canon")}, nil, tt.gps))
+			if md.HasGPS {
+				t.Errorf("got coordinates %f, %f", md.Latitude, md.Longitude)
+			}
+			if md.Make != "Canon" {
+				t.Errorf("got make %q", md.Make)
+			}
+		})
+	}
+}
+
+func TestReadTIFFMalformed(t *testing.T) {
+	var valid = testEXIF(binary.BigEndian, "N", "E")
+
+	// Every truncated version of the file has to be read without panicking
+	for i := range valid {
+		var md imageMetadata
+		md.readTIFF(valid[:i])
+	}
+
+	// An entry count larger than the directory reads the entries which are
+	// in the file
+	var b = bytes.Clone(valid)
+	binary.BigEndian.PutUint16(b[8:], 0xFFFF)
+	var md imageMetadata
+	md.readTIFF(b)
+	if md.Make != "Canon" {
+		t.Errorf("got make %q from a directory with a bad entry count", md.Make)
+	}
+
+	for name, b := range map[string][]byte{
+		"empty":           nil,
+		"bad byte order":  append([]byte("XX"), valid[2:]...),
+		"bad magic":       append([]byte("MM\x00\x2B"), valid[4:]...),
+		"ifd out of file": []byte("II\x2A\x00\xFF\xFF\xFF\xFF"),
+		"entry pointing past the end": buildTIFF(binary.LittleEndian, []testTag{
+			{0x010F, 2, 0xFFFFFFF0, []byte("Canon\x00")},
+		}, nil, nil),
+		"exif pointer loops to ifd0": buildTIFF(binary.LittleEndian, []testTag{
+			{0x8769, 4, 1, binary.LittleEndian.AppendUint32(nil, 8)},
+		}, nil, nil),
+	} {
+		t.Run(name, func(t *testing.T) {
+			var md imageMetadata
+			md.readTIFF(b)
+			if md.Make != "" || md.HasGPS {
+				t.Errorf("got metadata from a malformed file: %+v", md)
+			}
+		})
+	}
+}
+
+const testXMP = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about=""
+	tiff:Make="NIKON CORPORATION"
+	tiff:Model="NIKON Z 6"
+	tiff:Orientation="8"
+	exif:DateTimeOriginal="2023-01-02T03:04:05"
+	exif:GPSLatitude="52,22.5N"
+	exif:GPSLongitude="4,53W"
+	aux:SerialNumber="6001234"
+	aux:LensSerialNumber="  "
+	photoshop:City="Amsterdam &amp; Co">
+	<dc:creator><rdf:Seq><rdf:li>Jane</rdf:li><rdf:li>Doe</rdf:li></rdf:Seq></dc:creator>
+	<dc:description>
+		<rdf:Alt><rdf:li xml:lang="x-default">A &lt;nice&gt; photo</rdf:li></rdf:Alt>
+	</dc:description>
+	<exifEX:LensModel>NIKKOR Z 24-70mm</exifEX:LensModel>
+</rdf:Description>
+</rdf:RDF>
+</x:xmpmeta>`
+
+func TestReadXMP(t *testing.T) {
+	var md imageMetadata
+	md.readXMP([]byte(testXMP))
+	checkMetadata(t, md, imageMetadata{
+		Orientation: 8,
+		Make:        "NIKON CORPORATION",
+		Model:       "NIKON Z 6",
+		Lens:        "NIKKOR Z 24-70mm",
+		Taken:       "2023-01-02T03:04:05",
+		Latitude:    52.375,
+		Longitude:   -4.88333,
+		HasGPS:      true,
+		Serial:      "6001234",
+		Creator:     "Jane Doe",
+		Caption:     "A <nice> photo",
+		City:        "Amsterdam & Co",
+	})
+
+	// Values which were found in the EXIF data are not replaced
+	md = imageMetadata{Make: "Canon", HasGPS: true, Latitude: 1, Longitude: 2}
+	md.readXMP([]byte(testXMP))
+	if md.Make != "Canon" || md.Latitude != 1 || md.Longitude != 2 {
+		t.Errorf("XMP replaced the EXIF values: %+v", md)
+	}
+
+	// Broken packets don't panic
+	for i := range testXMP {
+		var md imageMetadata
+		md.readXMP([]byte(testXMP[:i]))
+	}
+}
+
+func TestXMPCoordinate(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want float64
+		ok   bool
+	}{
+		{"52,22.5N", 52.375, true},
+		{"52,22,30N", 52.375, true},
+		{"4,53W", -4.88333, true},
+		{"33,51.5S", -33.85833, true},
+		{"151,12E", 151.2, true},
+		{"52N", 52, true},
+		{"52,22.5", 0, false},
+		{"52,22.5X", 0, false},
+		{"52,22,30,1N", 0, false},
+		{"a,bN", 0, false},
+		{"N", 0, false},
+		{"", 0, false},
+	} {
+		got, ok := xmpCoordinate(tt.in)
+		if ok != tt.ok || math.Abs(got-tt.want) > 1e-5 {
+			t.Errorf("xmpCoordinate(%q) = %f, %t, want %f, %t", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// webpChunk returns a RIFF chunk, padded to an even length
+func webpChunk(typ string, data []byte) []byte {
+	var b = append([]byte(typ), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func webpFile(chunks ...[]byte) []byte {
+	var body = []byte("WEBP")
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+func vp8xChunk(width, height int) []byte {
+	var w, h = width - 1, height - 1
+	return webpChunk("VP8X", []byte{
+		0x08, 0, 0, 0, // Flags, EXIF is present
+		byte(w), byte(w >> 8), byte(w >> 16),
+		byte(h), byte(h >> 8), byte(h >> 16),
+	})
+}
+
+func TestReadWebP(t *testing.T) {
+	var vp8 = webpChunk("VP8 ", []byte{
+		0x50, 0x2A, 0x00, 0x9D, 0x01, 0x2A,
+		0x20, 0x03, // 800
+		0x58, 0x02, // 600
+		0, 0,
+	})
+	var vp8l = webpChunk("VP8L", []byte{
+		0x2F,
+		0xFF, 0xC3, 0x3F, 0x00, // 1024 × 256
+	})
+
+	for _, tt := range []struct {
+		name string
+		file []byte
+		want imageMetadata
+	}{
+		// Sizes where adding one carries into the higher bytes
+		{"vp8x", webpFile(vp8xChunk(512, 1024), vp8), imageMetadata{Width: 512, Height: 1024}},
+		{"vp8x large", webpFile(vp8xChunk(16384, 65536)), imageMetadata{Width: 16384, Height: 65536}},
+		{"vp8x maximum", webpFile(vp8xChunk(1<<24, 1<<24)), imageMetadata{Width: 1 << 24, Height: 1 << 24}},
+		{"vp8", webpFile(vp8), imageMetadata{Width: 800, Height: 600}},
+		{"vp8l", webpFile(vp8l), imageMetadata{Width: 1024, Height: 256}},
+		{"exif and xmp", webpFile(
+			vp8xChunk(100, 100),
+			vp8,
+			webpChunk("EXIF", append([]byte("Exif\x00\x00"), testEXIF(binary.LittleEndian, "N", "E")...)),
+			webpChunk("XMP ", []byte(testXMP)),
+		), imageMetadata{
+			Width: 100, Height: 100,
+			Orientation: 6, Make: "Canon", Model: "Canon EOS R5", Lens: "RF50mm F1.8 STM",
+			Software: "Firmware 1.0", Taken: "2024-05-06 07:08:09", Exposure: "1/250s",
+			FNumber: "f/1.8", ISO: 400, FocalLength: "50mm",
+			Latitude: 52.375, Longitude: 4.88333, HasGPS: true, Serial: "012345678",
+			Creator: "Jane Doe", Caption: "A <nice> photo", City: "Amsterdam & Co",
+		}},
+		{"exif without prefix", webpFile(
+			webpChunk("EXIF", buildTIFF(binary.BigEndian, []testTag{asciiTag(0x0110, "X100")}, nil, nil)),
+		), imageMetadata{Model: "X100"}},
+		{"unknown chunks are skipped", webpFile(
+			webpChunk("ICCP", make([]byte, 301)),
+			webpChunk("ANIM", make([]byte, 6)),
+			vp8l,
+		), imageMetadata{Width: 1024, Height: 256}},
+		{"bad vp8 signature", webpFile(webpChunk("VP8 ", make([]byte, 10))), imageMetadata{}},
+		{"bad vp8l signature", webpFile(webpChunk("VP8L", make([]byte, 5))), imageMetadata{}},
+		{"chunk smaller than header", webpFile(webpChunk("VP8X", make([]byte, 4))), imageMetadata{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var md imageMetadata
+			if err := md.readWebP(bytes.NewReader(tt.file)); err != nil && err.Error() != "EOF" {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			checkMetadata(t, md, tt.want)
+		})
+	}
+}
+
+func TestReadWebPMalformed(t *testing.T) {
+	var valid = webpFile(
+		vp8xChunk(512, 1024),
+		webpChunk("EXIF", append([]byte("Exif\x00\x00"), testEXIF(binary.LittleEndian, "N", "E")...)),
+	)
+	for i := range valid {
+		var md imageMetadata
+		md.readWebP(bytes.NewReader(valid[:i]))
+	}
+
+	// A chunk which claims to be larger than the read limit
+	var huge = webpFile(webpChunk("EXIF", nil))
+	binary.LittleEndian.PutUint32(huge[16:], 0xFFFFFFF0)
+	var md imageMetadata
+	if err := md.readWebP(bytes.NewReader(huge)); err == nil {
+		t.Errorf("expected an error for a chunk of %d bytes", uint32(0xFFFFFFF0))
+	}
+}
+
+// renderImageMetadata renders the metadata preview of a JPEG file with the
+// given APP1 segments
+func renderImageMetadata(t *testing.T, segments ...[]byte) func(canEdit bool) string {
+	var jpeg = []byte{0xFF, 0xD8}
+	for _, seg := range segments {
+		jpeg = append(jpeg, 0xFF, 0xE1, byte((len(seg)+2)>>8), byte(len(seg)+2))
+		jpeg = append(jpeg, seg...)
+	}
+	jpeg = append(jpeg, 0xFF, 0xD9)
+	var wc, _ = archiveTestServer(t, jpeg)
+
+	return func(canEdit bool) string {
+		var out bytes.Buffer
+		var td = *archiveTestTD
+		td.Locale = &locale{Tag: defaultLocale}
+		var file = pixelapi.FileInfo{ID: "test", Name: "photo.jpg", Size: int64(len(jpeg)), CanEdit: canEdit}
+		if err := previewImageMetadata(wc, &out, httptest.NewRequest("GET", "/", nil), &td, file, nil); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return out.String()
+	}
+}
+
+func TestPreviewImageMetadataPrivacy(t *testing.T) {
+	var render = renderImageMetadata(t, append([]byte("Exif\x00\x00"), testEXIF(binary.BigEndian, "N", "E")...))
+	var visitor = render(false)
+	checkPreview(t, visitor,
+		[]string{"preview.image.private_data_warning", "Canon EOS R5"},
+		[]string{"52.375", "4.88333", "openstreetmap", "012345678", "preview.image.gps_warning", "preview.image.no_private_data"},
+	)
+
+	var owner = render(true)
+	checkPreview(t, owner,
+		[]string{"preview.image.gps_warning", "52.37500, 4.88333", "openstreetmap.org", "preview.image.serial_warning", "012345678"},
+		[]string{"preview.image.private_data_warning", "preview.image.no_private_data"},
+	)
+
+	if strings.Count(owner, "preview_warning") != 2 || strings.Count(visitor, "preview_warning") != 1 {
+		t.Errorf("unexpected number of warnings:\n%s\n%s", owner, visitor)
+	}
+}
+
+func TestPreviewImageMetadataPersonal(t *testing.T) {
+	var xmp = []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/" photoshop:City="Utrecht" photoshop:Country="Netherlands"/>
+</rdf:RDF></x:xmpmeta>`)
+	var render = renderImageMetadata(t,
+		append([]byte("Exif\x00\x00"), buildTIFF(binary.LittleEndian, []testTag{
+			asciiTag(0x010F, "Canon"),
+		}, []testTag{
+			asciiTag(0xA430, "Jane Doe"), // Camera owner
+		}, nil)...),
+		append([]byte("http://ns.adobe.com/xap/1.0/\x00"), xmp...),
+	)
+
+	var visitor = render(false)
+	checkPreview(t, visitor,
+		[]string{"preview.image.private_data_warning", "Canon"},
+		[]string{"Jane Doe", "Utrecht", "Netherlands", "preview.image.personal_warning", "preview.image.no_private_data"},
+	)
+
+	var owner = render(true)
+	checkPreview(t, owner,
+		[]string{"preview.image.personal_warning", "Jane Doe", "Utrecht, Netherlands"},
+		[]string{"preview.image.private_data_warning", "preview.image.gps_warning", "preview.image.no_private_data"},
+	)
+}
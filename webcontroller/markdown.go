@@ -0,0 +1,431 @@
+package webcontroller
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/util"
+	"github.com/BurntSushi/toml"
+	"github.com/julienschmidt/httprouter"
+	blackfriday "github.com/russross/blackfriday/v2"
+)
+
+// markdownPage is a markdown document from resource_dir/include/md. Documents
+// which start with a front matter block are registered as pages on the website
+// automatically. Documents without front matter can only be included in other
+// templates.
+//
+// The front matter is a TOML document between +++ lines:
+//
+//	+++
+//	path        = "about"
+//	title       = "Questions and Answers"
+//	description = "Frequently asked questions about pixeldrain"
+//	image       = "/res/img/pixeldrain_256.png"
+//	nav_order   = 10
+//	nav_title   = "menu.about"
+//	no_exec     = false
+//	static      = false
+//	auth        = false
+//	no_embed    = false
+//	draft       = false
+//	+++
+//
+// Front matter can also be written as YAML between --- lines. Only flat keys
+// with scalar values are supported, they're converted to TOML:
+//
+//	---
+//	path: about
+//	title: "Questions and Answers"
+//	nav_order: 10
+//	---
+type markdownPage struct {
+	Template string `toml:"-"` // Name of the template containing the markdown source
+
+	Path        string `toml:"path"`        // URL path relative to the prefix, without leading slash
+	Title       string `toml:"title"`       // Title of the page, the first level 1 heading is used if empty
+	Description string `toml:"description"` // Description for search engines and link previews
+	Image       string `toml:"image"`       // Image for link previews
+	NavOrder    int    `toml:"nav_order"`   // Position in the navigation menu, 0 is not shown
+	NavTitle    string `toml:"nav_title"`   // Message key of the title in the navigation menu
+	Draft       bool   `toml:"draft"`       // Drafts are only served in debug mode
+
+	// Don't execute the document as a template, the markdown is rendered as-is
+	NoExec bool `toml:"no_exec"`
+	// The output of the template does not depend on the user or the request,
+	// so it only needs to be rendered once per locale
+	Static bool `toml:"static"`
+	// The user needs to be logged in to view this page
+	Auth bool `toml:"auth"`
+	// The page cannot be embedded in an iframe
+	NoEmbed bool `toml:"no_embed"`
+
+	// Raw markdown source, only used for NoExec pages
+	Source []byte `toml:"-"`
+
+	// True for pages with front matter. Pages which are routed get a URL on
+	// the website
+	routed bool
+}
+
+// frontMatterRegex matches a TOML front matter block between +++ lines at the
+// start of a document
+var frontMatterRegex = regexp.MustCompile(`^\+\+\+\r?\n((?s:.*?)\r?\n)?\+\+\+(?:\r?\n|$)`)
+
+// yamlFrontMatterRegex matches a YAML front matter block between --- lines
+var yamlFrontMatterRegex = regexp.MustCompile(`^---\r?\n((?s:.*?)\r?\n)?---(?:\r?\n|$)`)
+
+// parseFrontMatter splits the front matter from a markdown document and returns
+// the page metadata and the markdown body. Documents without front matter are
+// not routed
+func parseFrontMatter(name string, doc []byte) (page *markdownPage, body []byte) {
+	page = &markdownPage{
+		Template: name,
+		Path:     strings.TrimSuffix(name, ".md"),
+	}
+
+	var regex = frontMatterRegex
+	if bytes.HasPrefix(doc, []byte("---")) {
+		regex = yamlFrontMatterRegex
+	} else if !bytes.HasPrefix(doc, []byte("+++")) {
+		return page, doc
+	}
+	var match = regex.FindSubmatchIndex(doc)
+	if match == nil {
+		log.Error("Front matter of '%s' is not terminated", name)
+		return page, doc
+	}
+	body = doc[match[1]:]
+
+	var header string
+	var err error
+	if match[2] != -1 {
+		header = string(doc[match[2]:match[3]])
+	}
+	if regex == yamlFrontMatterRegex {
+		if header, err = yamlToTOML(header); err != nil {
+			log.Error("Invalid front matter in '%s': %s", name, err)
+			return &markdownPage{Template: name, Path: strings.TrimSuffix(name, ".md")}, body
+		}
+	}
+	meta, err := toml.Decode(header, page)
+	if err != nil {
+		log.Error("Invalid front matter in '%s': %s", name, err)
+		return &markdownPage{Template: name, Path: strings.TrimSuffix(name, ".md")}, body
+	}
+	for _, key := range meta.Undecoded() {
+		log.Warn("Unknown front matter key '%s' in '%s'", key, name)
+	}
+
+	page.Path = strings.Trim(page.Path, "/")
+	page.routed = true
+	if page.NoExec {
+		page.Source = body
+	}
+	return page, body
+}
+
+// yamlToTOML converts YAML front matter to TOML. Only "key: value" lines with
+// scalar values are supported, nested maps and lists are refused
+func yamlToTOML(doc string) (string, error) {
+	var out strings.Builder
+	for i, line := range strings.Split(doc, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		} else if line[0] == ' ' || line[0] == '\t' || line[0] == '-' {
+			return "", fmt.Errorf("line %d: nested values are not supported", i+1)
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return "", fmt.Errorf("line %d: expected a key and a value", i+1)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		// Quotes only count at the start of a value, a plain value like It's
+		// does not start a string
+		var comment = strings.Index(" "+value, " #")
+		if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "'") {
+			comment = yamlCommentIndex(value)
+		}
+		if comment != -1 {
+			value = strings.TrimSpace(value[:comment])
+		}
+
+		switch {
+		case value == "":
+			continue // Null, the default is used
+		case strings.HasPrefix(value, "\""):
+			// Double quoted strings have the same escapes as TOML strings
+		case strings.HasPrefix(value, "'"):
+			if len(value) < 2 || !strings.HasSuffix(value, "'") {
+				return "", fmt.Errorf("line %d: unterminated string", i+1)
+			}
+			value = tomlString(strings.ReplaceAll(value[1:len(value)-1], "''", "'"))
+		case value == "true" || value == "false":
+		default:
+			if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+				value = tomlString(value)
+			}
+		}
+		fmt.Fprintf(&out, "%s = %s\n", key, value)
+	}
+	return out.String(), nil
+}
+
+// tomlString quotes a string for a TOML document
+func tomlString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// markdownPage returns the metadata of a markdown document by template name
+func (tm *TemplateManager) markdownPage(name string) *markdownPage {
+	return tm.tpl.Load().markdown[name]
+}
+
+// markdownPages returns the markdown documents which should get a URL on the
+// website. Translations of pages are not included, they're served on the URL of
+// the original page. Drafts are only included in debug mode
+func (tm *TemplateManager) markdownPages() (pages []*markdownPage) {
+	for _, page := range tm.tpl.Load().markdown {
+		if !page.routed || isLocalizedTemplate(page.Template) {
+			continue
+		}
+		if page.Draft && !tm.debugModeEnabled {
+			continue
+		}
+		pages = append(pages, page)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Path < pages[j].Path })
+	return pages
+}
+
+// isLocalizedTemplate returns true for translated templates like about.de.md
+func isLocalizedTemplate(name string) bool {
+	return strings.Count(name, ".") > 1
+}
+
+type markdownNavItem struct {
+	Path  string
+	Title string
+}
+
+// markdownNav returns the pages which should be shown in the navigation menu,
+// ordered by their nav_order. The nav_title message is used as title if the
+// page has one, otherwise the title of the translated page is used
+func (tm *TemplateManager) markdownNav(l *locale) (nav []markdownNavItem) {
+	var pages = tm.markdownPages()
+	sort.SliceStable(pages, func(i, j int) bool { return pages[i].NavOrder < pages[j].NavOrder })
+
+	for _, page := range pages {
+		if page.NavOrder <= 0 || page.Draft {
+			continue
+		}
+		var title = page.Title
+		if page.NavTitle != "" {
+			title = l.T(page.NavTitle)
+		} else if translated := tm.markdownPage(tm.localizedTemplate(page.Template, l)); translated != nil &&
+			translated.Title != "" {
+			title = translated.Title
+		}
+		nav = append(nav, markdownNavItem{Path: page.Path, Title: title})
+	}
+	return nav
+}
+
+// renderedMarkdown is the HTML output of a markdown document and the title
+// which was extracted from it
+type renderedMarkdown struct {
+	html  template.HTML
+	title string
+}
+
+// markdownBufPool holds the buffers which are used for rendering markdown
+// pages. Buffers which grew very large are not returned to the pool
+var markdownBufPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+func getMarkdownBuf() *bytes.Buffer { return markdownBufPool.Get().(*bytes.Buffer) }
+func putMarkdownBuf(buf *bytes.Buffer) {
+	if buf.Cap() > 4<<20 {
+		return
+	}
+	buf.Reset()
+	markdownBufPool.Put(buf)
+}
+
+// renderMarkdown converts a markdown document to HTML. The first level 1
+// heading is not rendered but returned as the title of the document.
+// Paragraphs containing a shortcode are passed to the shortcode function, if
+// any shortcodes were rendered the output depends on the request
+func renderMarkdown(
+	src []byte,
+	out *bytes.Buffer,
+	shortcode func(out *bytes.Buffer, name string, args map[string]string),
+) (title string, dynamic bool) {
+	var skipExit *blackfriday.Node
+	renderer := blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
+		Flags: blackfriday.CommonHTMLFlags | blackfriday.TOC,
+	})
+
+	// We parse the markdown document, walk through the nodes. Extract the
+	// title of the document, and the rest of the nodes are rendered like
+	// normal
+	blackfriday.New(
+		blackfriday.WithRenderer(renderer),
+		blackfriday.WithExtensions(blackfriday.CommonExtensions|blackfriday.AutoHeadingIDs),
+	).Parse(
+		src,
+	).Walk(func(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		// Capture the title of the document so we can put it at the top of
+		// the template and in the metadata. When entering a h1 node the
+		// first child will be the title of the document. Save that value
+		if node.Type == blackfriday.Heading && node.HeadingData.Level == 1 {
+			title = string(node.FirstChild.Literal)
+			return blackfriday.SkipChildren
+		}
+
+		// Paragraphs which only contain a shortcode are replaced by the
+		// output of the shortcode
+		if node.Type == blackfriday.Paragraph && shortcode != nil {
+			if !entering {
+				if node == skipExit {
+					return blackfriday.GoToNext
+				}
+			} else if name, args, ok := parseShortcode(nodeText(node)); ok {
+				shortcode(out, name, args)
+				skipExit, dynamic = node, true
+				return blackfriday.SkipChildren
+			}
+		}
+
+		// Code blocks get syntax highlighting
+		if node.Type == blackfriday.CodeBlock {
+			renderCodeBlock(out, node.Info, node.Literal)
+			return blackfriday.GoToNext
+		}
+
+		// If this text node contains solely the text "[TOC]" then we render
+		// the table of contents
+		if node.Type == blackfriday.Text && bytes.Equal(node.Literal, []byte("[TOC]")) {
+			// Find the document node and render its TOC
+			for parent := node.Parent; ; parent = parent.Parent {
+				if parent.Type == blackfriday.Document {
+					renderer.RenderHeader(out, parent)
+					return blackfriday.SkipChildren
+				}
+			}
+		}
+
+		return renderer.RenderNode(out, node, entering)
+	})
+	return title, dynamic
+}
+
+// serveMarkdown renders a markdown document inside the markdown_wrapper
+// template. The options for the page are read from the document's front matter
+// on every request, so they can be changed without restarting in debug mode.
+//
+// Pages which are not executed and pages marked as static don't depend on the
+// request, they are only rendered once per locale. The cache is part of the
+// template set so it is cleared when the templates are reloaded. Pages which
+// contain shortcodes are not cached
+func (wc *WebController) serveMarkdown(tpl string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		var err error
+		var tpld = wc.newTemplateData(w, r)
+
+		// The page options are always taken from the original document. If
+		// there is a translation of the document for the user's locale we
+		// render that instead
+		var page = wc.templates.markdownPage(tpl)
+		if page == nil || (page.Draft && !wc.config.DebugMode) {
+			wc.serveNotFound(w, r)
+			return
+		}
+		var doc = wc.templates.markdownPage(wc.templates.localizedTemplate(tpl, tpld.Locale))
+		if doc == nil {
+			doc = page
+		}
+
+		if page.NoEmbed {
+			w.Header().Set("X-Frame-Options", "DENY")
+		}
+		if page.Auth && !tpld.Authenticated {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		var cacheKey string
+		if doc.NoExec {
+			cacheKey = doc.Template
+		} else if page.Static {
+			cacheKey = doc.Template + ":" + tpld.Locale.Tag
+		}
+
+		var set = wc.templates.tpl.Load()
+		var md renderedMarkdown
+		if cached, ok := set.rendered.Load(cacheKey); cacheKey != "" && ok {
+			md = cached.(renderedMarkdown)
+		} else {
+			// Execute the raw markdown template and save the result in a
+			// buffer. Pages which are not templates are used as-is
+			var tplBuf = getMarkdownBuf()
+			defer putMarkdownBuf(tplBuf)
+			if doc.NoExec {
+				tplBuf.Write(doc.Source)
+			} else {
+				err = wc.templates.Run(tplBuf, r, doc.Template, tpld)
+				if err != nil && !util.IsNetError(err) {
+					log.Error("Error executing template '%s': %s", doc.Template, err)
+					return
+				}
+			}
+
+			// Parse the markdown document and save the resulting HTML in a
+			// buffer
+			var mdBuf = getMarkdownBuf()
+			defer putMarkdownBuf(mdBuf)
+			title, dynamic := renderMarkdown(
+				tplBuf.Bytes(),
+				mdBuf,
+				func(out *bytes.Buffer, name string, args map[string]string) {
+					wc.renderShortcode(out, r, tpld, name, args)
+				},
+			)
+			md.title, md.html = title, template.HTML(mdBuf.String())
+
+			// Templates are not executed for HEAD requests, so the output
+			// can't be cached. Shortcodes load live data
+			if cacheKey != "" && r.Method != "HEAD" && !dynamic {
+				set.rendered.Store(cacheKey, md)
+			}
+		}
+
+		// The title from the front matter takes priority over the heading
+		if md.title != "" {
+			tpld.Title = md.title
+		}
+		if doc.Title != "" {
+			tpld.Title = doc.Title
+		}
+		tpld.OGData = wc.metadataFromMarkdown(r, page, tpld.Title)
+
+		// Pass the rendered document to the wrapper template
+		tpld.Other = md.html
+
+		// Execute the wrapper template
+		err = wc.templates.Run(w, r, "markdown_wrapper", tpld)
+		if err != nil && !util.IsNetError(err) {
+			log.Error("Error executing template '%s': %s", tpl, err)
+		}
+	}
+}
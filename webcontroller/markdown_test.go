@@ -0,0 +1,78 @@
+package webcontroller
+
+import (
+	"testing"
+)
+
+func TestParseFrontMatter(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		doc    string
+		want   markdownPage
+		body   string
+		routed bool
+	}{
+		{
+			name:   "toml",
+			doc:    "+++\npath = \"/about/\"\ntitle = \"About\"\nnav_order = 10\n+++\n# Body\n",
+			want:   markdownPage{Path: "about", Title: "About", NavOrder: 10},
+			body:   "# Body\n",
+			routed: true,
+		}, {
+			name: "yaml",
+			doc: "---\n" +
+				"# Comment\n" +
+				"path: about\n" +
+				"title: \"Questions and \\\"Answers\\\"\"\n" +
+				"description: It's about pixeldrain#1 # Comment\n" +
+				"nav_title: 'menu.''about'''\n" +
+				"nav_order: 10\n" +
+				"draft: true\n" +
+				"image:\n" +
+				"---\r\n# Body\n",
+			want: markdownPage{
+				Path:        "about",
+				Title:       `Questions and "Answers"`,
+				Description: "It's about pixeldrain#1",
+				NavTitle:    "menu.'about'",
+				NavOrder:    10,
+				Draft:       true,
+			},
+			body:   "# Body\n",
+			routed: true,
+		}, {
+			name:   "empty yaml",
+			doc:    "---\n---\nBody",
+			want:   markdownPage{Path: "page"},
+			body:   "Body",
+			routed: true,
+		}, {
+			name: "yaml with backslashes",
+			doc:  "---\ntitle: C:\\Users \"quoted\"\n---\n",
+			want: markdownPage{Path: "page", Title: `C:\Users "quoted"`},
+			body: "", routed: true,
+		},
+
+		{name: "no front matter", doc: "# Title\n", want: markdownPage{Path: "page"}, body: "# Title\n"},
+		{name: "horizontal rule", doc: "---\n\nText", want: markdownPage{Path: "page"}, body: "---\n\nText"},
+		{name: "nested yaml", doc: "---\npath: about\nnested:\n  key: value\n---\nBody", want: markdownPage{Path: "page"}, body: "Body"},
+		{name: "yaml list", doc: "---\n- item\n---\nBody", want: markdownPage{Path: "page"}, body: "Body"},
+		{name: "unterminated yaml string", doc: "---\ntitle: 'About\n---\nBody", want: markdownPage{Path: "page"}, body: "Body"},
+		{name: "yaml wrong type", doc: "---\nnav_order: ten\n---\nBody", want: markdownPage{Path: "page"}, body: "Body"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			page, body := parseFrontMatter("page.md", []byte(tt.doc))
+			if page.Path != tt.want.Path || page.Title != tt.want.Title ||
+				page.Description != tt.want.Description || page.NavTitle != tt.want.NavTitle ||
+				page.NavOrder != tt.want.NavOrder || page.Draft != tt.want.Draft || page.Image != "" {
+				t.Errorf("got page %+v, want %+v", page, tt.want)
+			}
+			if string(body) != tt.body {
+				t.Errorf("got body %q, want %q", body, tt.body)
+			}
+			if page.routed != tt.routed {
+				t.Errorf("got routed %t, want %t", page.routed, tt.routed)
+			}
+		})
+	}
+}
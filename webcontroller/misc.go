@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net/http"
 
-	"fornaxian.tech/log"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -19,8 +18,8 @@ func (wc *WebController) serveShareXConfig(w http.ResponseWriter, r *http.Reques
 	if templateData.Authenticated {
 		sess, err := templateData.PixelAPI.PostUserSession("sharex")
 		if err != nil {
-			log.Error("Failed to create user session: %s", err)
-			wc.templates.Run(w, r, "500", templateData)
+			w.Header().Del("Content-Disposition")
+			wc.serveAPIError(w, r, templateData, err, "")
 			return
 		}
 
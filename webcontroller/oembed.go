@@ -0,0 +1,238 @@
+package webcontroller
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+	"fornaxian.tech/util"
+	"github.com/julienschmidt/httprouter"
+)
+
+// oEmbed lets chat applications and content management systems embed files,
+// lists and directories. The response describes the page at the requested URL
+// and contains an iframe of the embedded viewer. The spec is at
+// https://oembed.com
+const (
+	oEmbedCacheAge       = 3600 // Seconds
+	oEmbedThumbnailSize  = 256
+	oEmbedDefaultWidth   = 800
+	oEmbedDefaultHeight  = 600
+	oEmbedVideoHeight    = 450
+	oEmbedAudioHeight    = 200
+	oEmbedContentTypeXML = "text/xml; charset=utf-8"
+)
+
+type oEmbedResponse struct {
+	XMLName         xml.Name `json:"-" xml:"oembed"`
+	Type            string   `json:"type" xml:"type"` // photo, video or rich
+	Version         string   `json:"version" xml:"version"`
+	Title           string   `json:"title,omitempty" xml:"title,omitempty"`
+	AuthorName      string   `json:"author_name,omitempty" xml:"author_name,omitempty"`
+	AuthorURL       string   `json:"author_url,omitempty" xml:"author_url,omitempty"`
+	ProviderName    string   `json:"provider_name" xml:"provider_name"`
+	ProviderURL     string   `json:"provider_url" xml:"provider_url"`
+	CacheAge        int      `json:"cache_age" xml:"cache_age"`
+	ThumbnailURL    string   `json:"thumbnail_url,omitempty" xml:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int      `json:"thumbnail_width,omitempty" xml:"thumbnail_width,omitempty"`
+	ThumbnailHeight int      `json:"thumbnail_height,omitempty" xml:"thumbnail_height,omitempty"`
+	URL             string   `json:"url,omitempty" xml:"url,omitempty"` // Image URL for the photo type
+	HTML            string   `json:"html,omitempty" xml:"html,omitempty"`
+	Width           int      `json:"width" xml:"width"`
+	Height          int      `json:"height" xml:"height"`
+
+	// URL of the embedded viewer, the iframe is generated after the size is
+	// known
+	embedURL string
+}
+
+// addOEmbed adds the oEmbed discovery links for a page
+func (og *ogData) addOEmbed(addr, pageURL string) {
+	var endpoint = addr + "/oembed?url=" + url.QueryEscape(pageURL)
+	og.addAlternate("application/json+oembed", endpoint+"&format=json")
+	og.addAlternate("text/xml+oembed", endpoint+"&format=xml")
+}
+
+// setThumbnail sets the thumbnail URL with the size parameters of the
+// thumbnail API
+func (oe *oEmbedResponse) setThumbnail(thumbnailURL string) {
+	var sep = "?"
+	if strings.Contains(thumbnailURL, "?") {
+		sep = "&"
+	}
+	oe.ThumbnailURL = fmt.Sprintf("%s%swidth=%d&height=%d", thumbnailURL, sep, oEmbedThumbnailSize, oEmbedThumbnailSize)
+	oe.ThumbnailWidth, oe.ThumbnailHeight = oEmbedThumbnailSize, oEmbedThumbnailSize
+}
+
+// fit scales the embed down to the maximum size requested by the consumer,
+// keeping the aspect ratio
+func (oe *oEmbedResponse) fit(maxWidth, maxHeight int) {
+	if maxWidth > 0 && oe.Width > maxWidth {
+		oe.Height = oe.Height * maxWidth / oe.Width
+		oe.Width = maxWidth
+	}
+	if maxHeight > 0 && oe.Height > maxHeight {
+		oe.Width = oe.Width * maxHeight / oe.Height
+		oe.Height = maxHeight
+	}
+}
+
+func (wc *WebController) serveOEmbed(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var td = wc.newTemplateData(w, r)
+	var addr = getRequestAddress(r)
+	var query = r.URL.Query()
+
+	var format = query.Get("format")
+	if format == "" {
+		format = "json"
+	} else if format != "json" && format != "xml" {
+		var res = errorFor(http.StatusNotImplemented, nil)
+		res.value, res.message = "format_not_supported", "Only the json and xml formats are supported"
+		wc.serveError(w, r, td, res)
+		return
+	}
+
+	// Only the path of the URL is used, consumers can request URLs from any
+	// of our domains
+	target, err := url.Parse(query.Get("url"))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+		wc.serveError(w, r, td, errorFor(http.StatusNotFound, err))
+		return
+	}
+
+	var oe = oEmbedResponse{
+		Type:         "rich",
+		Version:      "1.0",
+		ProviderName: "pixeldrain",
+		ProviderURL:  addr,
+		CacheAge:     oEmbedCacheAge,
+		Width:        oEmbedDefaultWidth,
+		Height:       oEmbedDefaultHeight,
+	}
+
+	switch {
+	case strings.HasPrefix(target.Path, "/u/") && fileIDRegex.MatchString(target.Path[3:]):
+		file, err := wc.getFileInfo(td, target.Path[3:])
+		if err != nil {
+			wc.serveAPIError(w, r, td, err, "")
+			return
+		} else if file.AbuseType != "" {
+			wc.serveError(w, r, td, errorFor(http.StatusUnavailableForLegalReasons, nil))
+			return
+		}
+		wc.oEmbedFile(&oe, r, td, file)
+	case strings.HasPrefix(target.Path, "/l/") && fileIDRegex.MatchString(target.Path[3:]):
+		list, err := wc.getListID(td, target.Path[3:])
+		if err != nil {
+			wc.serveAPIError(w, r, td, err, "")
+			return
+		}
+		for _, file := range list.Files {
+			if file.AbuseType != "" {
+				wc.serveError(w, r, td, errorFor(http.StatusUnavailableForLegalReasons, nil))
+				return
+			}
+		}
+		oe.Title = list.Title
+		oe.embedURL = addr + "/l/" + list.ID + "?embed"
+		if len(list.Files) > 0 {
+			oe.setThumbnail(addr + "/api/list/" + list.ID + "/thumbnail")
+		}
+	case strings.HasPrefix(target.Path, "/d/") && len(target.Path) > 3:
+		node, err := wc.getFilesystemPath(td, target.Path[3:])
+		if err != nil {
+			wc.serveAPIError(w, r, td, err, "")
+			return
+		} else if node.Path[node.BaseIndex].AbuseType != "" {
+			wc.serveError(w, r, td, errorFor(http.StatusUnavailableForLegalReasons, nil))
+			return
+		}
+		oEmbedFilesystem(&oe, addr, node)
+	default:
+		wc.serveError(w, r, td, errorFor(http.StatusNotFound, nil))
+		return
+	}
+
+	maxWidth, _ := strconv.Atoi(query.Get("maxwidth"))
+	maxHeight, _ := strconv.Atoi(query.Get("maxheight"))
+	oe.fit(maxWidth, maxHeight)
+
+	if oe.Type != "photo" {
+		oe.HTML = fmt.Sprintf(
+			`<iframe src="%s" width="%d" height="%d" style="border: none;" allowfullscreen></iframe>`,
+			html.EscapeString(oe.embedURL), oe.Width, oe.Height,
+		)
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(oEmbedCacheAge))
+	if format == "xml" {
+		w.Header().Set("Content-Type", oEmbedContentTypeXML)
+		w.Write([]byte(xml.Header))
+		err = xml.NewEncoder(w).Encode(oe)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(oe)
+	}
+	if err != nil && !util.IsNetError(err) {
+		log.Error("Failed to encode oEmbed response: %s", err)
+	}
+}
+
+// oEmbedFile describes a file. Images are embedded as photos when their
+// dimensions can be read, videos get a player of the right aspect ratio
+func (wc *WebController) oEmbedFile(oe *oEmbedResponse, r *http.Request, td *TemplateData, file pixelapi.FileInfo) {
+	var addr = getRequestAddress(r)
+	oe.Title = file.Name
+	oe.setThumbnail(addr + "/api/file/" + file.ID + "/thumbnail")
+	oe.embedURL = addr + "/u/" + file.ID + "?embed"
+
+	switch {
+	case strings.HasPrefix(file.MimeType, "image/"):
+		var size = wc.getImageSize(td, file)
+		if size.Width <= 0 || size.Height <= 0 {
+			return
+		}
+		oe.Type = "photo"
+		oe.URL = addr + "/api/file/" + file.ID
+		oe.Width, oe.Height = size.Width, size.Height
+	case strings.HasPrefix(file.MimeType, "video/"):
+		oe.Type = "video"
+		oe.Height = oEmbedVideoHeight
+	case strings.HasPrefix(file.MimeType, "audio/"):
+		oe.Height = oEmbedAudioHeight
+	}
+}
+
+// oEmbedFilesystem describes a directory or a file in the filesystem. The
+// author is the link in the branding of the directory, if there is one
+func oEmbedFilesystem(oe *oEmbedResponse, addr string, fsPath pixelapi.FilesystemPath) {
+	var base = fsPath.Path[fsPath.BaseIndex]
+	var filepath = fsEscapePath(base.Path)
+	oe.Title = base.Name
+	oe.embedURL = addr + "/d" + filepath + "?embed"
+
+	if base.Type == "file" {
+		oe.setThumbnail(addr + "/api/filesystem" + filepath + "?thumbnail")
+
+		switch {
+		case strings.HasPrefix(base.FileType, "video/"):
+			oe.Type = "video"
+			oe.Height = oEmbedVideoHeight
+		case strings.HasPrefix(base.FileType, "audio/"):
+			oe.Height = oEmbedAudioHeight
+		}
+	}
+
+	if link := fsBranding(fsPath.Path)["brand_header_link"]; link != "" {
+		if u, err := url.Parse(link); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			oe.AuthorURL, oe.AuthorName = u.String(), u.Host
+		}
+	}
+}
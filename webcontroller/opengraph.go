@@ -2,7 +2,6 @@ package webcontroller
 
 import (
 	"net/http"
-	"net/url"
 	"strings"
 
 	"fornaxian.tech/pixeldrain_api_client/pixelapi"
@@ -12,9 +11,10 @@ const defaultThemeColour = "#220735"
 const defaultHost = "https://pixeldrain.com"
 
 type ogData struct {
-	MetaPropRules []ogProp
-	MetaNameRules []ogProp
-	LinkRules     []ogProp
+	MetaPropRules  []ogProp
+	MetaNameRules  []ogProp
+	LinkRules      []ogProp
+	AlternateRules []ogProp // Alternate representations, the key is the content type
 }
 
 type ogProp struct {
@@ -25,14 +25,37 @@ type ogProp struct {
 func (og *ogData) addProp(k, v string) { og.MetaPropRules = append(og.MetaPropRules, ogProp{k, v}) }
 func (og *ogData) addName(k, v string) { og.MetaNameRules = append(og.MetaNameRules, ogProp{k, v}) }
 func (og *ogData) addLink(k, v string) { og.LinkRules = append(og.LinkRules, ogProp{k, v}) }
+func (og *ogData) addAlternate(k, v string) {
+	og.AlternateRules = append(og.AlternateRules, ogProp{k, v})
+}
+
+// prop returns the value of a meta property, or an empty string if it's not set
+func (og ogData) prop(k string) string {
+	for _, p := range og.MetaPropRules {
+		if p.Key == k {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+// filterProps returns the rules for which drop returns false
+func filterProps(rules []ogProp, drop func(k string) bool) (out []ogProp) {
+	for _, p := range rules {
+		if !drop(p.Key) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
 
-func generateOGData(name, filetype, pageurl, fileurl, thumbnailurl, themecolour string) (og ogData) {
+func generateOGData(name, description, filetype, pageurl, fileurl, thumbnailurl, themecolour string) (og ogData) {
 	og.addProp("og:title", name)
 	og.addProp("og:site_name", "pixeldrain")
-	og.addProp("og:description", "This file has been shared with you on pixeldrain")
+	og.addProp("og:description", description)
 	og.addProp("og:url", pageurl)
-	og.addProp("description", "This file has been shared with you on pixeldrain")
-	og.addName("description", "This file has been shared with you on pixeldrain")
+	og.addProp("description", description)
+	og.addName("description", description)
 	og.addName("keywords", "pixeldrain,shared,sharing,upload,file,free")
 	og.addName("twitter:title", name)
 	og.addName("twitter:site", "@Fornax96")
@@ -88,68 +111,111 @@ func getRequestAddress(r *http.Request) (addr string) {
 	}
 }
 
-func (wc *WebController) metadataFromFile(r *http.Request, f pixelapi.FileInfo) ogData {
+func (wc *WebController) metadataFromFile(r *http.Request, td *TemplateData, f pixelapi.FileInfo) ogData {
 	var addr = getRequestAddress(r)
-	return generateOGData(
+	var og = generateOGData(
 		f.Name,
+		wc.templates.localeFromRequest(r).T("og.file_description"),
 		f.MimeType,
 		addr+"/u/"+f.ID,
 		addr+"/api/file/"+f.ID,
 		addr+"/api/file/"+f.ID+"/thumbnail",
 		defaultThemeColour,
 	)
+	if useCard(f.MimeType) {
+		og.setCard(cardURL(addr, "u", f.ID))
+	}
+	wc.setFilePlayer(&og, r, td, f)
+	og.addOEmbed(addr, addr+"/u/"+f.ID)
+	return og
 }
 func (wc *WebController) metadataFromList(r *http.Request, l pixelapi.ListInfo) ogData {
 	var addr = getRequestAddress(r)
+	var description = wc.templates.localeFromRequest(r).T("og.list_description")
 	if l.FileCount > 0 {
-		return generateOGData(
+		var og = generateOGData(
 			l.Title,
+			description,
 			l.Files[0].MimeType,
 			addr+"/l/"+l.ID,
 			addr+"/api/file/"+l.Files[0].ID,
 			addr+"/api/file/"+l.Files[0].ID+"/thumbnail",
 			defaultThemeColour,
 		)
+		// Photo albums keep the image of the first photo
+		if useCard(l.Files[0].MimeType) {
+			og.setCard(cardURL(addr, "l", l.ID))
+		}
+		og.addOEmbed(addr, addr+"/l/"+l.ID)
+		og.addFeed(wc.listFeed(r, l))
+		return og
 	}
 
 	var og = ogData{}
 	og.addProp("og:type", "website")
 	og.addProp("og:title", l.Title)
 	og.addProp("og:site_name", "pixeldrain")
-	og.addProp("og:description", "A collection of files on pixeldrain")
-	og.addProp("description", "A collection of files on pixeldrain")
-	og.addName("description", "A collection of files on pixeldrain")
+	og.addProp("og:description", description)
+	og.addProp("description", description)
+	og.addName("description", description)
 	og.addProp("og:url", addr+"/l/"+l.ID)
 	og.addName("twitter:title", l.Title)
+	og.setCard(cardURL(addr, "l", l.ID))
+	og.addOEmbed(addr, addr+"/l/"+l.ID)
+	og.addFeed(wc.listFeed(r, l))
 	return og
 }
 
-func (wc *WebController) metadataFromFilesystem(r *http.Request, f pixelapi.FilesystemPath) (og ogData) {
+func (wc *WebController) metadataFromFilesystem(r *http.Request, td *TemplateData, f pixelapi.FilesystemPath) (og ogData) {
 	var addr = getRequestAddress(r)
 	var base = &f.Path[f.BaseIndex]
 
-	// Encode the file path
-	var split = strings.Split(base.Path, "/")
-	for i := range split {
-		split[i] = url.PathEscape(split[i])
-	}
-	var filepath = strings.Join(split, "/")
+	var filepath = fsEscapePath(base.Path)
 
 	// Get the theme colour
 	var colour = defaultThemeColour
-	for _, node := range f.Path {
-		if node.Properties["branding_enabled"] == "true" &&
-			node.Properties["brand_highlight_color"] != "" {
-			colour = node.Properties["brand_highlight_color"]
-		}
+	if c := fsBranding(f.Path)["brand_highlight_color"]; c != "" {
+		colour = c
 	}
 
-	return generateOGData(
+	og = generateOGData(
 		base.Name,
+		wc.templates.localeFromRequest(r).T("og.file_description"),
 		base.FileType,
 		addr+"/d"+filepath,
 		addr+"/api/filesystem"+filepath,
 		addr+"/api/filesystem"+filepath+"?thumbnail",
 		colour,
 	)
+	wc.setFilesystemPlayer(&og, r, td, *base)
+	og.addOEmbed(addr, addr+"/d"+filepath)
+	if base.Type == "dir" {
+		og.addFeed(wc.filesystemFeed(r, f))
+	}
+	return og
+}
+
+func (wc *WebController) metadataFromMarkdown(r *http.Request, page *markdownPage, title string) ogData {
+	var addr = getRequestAddress(r)
+	var description = page.Description
+	if description == "" {
+		description = wc.templates.localeFromRequest(r).T("og.page_description")
+	}
+	var image = page.Image
+	if image == "" {
+		image = "/res/img/pixeldrain_256.png"
+	}
+	if strings.HasPrefix(image, "/") {
+		image = addr + image
+	}
+
+	return generateOGData(
+		title+" ~ pixeldrain",
+		description,
+		"",
+		addr+"/"+page.Path,
+		"",
+		image,
+		defaultThemeColour,
+	)
 }
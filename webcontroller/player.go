@@ -0,0 +1,448 @@
+package webcontroller
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+	"fornaxian.tech/util"
+	"github.com/julienschmidt/httprouter"
+)
+
+// The player page is a bare video or audio element which can be embedded on
+// other websites. Twitter's player card needs an HTML page, it can't play a
+// media file directly
+const (
+	playerDefaultWidth  = 1280 // Used when the size of a video can't be read
+	playerDefaultHeight = 720
+	playerAudioWidth    = 480
+	playerAudioHeight   = 270
+
+	// Most of the header of a video is skipped, but the track information can
+	// be at the end of an MP4 file
+	videoSizeMaxRead = 512 << 10
+
+	// Sizes larger than this are not real videos. MP4 sizes are 16 bit
+	// integers, Matroska sizes can be anything
+	videoMaxDimension = 1<<16 - 1
+)
+
+type playerData struct {
+	Type     string // video or audio
+	Title    string
+	Source   string
+	MimeType string
+	Poster   string
+	Captions []playerCaptions
+}
+
+type playerCaptions struct {
+	Source   string
+	Language string
+}
+
+// videoSize is the display size of a video. It's zero if the size could not be
+// read from the file
+type videoSize struct {
+	Width  int
+	Height int
+}
+
+// playerSize returns the size of the player for a video, or the default size
+// if the video size is unknown
+func (vs videoSize) playerSize() (int, int) {
+	if vs.Width <= 0 || vs.Height <= 0 {
+		return playerDefaultWidth, playerDefaultHeight
+	}
+	return vs.Width, vs.Height
+}
+
+// setPlayer points the player card at the player page. The og:video
+// properties keep the URL of the file, but get the dimensions of the player
+func (og *ogData) setPlayer(playerURL string, width, height int) {
+	var w, h = strconv.Itoa(width), strconv.Itoa(height)
+	if og.prop("og:video") != "" {
+		og.addProp("og:video:width", w)
+		og.addProp("og:video:height", h)
+	}
+
+	og.MetaNameRules = filterProps(og.MetaNameRules, func(k string) bool {
+		return k == "twitter:card" || k == "twitter:player"
+	})
+	og.addName("twitter:card", "player")
+	og.addName("twitter:player", playerURL)
+	og.addName("twitter:player:width", w)
+	og.addName("twitter:player:height", h)
+}
+
+// setFilePlayer adds the player page to the metadata of a video or audio file
+func (wc *WebController) setFilePlayer(og *ogData, r *http.Request, td *TemplateData, file pixelapi.FileInfo) {
+	var playerURL = getRequestAddress(r) + "/u/" + file.ID + "/player"
+	if strings.HasPrefix(file.MimeType, "video/") {
+		var size = wc.getVideoSize(file.ID, wc.isCrawler(r), func(ctx context.Context) *apiRangeReader {
+			return wc.newRangeReader(ctx, td, file, videoSizeMaxRead)
+		})
+		var w, h = size.playerSize()
+		og.setPlayer(playerURL, w, h)
+	} else if strings.HasPrefix(file.MimeType, "audio/") {
+		og.setPlayer(playerURL, playerAudioWidth, playerAudioHeight)
+	}
+}
+
+// setFilesystemPlayer adds the player page to the metadata of a video or audio
+// file in the filesystem
+func (wc *WebController) setFilesystemPlayer(og *ogData, r *http.Request, td *TemplateData, node pixelapi.FilesystemNode) {
+	var playerURL = getRequestAddress(r) + "/d" + fsEscapePath(node.Path) + "?player"
+	if strings.HasPrefix(node.FileType, "video/") {
+		var key = node.Path + ":" + strconv.FormatInt(node.Modified.UnixNano(), 10)
+		var size = wc.getVideoSize(key, wc.isCrawler(r), func(ctx context.Context) *apiRangeReader {
+			return wc.newFilesystemRangeReader(ctx, td, node, videoSizeMaxRead)
+		})
+		var w, h = size.playerSize()
+		og.setPlayer(playerURL, w, h)
+	} else if strings.HasPrefix(node.FileType, "audio/") {
+		og.setPlayer(playerURL, playerAudioWidth, playerAudioHeight)
+	}
+}
+
+func (wc *WebController) serveFilePlayer(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var td = wc.newTemplateData(w, r)
+	file, err := wc.getFileInfo(td, p.ByName("id"))
+	if err != nil {
+		wc.serveAPIError(w, r, td, err, "")
+		return
+	}
+
+	var addr = getRequestAddress(r)
+	wc.servePlayer(w, r, td, playerData{
+		Title:    file.Name,
+		Source:   addr + "/api/file/" + file.ID,
+		MimeType: file.MimeType,
+		Poster:   addr + "/api/file/" + file.ID + "/thumbnail",
+	})
+}
+
+// serveFilesystemPlayer serves the player for a file in the filesystem. WebVTT
+// files next to the video are added as captions. They need to have the same
+// name as the video, optionally followed by a language code. So video.mp4 gets
+// the captions from video.vtt and video.en.vtt
+func (wc *WebController) serveFilesystemPlayer(
+	w http.ResponseWriter,
+	r *http.Request,
+	td *TemplateData,
+	fsPath pixelapi.FilesystemPath,
+) {
+	var addr = getRequestAddress(r)
+	var node = fsPath.Path[fsPath.BaseIndex]
+	var pd = playerData{
+		Title:    node.Name,
+		Source:   addr + "/api/filesystem" + fsEscapePath(node.Path),
+		MimeType: node.FileType,
+		Poster:   addr + "/api/filesystem" + fsEscapePath(node.Path) + "?thumbnail",
+	}
+
+	if strings.HasPrefix(node.FileType, "video/") && fsPath.BaseIndex > 0 {
+		dir, err := wc.getFilesystemPath(td, strings.TrimPrefix(path.Dir(node.Path), "/"))
+		if err != nil {
+			log.Debug("Can't list directory for captions of %s: %s", node.Path, err)
+		} else {
+			pd.Captions = fsCaptions(addr, node, dir.Children)
+		}
+	}
+
+	wc.servePlayer(w, r, td, pd)
+}
+
+// fsCaptions finds the WebVTT files which belong to a video
+func fsCaptions(addr string, video pixelapi.FilesystemNode, siblings []pixelapi.FilesystemNode) (captions []playerCaptions) {
+	var stem = strings.TrimSuffix(video.Name, path.Ext(video.Name)) + "."
+	for _, node := range siblings {
+		if node.Type != "file" ||
+			!strings.HasPrefix(node.Name, stem) ||
+			!strings.HasSuffix(strings.ToLower(node.Name), ".vtt") {
+			continue
+		}
+		var lang = strings.TrimPrefix(node.Name, stem)
+		lang = strings.TrimSuffix(lang[:len(lang)-len("vtt")], ".")
+		if strings.Contains(lang, ".") {
+			continue // Belongs to another video with a longer name
+		}
+		captions = append(captions, playerCaptions{
+			Source:   addr + "/api/filesystem" + fsEscapePath(node.Path),
+			Language: lang,
+		})
+	}
+	return captions
+}
+
+func (wc *WebController) servePlayer(w http.ResponseWriter, r *http.Request, td *TemplateData, pd playerData) {
+	if strings.HasPrefix(pd.MimeType, "video/") {
+		pd.Type = "video"
+	} else if strings.HasPrefix(pd.MimeType, "audio/") {
+		pd.Type = "audio"
+	} else {
+		var res = errorFor(http.StatusNotFound, nil)
+		res.value, res.message = "not_playable", "This file is not a video or audio file"
+		wc.serveError(w, r, td, res)
+		return
+	}
+
+	// Prevent search engines from indexing this page for privacy reasons
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+
+	td.Title = pd.Title
+	td.Other = pd
+	if err := wc.templates.Run(w, r, "player", td); err != nil && !util.IsNetError(err) {
+		log.Error("Error executing template player: %s", err)
+	}
+}
+
+// getVideoSize returns the display size of a video. Only link previews need
+// the size, so other pages don't wait for it. When wait is false and the size
+// is not cached it's read in the background and zero is returned. The size is
+// cached, the key must change when the file changes
+func (wc *WebController) getVideoSize(key string, wait bool, newReader func(ctx context.Context) *apiRangeReader) videoSize {
+	var fetch = func() (videoSize, error) {
+		// The result is shared by everyone who requests it at the same
+		// time, so it doesn't use the context of the request
+		var ctx, cancel = context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		size, err := readVideoSize(newReader(ctx))
+		if err != nil {
+			// Failures are cached too, so a slow or broken API is not asked
+			// again on every page view
+			log.Debug("Can't read size of video %s: %s", key, err)
+			return videoSize{}, nil
+		}
+		return size, nil
+	}
+
+	if !wait {
+		if size, ok := wc.cache.videoSize.peek(key); ok {
+			return size
+		}
+		go wc.cache.videoSize.get(key, fetch)
+		return videoSize{}
+	}
+	size, _ := wc.cache.videoSize.get(key, fetch)
+	return size
+}
+
+// readVideoSize reads the display size from the header of an MP4 or WebM
+// video. Unsupported formats have size zero
+func readVideoSize(rr *apiRangeReader) (size videoSize, err error) {
+	head, err := readAt(rr, 0, min(rr.size, 16))
+	if err != nil {
+		return size, err
+	}
+
+	switch {
+	case len(head) >= 8 && string(head[4:8]) == "ftyp":
+		size, err = readMP4Size(rr, rr.size)
+	case bytes4(head) == 0x1A45DFA3: // EBML header
+		var b []byte
+		if b, err = readAt(rr, 0, min(rr.size, rangeBlockSize*2)); err == nil {
+			size = readMatroskaSize(b)
+		}
+	}
+
+	if errors.Is(err, errPreviewTooLarge) {
+		// The track information is past the read limit. We don't want to
+		// retry on every page view, so this is not an error
+		err = nil
+	}
+	return size, err
+}
+
+func bytes4(b []byte) uint32 {
+	if len(b) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+// mp4Boxes calls fn with the type, body offset and body size of every box
+// between off and end. Walking stops when fn returns true
+func mp4Boxes(ra io.ReaderAt, off, end int64, fn func(typ string, body, size int64) (bool, error)) error {
+	for i := 0; i < 1000 && off+8 <= end; i++ {
+		hdr, err := readAt(ra, off, min(16, end-off))
+		if err != nil {
+			return err
+		}
+
+		var boxSize, hdrSize = int64(binary.BigEndian.Uint32(hdr)), int64(8)
+		if boxSize == 1 && len(hdr) >= 16 {
+			boxSize, hdrSize = int64(binary.BigEndian.Uint64(hdr[8:])), 16
+		} else if boxSize == 0 {
+			boxSize = end - off
+		}
+		if boxSize < hdrSize || boxSize > end-off {
+			return errors.New("invalid box size")
+		}
+
+		if stop, err := fn(string(hdr[4:8]), off+hdrSize, boxSize-hdrSize); stop || err != nil {
+			return err
+		}
+		off += boxSize
+	}
+	return nil
+}
+
+// readMP4Size reads the size of the first video track from the track headers.
+// The tkhd box contains the size after the transformation matrix is applied,
+// but phones store rotated videos with a rotation matrix and the size of the
+// unrotated frames
+func readMP4Size(ra io.ReaderAt, fileSize int64) (size videoSize, err error) {
+	err = mp4Boxes(ra, 0, fileSize, func(typ string, off, n int64) (bool, error) {
+		if typ != "moov" {
+			return false, nil
+		}
+		return true, mp4Boxes(ra, off, off+n, func(typ string, off, n int64) (bool, error) {
+			if typ != "trak" {
+				return false, nil
+			}
+			err := mp4Boxes(ra, off, off+n, func(typ string, off, n int64) (bool, error) {
+				if typ != "tkhd" {
+					return false, nil
+				}
+				tkhd, err := readAt(ra, off, min(n, 128))
+				if err != nil || len(tkhd) < 84 {
+					return true, err
+				}
+
+				// The matrix is followed by the width and height, both are
+				// 16.16 fixed point numbers
+				var matrix = tkhd[len(tkhd)-44:]
+				var w = int(binary.BigEndian.Uint32(tkhd[len(tkhd)-8:]) >> 16)
+				var h = int(binary.BigEndian.Uint32(tkhd[len(tkhd)-4:]) >> 16)
+				if bytes4(matrix[0:4]) == 0 && bytes4(matrix[4:8]) != 0 {
+					w, h = h, w // Rotated by 90 or 270 degrees
+				}
+				if w > 0 && h > 0 {
+					size = videoSize{Width: w, Height: h}
+				}
+				return true, nil
+			})
+			return size.Width > 0, err // Audio tracks have no size
+		})
+	})
+	return size, err
+}
+
+// Matroska element IDs. WebM is a subset of Matroska
+const (
+	mkvSegment       = 0x18538067
+	mkvCluster       = 0x1F43B675
+	mkvTracks        = 0x1654AE6B
+	mkvTrackEntry    = 0xAE
+	mkvVideo         = 0xE0
+	mkvPixelWidth    = 0xB0
+	mkvPixelHeight   = 0xBA
+	mkvDisplayWidth  = 0x54B0
+	mkvDisplayHeight = 0x54BA
+)
+
+// ebmlVint reads a variable length integer from an EBML document. Element IDs
+// keep their length marker, sizes don't. The second return value is the
+// length of the integer, it's zero if the integer is invalid. Sizes with all
+// bits set are unknown, those are returned as -1
+func ebmlVint(b []byte, id bool) (int64, int) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0
+	}
+	var n = 1
+	for b[0]&(0x80>>(n-1)) == 0 {
+		n++
+	}
+	if len(b) < n {
+		return 0, 0
+	}
+
+	var v = uint64(b[0])
+	if !id {
+		v &= 0xFF >> n
+	}
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	if !id && v == 1<<(7*n)-1 {
+		return -1, n
+	}
+	return int64(v), n
+}
+
+// readMatroskaSize reads the display size of the first video track in the
+// start of a Matroska file. The tracks are usually stored before the first
+// cluster
+func readMatroskaSize(b []byte) (size videoSize) {
+	var pixelW, pixelH, displayW, displayH int64
+	var walk func(b []byte) bool
+	walk = func(b []byte) bool {
+		for len(b) > 0 {
+			id, idLen := ebmlVint(b, true)
+			n, sizeLen := ebmlVint(b[idLen:], false)
+			if idLen == 0 || sizeLen == 0 {
+				return true
+			}
+			var body = b[idLen+sizeLen:]
+			if n >= 0 && n < int64(len(body)) {
+				body = body[:n]
+			}
+
+			switch id {
+			case mkvCluster:
+				return true
+			case mkvSegment, mkvTracks, mkvTrackEntry:
+				if walk(body) {
+					return true
+				}
+			case mkvVideo:
+				walk(body)
+				return true
+			case mkvPixelWidth, mkvPixelHeight, mkvDisplayWidth, mkvDisplayHeight:
+				var v int64
+				for _, c := range body[:min(len(body), 8)] {
+					v = v<<8 | int64(c)
+				}
+				switch id {
+				case mkvPixelWidth:
+					pixelW = v
+				case mkvPixelHeight:
+					pixelH = v
+				case mkvDisplayWidth:
+					displayW = v
+				case mkvDisplayHeight:
+					displayH = v
+				}
+			}
+
+			if n < 0 {
+				return true // Unknown size, the rest of the buffer is the body
+			}
+			b = b[idLen+sizeLen+len(body):]
+		}
+		return false
+	}
+	walk(b)
+
+	var valid = func(v int64) bool { return v > 0 && v <= videoMaxDimension }
+	if !valid(pixelW) || !valid(pixelH) {
+		return size
+	} else if valid(displayW) && valid(displayH) {
+		// The display size can be in pixels or an aspect ratio, so only the
+		// ratio is used
+		if w := pixelH * displayW / displayH; valid(w) {
+			return videoSize{Width: int(w), Height: int(pixelH)}
+		}
+		return size
+	}
+	return videoSize{Width: int(pixelW), Height: int(pixelH)}
+}
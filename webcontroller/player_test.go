@@ -0,0 +1,322 @@
+package webcontroller
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+)
+
+// mp4Box returns an ISO base media box with a 32 bit size
+func mp4Box(typ string, body ...[]byte) []byte {
+	var b = bytes.Join(body, nil)
+	return append(append(binary.BigEndian.AppendUint32(nil, uint32(8+len(b))), typ...), b...)
+}
+
+// mp4LargeBox returns a box with a 64 bit size
+func mp4LargeBox(typ string, body ...[]byte) []byte {
+	var b = bytes.Join(body, nil)
+	var hdr = append(binary.BigEndian.AppendUint32(nil, 1), typ...)
+	return append(binary.BigEndian.AppendUint64(hdr, uint64(16+len(b))), b...)
+}
+
+// mp4BoxSize returns a box with a size which does not match its contents
+func mp4BoxSize(typ string, size uint32, body ...[]byte) []byte {
+	return append(append(binary.BigEndian.AppendUint32(nil, size), typ...), bytes.Join(body, nil)...)
+}
+
+var (
+	mp4Identity  = []uint32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000}
+	mp4Rotate90  = []uint32{0, 0x10000, 0, 0xFFFF0000, 0, 0, 0, 0, 0x40000000}
+	mp4Rotate180 = []uint32{0xFFFF0000, 0, 0, 0, 0xFFFF0000, 0, 0, 0, 0x40000000}
+)
+
+// mp4Tkhd returns a track header box. Version 1 has 64 bit times
+func mp4Tkhd(version byte, matrix []uint32, width, height uint32) []byte {
+	var b = []byte{version, 0, 0, 7}
+	if version == 1 {
+		b = append(b, make([]byte, 32)...)
+	} else {
+		b = append(b, make([]byte, 20)...)
+	}
+	b = append(b, make([]byte, 16)...) // Reserved, layer, group, volume
+	for _, v := range matrix {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	b = binary.BigEndian.AppendUint32(b, width<<16)
+	b = binary.BigEndian.AppendUint32(b, height<<16)
+	return mp4Box("tkhd", b)
+}
+
+var mp4Ftyp = mp4Box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2mp41"))
+
+func TestReadMP4Size(t *testing.T) {
+	var video = mp4Box("trak", mp4Tkhd(0, mp4Identity, 1920, 1080), mp4Box("mdia"))
+	var audio = mp4Box("trak", mp4Tkhd(0, mp4Identity, 0, 0))
+
+	for _, tt := range []struct {
+		name    string
+		file    []byte
+		size    int64 // Size of the file according to the API, 0 for the real size
+		want    videoSize
+		wantErr bool
+	}{
+		{name: "video", file: bytes.Join([][]byte{mp4Ftyp, mp4Box("moov", mp4Box("mvhd", make([]byte, 100)), video)}, nil),
+			want: videoSize{1920, 1080}},
+		{name: "tkhd version 1", file: bytes.Join([][]byte{mp4Ftyp, mp4Box("moov", mp4Box("trak", mp4Tkhd(1, mp4Identity, 640, 480)))}, nil),
+			want: videoSize{640, 480}},
+		{name: "rotated 90 degrees", file: bytes.Join([][]byte{mp4Ftyp, mp4Box("moov", mp4Box("trak", mp4Tkhd(0, mp4Rotate90, 1920, 1080)))}, nil),
+			want: videoSize{1080, 1920}},
+		{name: "rotated 180 degrees", file: bytes.Join([][]byte{mp4Ftyp, mp4Box("moov", mp4Box("trak", mp4Tkhd(0, mp4Rotate180, 1920, 1080)))}, nil),
+			want: videoSize{1920, 1080}},
+		{name: "audio track first", file: bytes.Join([][]byte{mp4Ftyp, mp4Box("moov", audio, video)}, nil),
+			want: videoSize{1920, 1080}},
+		{name: "only audio", file: bytes.Join([][]byte{mp4Ftyp, mp4Box("moov", audio)}, nil)},
+		{name: "mdat before moov", file: bytes.Join([][]byte{mp4Ftyp, mp4Box("mdat", make([]byte, 1000)), mp4Box("moov", video)}, nil),
+			want: videoSize{1920, 1080}},
+		{name: "64 bit box size", file: bytes.Join([][]byte{mp4Ftyp, mp4LargeBox("mdat", make([]byte, 1000)), mp4Box("moov", video)}, nil),
+			want: videoSize{1920, 1080}},
+		{name: "last box extends to the end", file: bytes.Join([][]byte{mp4Ftyp, mp4BoxSize("moov", 0, video)}, nil),
+			want: videoSize{1920, 1080}},
+		{name: "no moov", file: bytes.Join([][]byte{mp4Ftyp, mp4Box("free", make([]byte, 100))}, nil)},
+		{name: "empty", file: []byte{}},
+		{name: "short tkhd", file: bytes.Join([][]byte{mp4Ftyp, mp4Box("moov", mp4Box("trak", mp4Box("tkhd", make([]byte, 40))))}, nil)},
+
+		{name: "box smaller than its header", file: bytes.Join([][]byte{mp4Ftyp, mp4BoxSize("moov", 4)}, nil),
+			wantErr: true},
+		{name: "box larger than the file", file: bytes.Join([][]byte{mp4Ftyp, mp4BoxSize("moov", 1000, video)}, nil),
+			wantErr: true},
+		{name: "64 bit box larger than the file", file: bytes.Join([][]byte{mp4Ftyp, mp4BoxSize("mdat", 1, binary.BigEndian.AppendUint64(nil, 1<<62))}, nil),
+			wantErr: true},
+		{name: "child larger than its parent", file: bytes.Join([][]byte{mp4Ftyp, mp4Box("moov", mp4BoxSize("trak", 500, mp4Tkhd(0, mp4Identity, 1920, 1080)))}, nil),
+			wantErr: true},
+		{name: "file shorter than its size", file: bytes.Join([][]byte{mp4Ftyp, mp4Box("mdat", make([]byte, 100))}, nil), size: 10000,
+			wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var size = tt.size
+			if size == 0 {
+				size = int64(len(tt.file))
+			}
+			got, err := readMP4Size(bytes.NewReader(tt.file), size)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got size %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadMP4SizeTruncated(t *testing.T) {
+	var file = bytes.Join([][]byte{mp4Ftyp, mp4Box("moov", mp4Box("trak", mp4Tkhd(0, mp4Rotate90, 1920, 1080)))}, nil)
+	for i := range file {
+		// The file is cut off, but the API still reports the full size
+		got, err := readMP4Size(bytes.NewReader(file[:i]), int64(len(file)))
+		if err == nil && got != (videoSize{}) {
+			t.Errorf("got size %+v from %d of %d bytes", got, i, len(file))
+		}
+		// The file is cut off and the size is correct
+		if got, _ = readMP4Size(bytes.NewReader(file[:i]), int64(i)); got.Width < 0 || got.Height < 0 {
+			t.Errorf("got size %+v from %d bytes", got, i)
+		}
+	}
+}
+
+func TestEBMLVint(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		in      []byte
+		id      bool
+		want    int64
+		wantLen int
+	}{
+		{"one byte size", []byte{0x81}, false, 1, 1},
+		{"two byte size", []byte{0x40, 0x02}, false, 2, 2},
+		{"size with trailing bytes", []byte{0x82, 0xFF, 0xFF}, false, 2, 1},
+		{"eight byte size", []byte{0x01, 0, 0, 0, 0, 0, 0x01, 0x00}, false, 256, 8},
+		{"zero size", []byte{0x80}, false, 0, 1},
+		{"unknown size", []byte{0xFF}, false, -1, 1},
+		{"unknown eight byte size", []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, false, -1, 8},
+		{"not unknown", []byte{0x7F, 0xFE}, false, 0x3FFE, 2},
+		{"one byte id", []byte{0xAE}, true, 0xAE, 1},
+		{"four byte id", []byte{0x1A, 0x45, 0xDF, 0xA3}, true, 0x1A45DFA3, 4},
+		{"id with all bits set", []byte{0xFF}, true, 0xFF, 1},
+
+		{"empty", nil, false, 0, 0},
+		{"zero first byte", []byte{0x00, 0x81}, false, 0, 0},
+		{"truncated size", []byte{0x40}, false, 0, 0},
+		{"truncated eight byte size", []byte{0x01, 0, 0, 0}, false, 0, 0},
+		{"truncated id", []byte{0x1A, 0x45, 0xDF}, true, 0, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, n := ebmlVint(tt.in, tt.id)
+			if got != tt.want || n != tt.wantLen {
+				t.Errorf("ebmlVint(%x, %t) = %d, %d, want %d, %d", tt.in, tt.id, got, n, tt.want, tt.wantLen)
+			}
+		})
+	}
+}
+
+// mkvElement returns a Matroska element. The size is a two byte vint
+func mkvElement(id uint32, body ...[]byte) []byte {
+	var b = bytes.Join(body, nil)
+	var idBytes = binary.BigEndian.AppendUint32(nil, id)
+	for len(idBytes) > 1 && idBytes[0] == 0 {
+		idBytes = idBytes[1:]
+	}
+	return append(append(idBytes, 0x40|byte(len(b)>>8), byte(len(b))), b...)
+}
+
+// mkvUint returns an element with an unsigned integer value
+func mkvUint(id uint32, v uint64) []byte {
+	var b = binary.BigEndian.AppendUint64(nil, v)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return mkvElement(id, b)
+}
+
+// mkvUnknownSize returns an element with an unknown size, its body is the rest
+// of the file
+func mkvUnknownSize(id uint32, body ...[]byte) []byte {
+	var b = binary.BigEndian.AppendUint32(nil, id)
+	return append(append(b, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF), bytes.Join(body, nil)...)
+}
+
+var mkvHeader = mkvElement(0x1A45DFA3, mkvElement(0x4282, []byte("webm")))
+
+func mkvFile(tracks ...[]byte) []byte {
+	return append(bytes.Clone(mkvHeader), mkvElement(mkvSegment,
+		mkvElement(0x1549A966, mkvUint(0x2AD7B1, 1000000)), // Info
+		mkvElement(mkvTracks, tracks...),
+		mkvElement(mkvCluster, make([]byte, 100)),
+	)...)
+}
+
+func mkvVideoTrack(video ...[]byte) []byte {
+	return mkvElement(mkvTrackEntry, mkvUint(0xD7, 1), mkvUint(0x83, 1), mkvElement(mkvVideo, video...))
+}
+
+func TestReadMatroskaSize(t *testing.T) {
+	var audio = mkvElement(mkvTrackEntry, mkvUint(0xD7, 1), mkvUint(0x83, 2), mkvElement(0xE1, mkvUint(0xB5, 48000)))
+
+	for _, tt := range []struct {
+		name string
+		file []byte
+		want videoSize
+	}{
+		{"video", mkvFile(mkvVideoTrack(mkvUint(mkvPixelWidth, 1280), mkvUint(mkvPixelHeight, 720))),
+			videoSize{1280, 720}},
+		{"display aspect ratio", mkvFile(mkvVideoTrack(
+			mkvUint(mkvPixelWidth, 720), mkvUint(mkvPixelHeight, 576),
+			mkvUint(mkvDisplayWidth, 16), mkvUint(mkvDisplayHeight, 9),
+		)), videoSize{1024, 576}},
+		{"display size in pixels", mkvFile(mkvVideoTrack(
+			mkvUint(mkvPixelWidth, 1440), mkvUint(mkvPixelHeight, 1080),
+			mkvUint(mkvDisplayWidth, 1920), mkvUint(mkvDisplayHeight, 1080),
+		)), videoSize{1920, 1080}},
+		{"zero display height", mkvFile(mkvVideoTrack(
+			mkvUint(mkvPixelWidth, 1280), mkvUint(mkvPixelHeight, 720),
+			mkvUint(mkvDisplayWidth, 16), mkvUint(mkvDisplayHeight, 0),
+		)), videoSize{1280, 720}},
+		{"audio track first", mkvFile(audio, mkvVideoTrack(mkvUint(mkvPixelWidth, 640), mkvUint(mkvPixelHeight, 360))),
+			videoSize{640, 360}},
+		{"first video track wins", mkvFile(
+			mkvVideoTrack(mkvUint(mkvPixelWidth, 640), mkvUint(mkvPixelHeight, 360)),
+			mkvVideoTrack(mkvUint(mkvPixelWidth, 1920), mkvUint(mkvPixelHeight, 1080)),
+		), videoSize{640, 360}},
+		{"unknown segment size", append(bytes.Clone(mkvHeader), mkvUnknownSize(mkvSegment,
+			mkvElement(mkvTracks, mkvVideoTrack(mkvUint(mkvPixelWidth, 1280), mkvUint(mkvPixelHeight, 720))),
+		)...), videoSize{1280, 720}},
+		{"only audio", mkvFile(audio), videoSize{}},
+		{"no height", mkvFile(mkvVideoTrack(mkvUint(mkvPixelWidth, 1280))), videoSize{}},
+		{"empty values", mkvFile(mkvVideoTrack(mkvElement(mkvPixelWidth), mkvElement(mkvPixelHeight))), videoSize{}},
+		{"cluster before tracks", append(bytes.Clone(mkvHeader), mkvElement(mkvSegment,
+			mkvElement(mkvCluster, make([]byte, 10)),
+			mkvElement(mkvTracks, mkvVideoTrack(mkvUint(mkvPixelWidth, 1280), mkvUint(mkvPixelHeight, 720))),
+		)...), videoSize{}},
+		{"negative values", mkvFile(mkvVideoTrack(
+			mkvUint(mkvPixelWidth, 1<<63), mkvUint(mkvPixelHeight, 1<<63),
+		)), videoSize{}},
+		{"huge values", mkvFile(mkvVideoTrack(
+			mkvUint(mkvPixelWidth, 1280), mkvUint(mkvPixelHeight, 1<<40),
+		)), videoSize{}},
+		{"huge display size", mkvFile(mkvVideoTrack(
+			mkvUint(mkvPixelWidth, 1280), mkvUint(mkvPixelHeight, 720),
+			mkvUint(mkvDisplayWidth, 1<<40), mkvUint(mkvDisplayHeight, 1),
+		)), videoSize{1280, 720}},
+		{"extreme aspect ratio", mkvFile(mkvVideoTrack(
+			mkvUint(mkvPixelWidth, 1280), mkvUint(mkvPixelHeight, 60000),
+			mkvUint(mkvDisplayWidth, 60000), mkvUint(mkvDisplayHeight, 1),
+		)), videoSize{}},
+		{"invalid element id", append(bytes.Clone(mkvHeader), 0x00, 0x00, 0x00), videoSize{}},
+		{"empty", nil, videoSize{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readMatroskaSize(tt.file); got != tt.want {
+				t.Errorf("got size %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadMatroskaSizeTruncated(t *testing.T) {
+	var file = mkvFile(mkvVideoTrack(
+		mkvUint(mkvPixelWidth, 720), mkvUint(mkvPixelHeight, 576),
+		mkvUint(mkvDisplayWidth, 16), mkvUint(mkvDisplayHeight, 9),
+	))
+	for i := range file {
+		if got := readMatroskaSize(file[:i]); got.Width < 0 || got.Height < 0 {
+			t.Errorf("got size %+v from %d bytes", got, i)
+		}
+	}
+}
+
+func TestGetVideoSize(t *testing.T) {
+	var file = bytes.Join([][]byte{mp4Ftyp, mp4Box("moov", mp4Box("trak", mp4Tkhd(0, mp4Identity, 1920, 1080)))}, nil)
+	var wc, _ = archiveTestServer(t, file)
+	wc.cache = newAPICache()
+	var info = pixelapi.FileInfo{ID: "test", Size: int64(len(file))}
+	var newReader = func(ctx context.Context) *apiRangeReader {
+		return wc.newRangeReader(ctx, archiveTestTD, info, videoSizeMaxRead)
+	}
+
+	// Pages which don't need the size don't wait for it
+	if size := wc.getVideoSize("test", false, newReader); size != (videoSize{}) {
+		t.Errorf("got size %+v without waiting", size)
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := wc.cache.videoSize.peek("test"); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if size := wc.getVideoSize("test", false, newReader); size != (videoSize{1920, 1080}) {
+		t.Errorf("got size %+v after reading in the background", size)
+	}
+
+	// Failures are cached
+	var requests atomic.Int64
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	wc = &WebController{apiHTTPClient: srv.Client(), config: Config{APIURLInternal: srv.URL}, cache: newAPICache()}
+	for i := 0; i < 3; i++ {
+		if size := wc.getVideoSize("broken", true, newReader); size != (videoSize{}) {
+			t.Errorf("got size %+v from a failing API", size)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+}
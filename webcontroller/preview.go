@@ -0,0 +1,835 @@
+package webcontroller
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+	"fornaxian.tech/util"
+	"github.com/julienschmidt/httprouter"
+	"github.com/microcosm-cc/bluemonday"
+	blackfriday "github.com/russross/blackfriday/v2"
+)
+
+// Previews are HTML fragments which the file viewer shows for file types the
+// browser can't display by itself. The renderer is picked by the extension of
+// the file name first and by the mime type second. When a renderer fails, for
+// example because a JSON file is not valid, the next matching renderer is
+// tried. If none of them work the file is shown as plain text
+type previewFunc func(wc *WebController, out *bytes.Buffer, r *http.Request, td *TemplateData, file pixelapi.FileInfo, body []byte) error
+
+type previewRenderer struct {
+	name       string
+	extensions []string // Lowercase extensions including the dot, like .tar.gz
+	mimeTypes  []string // Mime types, a type ending with a slash matches all subtypes
+	maxSize    int64    // The whole file is loaded in memory, larger files are not rendered
+	stream     bool     // The renderer reads the file itself, the body is nil
+	render     previewFunc
+}
+
+// errPreviewTooLarge is returned when a file or the part of it which is needed
+// for the preview is larger than the renderer allows
+var errPreviewTooLarge = errors.New("file is too large for preview")
+
+var previewRenderers []*previewRenderer
+
+// registerPreviewRenderer adds a renderer to the registry. Renderers which are
+// registered first take precedence
+func registerPreviewRenderer(pr *previewRenderer) {
+	previewRenderers = append(previewRenderers, pr)
+}
+
+// previewCodeExtensions and previewCodeMimeTypes map files to the languages in
+// syntaxLanguages
+var (
+	previewCodeExtensions = map[string]string{
+		".go": "go", ".js": "js", ".mjs": "js", ".cjs": "js", ".ts": "js",
+		".py": "python", ".sh": "sh", ".bash": "sh", ".c": "c", ".h": "c",
+		".cpp": "cpp", ".cc": "cpp", ".hpp": "cpp", ".java": "java", ".cs": "cs",
+		".rs": "rust",
+	}
+	previewCodeMimeTypes = map[string]string{
+		"application/x-shellscript": "sh",
+		"application/javascript":    "js",
+		"text/javascript":           "js",
+		"text/x-shellscript":        "sh",
+		"text/x-python":             "python",
+		"text/x-script.python":      "python",
+		"text/x-go":                 "go",
+		"text/x-c":                  "c",
+		"text/x-c++":                "cpp",
+		"text/x-java":               "java",
+		"text/rust":                 "rust",
+	}
+)
+
+var previewText = &previewRenderer{
+	name:       "text",
+	extensions: []string{".txt", ".log"},
+	mimeTypes:  []string{"text/"},
+	maxSize:    4 << 20,
+	render:     previewPlainText,
+}
+
+func init() {
+	registerPreviewRenderer(&previewRenderer{
+		name:       "markdown",
+		extensions: []string{".md", ".markdown"},
+		mimeTypes:  []string{"text/markdown", "text/x-markdown"},
+		maxSize:    4 << 20,
+		render:     previewMarkdown,
+	})
+	registerPreviewRenderer(&previewRenderer{
+		name:       "notebook",
+		extensions: []string{".ipynb"},
+		mimeTypes:  []string{"application/x-ipynb+json"},
+		maxSize:    16 << 20, // Notebooks contain the images of the outputs
+		render:     previewNotebook,
+	})
+	registerPreviewRenderer(&previewRenderer{
+		name:       "json",
+		extensions: []string{".json", ".geojson"},
+		mimeTypes:  []string{"application/json", "application/ld+json", "application/geo+json"},
+		maxSize:    2 << 20,
+		render:     previewJSON,
+	})
+	registerPreviewRenderer(&previewRenderer{
+		name:       "yaml",
+		extensions: []string{".yaml", ".yml"},
+		mimeTypes:  []string{"application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml"},
+		maxSize:    2 << 20,
+		render:     previewYAML,
+	})
+	registerPreviewRenderer(&previewRenderer{
+		name:       "csv",
+		extensions: []string{".csv"},
+		mimeTypes:  []string{"text/csv"},
+		maxSize:    8 << 20,
+		render:     previewTable(','),
+	})
+	registerPreviewRenderer(&previewRenderer{
+		name:       "tsv",
+		extensions: []string{".tsv", ".tab"},
+		mimeTypes:  []string{"text/tab-separated-values"},
+		maxSize:    8 << 20,
+		render:     previewTable('\t'),
+	})
+	registerPreviewRenderer(&previewRenderer{
+		name:       "subtitles",
+		extensions: []string{".srt", ".vtt"},
+		mimeTypes:  []string{"application/x-subrip", "text/vtt"},
+		maxSize:    2 << 20,
+		render:     previewSubtitles,
+	})
+
+	// Highlighting is slow on large files, those are shown as plain text
+	var code = &previewRenderer{name: "code", maxSize: 512 << 10, render: previewCode}
+	for ext := range previewCodeExtensions {
+		code.extensions = append(code.extensions, ext)
+	}
+	for mime := range previewCodeMimeTypes {
+		code.mimeTypes = append(code.mimeTypes, mime)
+	}
+	registerPreviewRenderer(code)
+	registerPreviewRenderer(previewText)
+}
+
+// previewPolicy sanitises the output of the renderers. The classes are
+// restricted to the ones used by the previews so user content can't use the
+// styles of the website
+var previewPolicy = func() *bluemonday.Policy {
+	var p = bluemonday.UGCPolicy()
+	p.AllowAttrs("class").Matching(
+		regexp.MustCompile(`^(?:(?:preview|hl)_[a-z_]+ ?)+$`),
+	).Globally()
+	p.AllowDataURIImages() // Images in notebook outputs
+	return p
+}()
+
+func (pr *previewRenderer) matchExtension(name string) bool {
+	name = strings.ToLower(name)
+	for _, e := range pr.extensions {
+		if strings.HasSuffix(name, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pr *previewRenderer) matchMimeType(mimeType string) bool {
+	mimeType, _, _ = strings.Cut(strings.ToLower(mimeType), ";")
+	mimeType = strings.TrimSpace(mimeType)
+	for _, m := range pr.mimeTypes {
+		if mimeType == m || (strings.HasSuffix(m, "/") && strings.HasPrefix(mimeType, m)) {
+			return true
+		}
+	}
+	return false
+}
+
+// findPreviewRenderers returns the renderers which can show a file, in the
+// order in which they should be tried
+func findPreviewRenderers(file pixelapi.FileInfo) (list []*previewRenderer) {
+	var add = func(pr *previewRenderer) {
+		for _, existing := range list {
+			if existing == pr {
+				return
+			}
+		}
+		list = append(list, pr)
+	}
+	for _, pr := range previewRenderers {
+		if pr.matchExtension(file.Name) {
+			add(pr)
+		}
+	}
+	for _, pr := range previewRenderers {
+		if pr.matchMimeType(file.MimeType) {
+			add(pr)
+		}
+	}
+	return list
+}
+
+func writePreviewMessage(w io.Writer, msg string) {
+	w.Write([]byte(`<p class="preview_message">` + html.EscapeString(msg) + "</p>\n"))
+}
+
+func (wc *WebController) serveFilePreview(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var td = wc.newTemplateData(w, r)
+	file, err := wc.getFileInfo(td, p.ByName("id"))
+	if err != nil {
+		wc.serveAPIError(w, r, td, err, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+
+	var renderers = findPreviewRenderers(file)
+	if len(renderers) == 0 {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		writePreviewMessage(w, td.Locale.T("preview.unsupported"))
+		return
+	}
+
+	var out = getMarkdownBuf()
+	defer putMarkdownBuf(out)
+	if err = wc.renderPreview(out, r, td, file, renderers); errors.Is(err, errPreviewTooLarge) {
+		writePreviewMessage(w, td.Locale.T("preview.too_large"))
+		return
+	} else if err != nil {
+		writePreviewMessage(w, td.Locale.T("preview.error"))
+		return
+	}
+
+	if _, err = w.Write(previewPolicy.SanitizeBytes(out.Bytes())); err != nil && !util.IsNetError(err) {
+		log.Error("Failed to write preview: %s", err)
+	}
+}
+
+// renderPreview runs the first renderer which succeeds. Streaming renderers
+// read the file themselves, for the others the file is downloaded once
+func (wc *WebController) renderPreview(
+	out *bytes.Buffer,
+	r *http.Request,
+	td *TemplateData,
+	file pixelapi.FileInfo,
+	renderers []*previewRenderer,
+) (err error) {
+	if renderers[0].stream {
+		if err = renderers[0].render(wc, out, r, td, file, nil); err != nil && !errors.Is(err, errPreviewTooLarge) {
+			log.Debug("Preview renderer '%s' failed on file %s: %s", renderers[0].name, file.ID, err)
+		}
+		return err
+	}
+
+	// Plain text is the last resort if all the other renderers fail. The
+	// file is only downloaded once, so only renderers which accept the size
+	// of the first one can be tried
+	if renderers[len(renderers)-1] != previewText {
+		renderers = append(renderers, previewText)
+	}
+	for len(renderers) > 0 && file.Size > renderers[0].maxSize {
+		renderers = renderers[1:]
+	}
+	if len(renderers) == 0 {
+		return errPreviewTooLarge
+	}
+
+	body, err := td.PixelAPI.GetFile(file.ID)
+	if err != nil {
+		log.Error("Can't download file for preview: %s", err)
+		return err
+	}
+	defer body.Close()
+
+	// The size in the file info could be outdated, never read more than the
+	// renderer allows
+	data, err := io.ReadAll(io.LimitReader(body, renderers[0].maxSize+1))
+	if err != nil {
+		log.Error("Can't read file for preview: %s", err)
+		return err
+	} else if int64(len(data)) > renderers[0].maxSize {
+		return errPreviewTooLarge
+	}
+
+	for _, pr := range renderers {
+		if int64(len(data)) > pr.maxSize {
+			continue
+		}
+		if err = pr.render(wc, out, r, td, file, data); err == nil {
+			return nil
+		}
+		log.Debug("Preview renderer '%s' failed on file %s: %s", pr.name, file.ID, err)
+		out.Reset()
+	}
+	return err
+}
+
+// previewSource returns the text of a file with normalised line endings
+func previewSource(body []byte) string {
+	var text = strings.ToValidUTF8(string(body), "\uFFFD")
+	text = strings.TrimPrefix(text, "\uFEFF") // Byte order mark
+	return strings.ReplaceAll(text, "\r\n", "\n")
+}
+
+func previewMarkdown(wc *WebController, out *bytes.Buffer, r *http.Request, td *TemplateData, file pixelapi.FileInfo, body []byte) error {
+	out.Write(blackfriday.Run(body))
+	return nil
+}
+
+func previewPlainText(wc *WebController, out *bytes.Buffer, r *http.Request, td *TemplateData, file pixelapi.FileInfo, body []byte) error {
+	writeNumberedLines(out, previewSource(body), nil)
+	return nil
+}
+
+func previewCode(wc *WebController, out *bytes.Buffer, r *http.Request, td *TemplateData, file pixelapi.FileInfo, body []byte) error {
+	var lang, ok = previewCodeExtensions[strings.ToLower(path.Ext(file.Name))]
+	if !ok {
+		var mimeType, _, _ = strings.Cut(file.MimeType, ";")
+		lang = previewCodeMimeTypes[strings.TrimSpace(mimeType)]
+	}
+	writeNumberedLines(out, previewSource(body), syntaxLanguages[lang])
+	return nil
+}
+
+// writeNumberedLines writes text with line numbers in a separate column, so
+// the numbers are not copied along with the text. If rules is not nil the text
+// is highlighted
+func writeNumberedLines(out *bytes.Buffer, text string, rules *syntaxRules) {
+	text = strings.TrimSuffix(text, "\n")
+	var lines = strings.Count(text, "\n") + 1
+
+	out.WriteString(`<div class="preview_code"><pre class="preview_gutter">`)
+	for i := 1; i <= lines; i++ {
+		out.WriteString(strconv.Itoa(i))
+		out.WriteByte('\n')
+	}
+	out.WriteString(`</pre><pre class="preview_source"><code>`)
+	if rules != nil {
+		rules.highlight(out, text)
+	} else {
+		out.WriteString(html.EscapeString(text))
+	}
+	out.WriteString("</code></pre></div>\n")
+}
+
+// previewTableRows is the number of rows on a page of a CSV or TSV table
+const previewTableRows = 100
+
+// previewTable renders delimited text as a table. The first row is used as the
+// header and is repeated on every page
+func previewTable(comma rune) previewFunc {
+	return func(wc *WebController, out *bytes.Buffer, r *http.Request, td *TemplateData, file pixelapi.FileInfo, body []byte) error {
+		var rd = csv.NewReader(strings.NewReader(previewSource(body)))
+		rd.Comma = comma
+		rd.FieldsPerRecord = -1
+		rd.LazyQuotes = true
+		records, err := rd.ReadAll()
+		if err != nil {
+			return err
+		} else if len(records) == 0 {
+			return errors.New("file contains no records")
+		}
+
+		var header, rows = records[0], records[1:]
+		var pages = max((len(rows)+previewTableRows-1)/previewTableRows, 1)
+		var page, _ = strconv.Atoi(r.FormValue("page"))
+		page = min(max(page, 1), pages)
+		rows = rows[(page-1)*previewTableRows : min(page*previewTableRows, len(rows))]
+
+		var writeRow = func(cell string, row []string) {
+			out.WriteString("<tr>")
+			for _, field := range row {
+				out.WriteString("<" + cell + ">" + html.EscapeString(field) + "</" + cell + ">")
+			}
+			out.WriteString("</tr>\n")
+		}
+
+		out.WriteString(`<div class="preview_table"><table><thead>`)
+		writeRow("th", header)
+		out.WriteString("</thead><tbody>\n")
+		for _, row := range rows {
+			writeRow("td", row)
+		}
+		out.WriteString("</tbody></table></div>\n")
+
+		if pages > 1 {
+			writePreviewPager(out, td, page, pages)
+		}
+		return nil
+	}
+}
+
+// writePreviewPager writes the links to the previous and next pages. The file
+// viewer loads the pages in place, without a script the links lead to the
+// viewer page with the page parameter
+func writePreviewPager(out *bytes.Buffer, td *TemplateData, page, pages int) {
+	var link = func(page int, label string) {
+		out.WriteString(`<a class="preview_page" href="?page=` + strconv.Itoa(page) + `">` +
+			html.EscapeString(label) + `</a>`)
+	}
+
+	out.WriteString(`<div class="preview_pager">`)
+	if page > 1 {
+		link(page-1, td.Locale.T("preview.previous"))
+	}
+	out.WriteString(`<span>` + html.EscapeString(td.Locale.T("preview.page", page, pages)) + `</span>`)
+	if page < pages {
+		link(page+1, td.Locale.T("preview.next"))
+	}
+	out.WriteString("</div>\n")
+}
+
+// previewMaxDepth limits the nesting of JSON documents, the renderer is
+// recursive
+const previewMaxDepth = 100
+
+// previewJSON pretty-prints a JSON document. Objects and arrays can be
+// collapsed. Files with multiple JSON documents, like JSON lines, are
+// supported too
+func previewJSON(wc *WebController, out *bytes.Buffer, r *http.Request, td *TemplateData, file pixelapi.FileInfo, body []byte) error {
+	var dec = json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	out.WriteString(`<div class="preview_tree">`)
+	for {
+		if err := writeJSONValue(out, dec, "", 0); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	out.WriteString("</div>\n")
+	return nil
+}
+
+// writeJSONValue reads the next value from the decoder and writes it to the
+// output. The key is written in front of the value, it's empty for array
+// elements
+func writeJSONValue(out *bytes.Buffer, dec *json.Decoder, key string, depth int) error {
+	if depth > previewMaxDepth {
+		return errors.New("document is nested too deeply")
+	}
+
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	// The decoder is already past the value at the time the comma is
+	// written, so More tells if the parent has more elements
+	var comma = func() string {
+		if depth > 0 && dec.More() {
+			return ","
+		}
+		return ""
+	}
+
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		out.WriteString("<div>" + key + jsonScalar(tok) + comma() + "</div>")
+		return nil
+	}
+
+	var open, close, class = "{", "}", "preview_tree_object"
+	if delim == '[' {
+		open, close, class = "[", "]", "preview_tree_array"
+	}
+
+	if !dec.More() {
+		if _, err = dec.Token(); err != nil {
+			return err
+		}
+		out.WriteString("<div>" + key + open + close + comma() + "</div>")
+		return nil
+	}
+
+	out.WriteString(`<details open class="` + class + `"><summary>` + key + open +
+		`</summary><div class="preview_tree_items">`)
+	for dec.More() {
+		var itemKey string
+		if delim == '{' {
+			if tok, err = dec.Token(); err != nil {
+				return err
+			}
+			name, _ := tok.(string)
+			itemKey = `<span class="hl_name">` + html.EscapeString(strconv.Quote(name)) + `</span>: `
+		}
+		if err = writeJSONValue(out, dec, itemKey, depth+1); err != nil {
+			return err
+		}
+	}
+	if _, err = dec.Token(); err != nil {
+		return err
+	}
+	out.WriteString("</div>" + close + comma() + "</details>")
+	return nil
+}
+
+func jsonScalar(tok json.Token) string {
+	switch v := tok.(type) {
+	case string:
+		return `<span class="hl_string">` + html.EscapeString(strconv.Quote(v)) + `</span>`
+	case json.Number:
+		return `<span class="hl_number">` + html.EscapeString(v.String()) + `</span>`
+	case bool:
+		return `<span class="hl_number">` + strconv.FormatBool(v) + `</span>`
+	default:
+		return `<span class="hl_number">null</span>`
+	}
+}
+
+// yamlLineRegex splits a line of YAML in the indentation with list markers,
+// the key and the rest of the line
+var yamlLineRegex = regexp.MustCompile(`^(\s*(?:- +)*)(?:("[^"]*"|'[^']*'|[^\s"'#][^#]*?):(?: +|$))?(.*)$`)
+
+// previewYAML highlights a YAML document and makes the indented blocks
+// collapsible. YAML is not parsed, the blocks are found by indentation, so
+// files with syntax errors are shown as well
+func previewYAML(wc *WebController, out *bytes.Buffer, r *http.Request, td *TemplateData, file pixelapi.FileInfo, body []byte) error {
+	var lines = strings.Split(strings.TrimSuffix(previewSource(body), "\n"), "\n")
+
+	// Blank lines and comments don't open or close blocks
+	var indent = func(line string) int {
+		var trimmed = strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			return -1
+		}
+		// List items are nested one level deeper than their parent, even if
+		// they're not indented
+		var n = len(line) - len(trimmed)
+		if trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+			n++
+		}
+		return n
+	}
+
+	var open []int // Indentation of the lines which opened the current blocks
+	out.WriteString(`<div class="preview_tree preview_yaml">`)
+	for i, line := range lines {
+		var level = indent(line)
+		for level != -1 && len(open) > 0 && level <= open[len(open)-1] {
+			out.WriteString("</div></details>")
+			open = open[:len(open)-1]
+		}
+
+		var next = -1
+		for j := i + 1; j < len(lines) && next == -1; j++ {
+			next = indent(lines[j])
+		}
+
+		if level != -1 && next > level {
+			out.WriteString("<details open><summary>")
+			writeYAMLLine(out, line)
+			out.WriteString(`</summary><div class="preview_tree_items">`)
+			open = append(open, level)
+		} else {
+			out.WriteString("<div>")
+			writeYAMLLine(out, line)
+			out.WriteString(" </div>") // The space keeps empty lines from collapsing
+		}
+	}
+	for range open {
+		out.WriteString("</div></details>")
+	}
+	out.WriteString("</div>\n")
+	return nil
+}
+
+func writeYAMLLine(out *bytes.Buffer, line string) {
+	var match = yamlLineRegex.FindStringSubmatch(line)
+	if match == nil {
+		out.WriteString(html.EscapeString(line))
+		return
+	}
+
+	out.WriteString(html.EscapeString(match[1]))
+	if match[2] != "" {
+		writeToken(out, hlName, match[2])
+		out.WriteString(": ")
+	}
+
+	var value, comment = match[3], ""
+	if i := yamlCommentIndex(value); i != -1 {
+		value, comment = value[:i], value[i:]
+	}
+
+	var trimmed = strings.TrimSpace(value)
+	switch {
+	case trimmed == "":
+		out.WriteString(html.EscapeString(value))
+	case strings.HasPrefix(trimmed, `"`) || strings.HasPrefix(trimmed, "'"):
+		writeToken(out, hlString, value)
+	case strings.HasPrefix(trimmed, "&") || strings.HasPrefix(trimmed, "*") ||
+		strings.HasPrefix(trimmed, "!") || trimmed == "|" || trimmed == ">" ||
+		trimmed == "---" || trimmed == "...":
+		writeToken(out, hlKeyword, value)
+	case yamlLiteral(trimmed):
+		writeToken(out, hlNumber, value)
+	default:
+		out.WriteString(html.EscapeString(value))
+	}
+
+	if comment != "" {
+		writeToken(out, hlComment, comment)
+	}
+}
+
+// yamlCommentIndex returns the start of the comment in a YAML value, or -1. A
+// comment starts with a # at the start of the value or after a space, outside
+// of quotes
+func yamlCommentIndex(s string) int {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' '):
+			return i
+		}
+	}
+	return -1
+}
+
+func yamlLiteral(s string) bool {
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "null", "~":
+		return true
+	}
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
+var (
+	subtitleTimeRegex  = regexp.MustCompile(`^\s*((?:\d+:)?\d{1,2}:\d{2})[.,]\d+\s+-->`)
+	subtitleVoiceRegex = regexp.MustCompile(`<v(?:\.[\w.-]+)?\s+([^>]+)>`)
+	subtitleStyleRegex = regexp.MustCompile(`{\\[^}]*}`) // SubRip position tags like {\an8}
+)
+
+// previewSubtitles shows the cues of a SubRip or WebVTT file as a transcript.
+// Formatting tags are removed, WebVTT voices are shown as the name of the
+// speaker
+func previewSubtitles(wc *WebController, out *bytes.Buffer, r *http.Request, td *TemplateData, file pixelapi.FileInfo, body []byte) error {
+	var cues = 0
+	out.WriteString(`<div class="preview_transcript">`)
+	for _, block := range strings.Split(previewSource(body), "\n\n") {
+		var lines = strings.Split(strings.Trim(block, "\n"), "\n")
+		for i, line := range lines {
+			var match = subtitleTimeRegex.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+
+			var text = strings.Join(lines[i+1:], "\n")
+			text = subtitleVoiceRegex.ReplaceAllString(text, "$1: ")
+			text = subtitleStyleRegex.ReplaceAllString(text, "")
+			text = strings.TrimSpace(html.UnescapeString(htmlTagRegex.ReplaceAllString(text, "")))
+			// Hours are only shown when the video is that long
+			var start = match[1]
+			if strings.Count(start, ":") == 2 {
+				start = strings.TrimPrefix(start, "00:")
+			}
+			if text != "" {
+				out.WriteString(`<div class="preview_cue"><span class="preview_cue_time">` +
+					html.EscapeString(start) + `</span><p>` +
+					strings.ReplaceAll(html.EscapeString(text), "\n", "<br/>") + "</p></div>\n")
+				cues++
+			}
+			break
+		}
+	}
+	out.WriteString("</div>\n")
+
+	if cues == 0 {
+		return errors.New("no subtitle cues found")
+	}
+	return nil
+}
+
+// notebookText is a multiline string in a Jupyter notebook, which is either a
+// string or a list of lines
+type notebookText string
+
+func (t *notebookText) UnmarshalJSON(b []byte) error {
+	var lines []string
+	if err := json.Unmarshal(b, &lines); err == nil {
+		*t = notebookText(strings.Join(lines, ""))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*t = notebookText(s)
+	return nil
+}
+
+type notebook struct {
+	Cells []struct {
+		CellType       string       `json:"cell_type"`
+		Source         notebookText `json:"source"`
+		ExecutionCount *int         `json:"execution_count"`
+		Outputs        []struct {
+			OutputType     string                     `json:"output_type"`
+			ExecutionCount *int                       `json:"execution_count"`
+			Text           notebookText               `json:"text"`
+			Data           map[string]json.RawMessage `json:"data"`
+			EName          string                     `json:"ename"`
+			EValue         string                     `json:"evalue"`
+			Traceback      []string                   `json:"traceback"`
+		} `json:"outputs"`
+	} `json:"cells"`
+	Metadata struct {
+		KernelSpec struct {
+			Language string `json:"language"`
+		} `json:"kernelspec"`
+		LanguageInfo struct {
+			Name string `json:"name"`
+		} `json:"language_info"`
+	} `json:"metadata"`
+}
+
+// ansiEscapeRegex matches the terminal colour codes in tracebacks
+var ansiEscapeRegex = regexp.MustCompile("\x1b\\[[0-9;]*[A-Za-z]")
+
+// previewNotebook renders the cells of a Jupyter notebook with their outputs.
+// Rich outputs are shown in order of preference: images, HTML, markdown and
+// plain text
+func previewNotebook(wc *WebController, out *bytes.Buffer, r *http.Request, td *TemplateData, file pixelapi.FileInfo, body []byte) error {
+	var nb notebook
+	if err := json.Unmarshal(body, &nb); err != nil {
+		return err
+	} else if nb.Cells == nil {
+		return errors.New("file has no notebook cells")
+	}
+
+	var lang = nb.Metadata.LanguageInfo.Name
+	if lang == "" {
+		lang = nb.Metadata.KernelSpec.Language
+	}
+	var rules = syntaxLanguages[strings.ToLower(lang)]
+
+	var cell = func(class, prompt string, content func()) {
+		out.WriteString(`<div class="preview_cell ` + class + `"><div class="preview_cell_prompt">` +
+			html.EscapeString(prompt) + `</div><div class="preview_cell_body">`)
+		content()
+		out.WriteString("</div></div>\n")
+	}
+	var count = func(n *int) string {
+		if n == nil {
+			return "[ ]:"
+		}
+		return fmt.Sprintf("[%d]:", *n)
+	}
+	var pre = func(text string) {
+		out.WriteString("<pre>" + html.EscapeString(text) + "</pre>")
+	}
+
+	out.WriteString(`<div class="preview_notebook">`)
+	for _, c := range nb.Cells {
+		switch c.CellType {
+		case "markdown":
+			cell("preview_cell_markdown", "", func() {
+				out.Write(blackfriday.Run([]byte(c.Source)))
+			})
+		case "code":
+			cell("preview_cell_code", "In "+count(c.ExecutionCount), func() {
+				out.WriteString("<pre><code>")
+				if rules != nil {
+					rules.highlight(out, string(c.Source))
+				} else {
+					out.WriteString(html.EscapeString(string(c.Source)))
+				}
+				out.WriteString("</code></pre>")
+			})
+		default:
+			cell("preview_cell_raw", "", func() { pre(string(c.Source)) })
+		}
+
+		for _, o := range c.Outputs {
+			var prompt = ""
+			if o.OutputType == "execute_result" {
+				prompt = "Out " + count(o.ExecutionCount)
+			}
+			cell("preview_cell_output", prompt, func() {
+				switch o.OutputType {
+				case "stream":
+					pre(string(o.Text))
+				case "error":
+					pre(ansiEscapeRegex.ReplaceAllString(strings.Join(o.Traceback, "\n"), ""))
+					if len(o.Traceback) == 0 {
+						pre(o.EName + ": " + o.EValue)
+					}
+				default:
+					writeNotebookData(out, o.Data)
+				}
+			})
+		}
+	}
+	out.WriteString("</div>\n")
+	return nil
+}
+
+func writeNotebookData(out *bytes.Buffer, data map[string]json.RawMessage) {
+	var get = func(mimeType string) (string, bool) {
+		var text notebookText
+		if raw, ok := data[mimeType]; !ok || json.Unmarshal(raw, &text) != nil {
+			return "", false
+		}
+		return string(text), true
+	}
+
+	// SVG images are not included, the sanitiser does not allow them because
+	// they can contain scripts. Plots usually have a text fallback
+	for _, mimeType := range []string{"image/png", "image/jpeg", "image/gif"} {
+		if img, ok := get(mimeType); ok {
+			out.WriteString(`<img src="data:` + mimeType + ";base64," +
+				strings.Join(strings.Fields(img), "") + `"/>`)
+			return
+		}
+	}
+	if h, ok := get("text/html"); ok {
+		out.WriteString(h) // Sanitised with the rest of the preview
+	} else if md, ok := get("text/markdown"); ok {
+		out.Write(blackfriday.Run([]byte(md)))
+	} else if text, ok := get("text/plain"); ok {
+		out.WriteString("<pre>" + html.EscapeString(text) + "</pre>")
+	}
+}
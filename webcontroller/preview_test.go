@@ -0,0 +1,328 @@
+package webcontroller
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+)
+
+// runPreview runs a preview renderer and sanitises the output like
+// serveFilePreview does
+func runPreview(t *testing.T, render previewFunc, name, query, body string) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	var td = &TemplateData{Locale: &locale{Tag: defaultLocale}}
+	var r = httptest.NewRequest("GET", "/u/test/preview"+query, nil)
+	if err := render(nil, &out, r, td, pixelapi.FileInfo{Name: name}, []byte(body)); err != nil {
+		return "", err
+	}
+	return string(previewPolicy.SanitizeBytes(out.Bytes())), nil
+}
+
+// checkPreview checks that the output contains all the wanted strings and none
+// of the unwanted ones
+func checkPreview(t *testing.T, got string, want, notWant []string) {
+	t.Helper()
+	for _, s := range want {
+		if !strings.Contains(got, s) {
+			t.Errorf("output does not contain %q:\n%s", s, got)
+		}
+	}
+	for _, s := range notWant {
+		if strings.Contains(got, s) {
+			t.Errorf("output contains %q:\n%s", s, got)
+		}
+	}
+}
+
+func TestPreviewTable(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		comma   rune
+		query   string
+		body    string
+		want    []string
+		notWant []string
+	}{
+		{
+			name:  "csv",
+			comma: ',',
+			body:  "name,size\r\nfile.txt,10\r\n\"a, b\",20\r\n",
+			want:  []string{"<th>name</th><th>size</th>", "<td>file.txt</td><td>10</td>", "<td>a, b</td>"},
+		}, {
+			name:  "tsv",
+			comma: '\t',
+			body:  "a\tb\n1\t2",
+			want:  []string{"<th>a</th><th>b</th>", "<td>1</td><td>2</td>"},
+		}, {
+			name:  "uneven rows and lazy quotes",
+			comma: ',',
+			body:  "a,b,c\n1\n2,x\"y\",3,4",
+			want:  []string{"<td>1</td></tr>", "<td>x&#34;y&#34;</td>", "<td>4</td>"},
+		}, {
+			name:    "escaped",
+			comma:   ',',
+			body:    "<script>alert(1)</script>,b\n<b>bold</b>,c",
+			want:    []string{"&lt;script&gt;", "&lt;b&gt;bold&lt;/b&gt;"},
+			notWant: []string{"<script>", "<b>"},
+		}, {
+			name:    "first page",
+			comma:   ',',
+			body:    "n\n" + tableRows(1, 150),
+			want:    []string{"<td>1</td>", "<td>100</td>", `href="?page=2"`, "preview.page"},
+			notWant: []string{"<td>101</td>", `href="?page=1"`},
+		}, {
+			name:    "second page",
+			comma:   ',',
+			query:   "?page=2",
+			body:    "n\n" + tableRows(1, 150),
+			want:    []string{"<th>n</th>", "<td>101</td>", "<td>150</td>", `href="?page=1"`},
+			notWant: []string{"<td>100</td>", `href="?page=3"`},
+		}, {
+			name:    "page out of range",
+			comma:   ',',
+			query:   "?page=99",
+			body:    "n\n" + tableRows(1, 150),
+			want:    []string{"<td>150</td>"},
+			notWant: []string{"<td>100</td>"},
+		}, {
+			name:    "single page",
+			comma:   ',',
+			body:    "n\n1",
+			notWant: []string{"preview_pager"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runPreview(t, previewTable(tt.comma), "file.csv", tt.query, tt.body)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			checkPreview(t, got, tt.want, tt.notWant)
+		})
+	}
+
+	for _, body := range []string{"", "\uFEFF", "\n\n"} {
+		if _, err := runPreview(t, previewTable(','), "file.csv", "", body); err == nil {
+			t.Errorf("expected an error for %q", body)
+		}
+	}
+}
+
+func tableRows(from, to int) (s string) {
+	for i := from; i <= to; i++ {
+		s += fmt.Sprintf("%d\n", i)
+	}
+	return s
+}
+
+func TestPreviewJSON(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		body    string
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "object",
+			body: `{"name": "file.txt", "size": 10, "tags": ["a", true, null], "empty": {}}`,
+			want: []string{
+				`<details open="" class="preview_tree_object"><summary>{</summary>`,
+				`<span class="hl_name">&#34;name&#34;</span>: <span class="hl_string">&#34;file.txt&#34;</span>,`,
+				`<span class="hl_number">10</span>,`,
+				`<details open="" class="preview_tree_array"><summary><span class="hl_name">&#34;tags&#34;</span>: [</summary>`,
+				`<span class="hl_number">true</span>,`,
+				`<span class="hl_number">null</span></div></div>],`,
+				`<span class="hl_name">&#34;empty&#34;</span>: {}</div>`,
+			},
+		}, {
+			name: "large numbers keep their precision",
+			body: `[12345678901234567890, 1.50]`,
+			want: []string{">12345678901234567890<", ">1.50<"},
+		}, {
+			name: "json lines",
+			body: "{\"a\": 1}\n{\"b\": 2}\n",
+			want: []string{"&#34;a&#34;", "&#34;b&#34;"},
+		}, {
+			name: "scalar document",
+			body: `"text"`,
+			want: []string{`<div><span class="hl_string">&#34;text&#34;</span></div>`},
+		}, {
+			name:    "escaped",
+			body:    `{"<b>": "<script>alert(1)</script>"}`,
+			want:    []string{"&lt;b&gt;", "&lt;script&gt;"},
+			notWant: []string{"<script>", "<b>"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runPreview(t, previewJSON, "file.json", "", tt.body)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			checkPreview(t, got, tt.want, tt.notWant)
+		})
+	}
+
+	for _, body := range []string{
+		`{"a": 1`,
+		`{"a" 1}`,
+		`[1, 2,]`,
+		`not json`,
+		strings.Repeat("[", previewMaxDepth+2) + strings.Repeat("]", previewMaxDepth+2),
+	} {
+		if _, err := runPreview(t, previewJSON, "file.json", "", body); err == nil {
+			t.Errorf("expected an error for %.40q", body)
+		}
+	}
+}
+
+func TestPreviewYAML(t *testing.T) {
+	got, err := runPreview(t, previewYAML, "file.yaml", "", strings.Join([]string{
+		"# config",
+		"server:",
+		"  port: 8080",
+		"  name: \"pixel#drain\" # the name",
+		"",
+		"  enabled: yes",
+		"list:",
+		"- one",
+		"- two: &anchor",
+		"    nested: <b>",
+		"end: ~",
+	}, "\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	checkPreview(t, got, []string{
+		`<div class="preview_tree preview_yaml">`,
+		`<details open=""><summary><span class="hl_name">server</span>: </summary>`,
+		`<span class="hl_name">port</span>: <span class="hl_number">8080</span>`,
+		`<span class="hl_string">&#34;pixel#drain&#34; </span><span class="hl_comment"># the name</span>`,
+		`<span class="hl_number">yes</span>`,
+		`<span class="hl_keyword">&amp;anchor</span>`,
+		`<span class="hl_name">nested</span>: &lt;b&gt;`,
+		`<span class="hl_number">~</span>`,
+	}, []string{"<b>"})
+
+	// The blocks have to be balanced, or the rest of the page breaks
+	if open, close := strings.Count(got, "<details"), strings.Count(got, "</details>"); open != close || open != 3 {
+		t.Errorf("got %d opened and %d closed blocks, want 3:\n%s", open, close, got)
+	}
+}
+
+func TestYAMLCommentIndex(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  int
+	}{
+		{"value", -1},
+		{"# comment", 0},
+		{"value # comment", 6},
+		{"value#not a comment", -1},
+		{`"quoted # not a comment"`, -1},
+		{`'quoted # not a comment' # comment`, 25},
+		{`"unterminated # quote`, -1},
+	} {
+		if got := yamlCommentIndex(tt.value); got != tt.want {
+			t.Errorf("yamlCommentIndex(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestPreviewNotebook(t *testing.T) {
+	got, err := runPreview(t, previewNotebook, "notebook.ipynb", "", `{
+		"metadata": {"kernelspec": {"language": "python"}},
+		"cells": [
+			{"cell_type": "markdown", "source": ["# Title\n", "Some *text*"]},
+			{"cell_type": "code", "execution_count": 3, "source": "print('<b>')", "outputs": [
+				{"output_type": "stream", "text": ["<b>\n"]},
+				{"output_type": "execute_result", "execution_count": 3, "data": {
+					"image/png": "iVBORw0K\nGgo=",
+					"text/plain": "<Figure>"
+				}},
+				{"output_type": "display_data", "data": {
+					"image/svg+xml": ["<svg onload=\"alert(1)\">", "</svg>"],
+					"text/plain": "<Figure size 640x480>"
+				}},
+				{"output_type": "display_data", "data": {
+					"text/html": "<table><tr><td>cell</td></tr></table><script>alert(1)</script>"
+				}},
+				{"output_type": "error", "ename": "ValueError", "evalue": "bad",
+					"traceback": ["\u001b[0;31mValueError\u001b[0m: bad"]}
+			]},
+			{"cell_type": "code", "execution_count": null, "source": "x", "outputs": []},
+			{"cell_type": "raw", "source": "<i>raw</i>"}
+		]
+	}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	checkPreview(t, got, []string{
+		"<h1>Title</h1>",
+		"<em>text</em>",
+		`<div class="preview_cell_prompt">In [3]:</div>`,
+		`<div class="preview_cell_prompt">Out [3]:</div>`,
+		`<div class="preview_cell_prompt">In [ ]:</div>`,
+		"<pre>&lt;b&gt;\n</pre>",
+		`<img src="data:image/png;base64,iVBORw0KGgo="/>`,
+		"<pre>&lt;Figure size 640x480&gt;</pre>",
+		"<td>cell</td>",
+		"<pre>ValueError: bad</pre>",
+		"<pre>&lt;i&gt;raw&lt;/i&gt;</pre>",
+	}, []string{
+		"<svg", "image/svg+xml", "<script", "alert(1)", "\x1b", "&lt;Figure&gt;",
+	})
+
+	for _, body := range []string{`{}`, `{"cells": "none"}`, `[]`, `not json`} {
+		if _, err := runPreview(t, previewNotebook, "notebook.ipynb", "", body); err == nil {
+			t.Errorf("expected an error for %q", body)
+		}
+	}
+}
+
+func TestPreviewSubtitles(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		body    string
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "subrip",
+			body: "\uFEFF1\r\n00:00:01,000 --> 00:00:02,000\r\n{\\an8}<i>Hello</i>\r\nworld\r\n\r\n" +
+				"2\r\n01:02:03,500 --> 01:02:04,000\r\nGoodbye &amp; <b>bye</b>\r\n",
+			want: []string{
+				`<span class="preview_cue_time">00:01</span><p>Hello<br/>world</p>`,
+				`<span class="preview_cue_time">01:02:03</span><p>Goodbye &amp; bye</p>`,
+			},
+			notWant: []string{"{\\an8}", "<i>", "<b>"},
+		}, {
+			name: "webvtt",
+			body: "WEBVTT\n\nNOTE a comment\n\nintro\n00:01.000 --> 00:02.000 align:start\n<v.loud Roger>Hi <c.yellow>there</c>\n\n" +
+				"00:03.000 --> 00:04.000\n\n" +
+				"00:05.000 --> 00:06.000\n&lt;script&gt;\n",
+			want: []string{
+				`<span class="preview_cue_time">00:01</span><p>Roger: Hi there</p>`,
+				"&lt;script&gt;",
+			},
+			notWant: []string{"NOTE", "intro", "00:03", "<script>"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runPreview(t, previewSubtitles, "file.srt", "", tt.body)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			checkPreview(t, got, tt.want, tt.notWant)
+		})
+	}
+
+	for _, body := range []string{"", "WEBVTT\n", "1\n00:00:01,000 --> 00:00:02,000\n\n", "just some text"} {
+		if _, err := runPreview(t, previewSubtitles, "file.srt", "", body); err == nil {
+			t.Errorf("expected an error for %q", body)
+		}
+	}
+}
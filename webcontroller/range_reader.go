@@ -0,0 +1,176 @@
+package webcontroller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+)
+
+// limitReader returns errPreviewTooLarge when more than n bytes are read
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (lr *limitReader) Read(p []byte) (n int, err error) {
+	if lr.n <= 0 {
+		return 0, errPreviewTooLarge
+	}
+	if int64(len(p)) > lr.n {
+		p = p[:lr.n]
+	}
+	n, err = lr.r.Read(p)
+	lr.n -= int64(n)
+	return n, err
+}
+
+// errAPIRequest wraps the errors of failed requests to the API. These are
+// temporary, unlike errors in the contents of a file
+var errAPIRequest = errors.New("API request failed")
+
+// apiBody marks the read errors of an API response body with errAPIRequest
+type apiBody struct {
+	io.Reader
+}
+
+func (b apiBody) Read(p []byte) (n int, err error) {
+	n, err = b.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %w", errAPIRequest, err)
+	}
+	return n, err
+}
+
+// newAPIRequest creates a request to the API for the HTTP client, for requests
+// which the API client doesn't support. Like the API client it uses the
+// credentials of the user and passes on their IP address and user agent, so
+// the API applies the rate limits and download counters of the visitor and
+// not of the web server
+func newAPIRequest(ctx context.Context, td *TemplateData, method, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if td.sessionKey != "" {
+		req.SetBasicAuth("", td.sessionKey)
+	}
+	if td.realIP != "" {
+		req.Header.Set("X-Real-IP", td.realIP)
+	}
+	if td.UserAgent != "" {
+		req.Header.Set("User-Agent", td.UserAgent)
+	}
+	return req, nil
+}
+
+// apiRangeReader reads parts of a file from the API with range requests. The
+// file is read in blocks which are kept in memory, archive readers tend to
+// read small pieces close together. It's not safe for concurrent use
+type apiRangeReader struct {
+	ctx    context.Context
+	client *http.Client
+	td     *TemplateData
+	url    string
+	size   int64
+	blocks map[int64][]byte
+	read   int64 // Bytes downloaded so far
+	limit  int64 // Reads fail with errPreviewTooLarge after this many bytes
+}
+
+// rangeBlockSize is the size of the range requests
+const rangeBlockSize = 64 << 10
+
+// newRangeReader returns a reader for a file on the API. The file is read with
+// the credentials of the user
+func (wc *WebController) newRangeReader(
+	ctx context.Context,
+	td *TemplateData,
+	file pixelapi.FileInfo,
+	limit int64,
+) *apiRangeReader {
+	return &apiRangeReader{
+		ctx:    ctx,
+		client: wc.apiHTTPClient,
+		td:     td,
+		url:    wc.config.APIURLInternal + "/file/" + file.ID,
+		size:   file.Size,
+		blocks: make(map[int64][]byte),
+		limit:  limit,
+	}
+}
+
+// newFilesystemRangeReader returns a reader for a file in the filesystem. The
+// file is read with the credentials of the user
+func (wc *WebController) newFilesystemRangeReader(
+	ctx context.Context,
+	td *TemplateData,
+	node pixelapi.FilesystemNode,
+	limit int64,
+) *apiRangeReader {
+	return &apiRangeReader{
+		ctx:    ctx,
+		client: wc.apiHTTPClient,
+		td:     td,
+		url:    wc.config.APIURLInternal + "/filesystem" + fsEscapePath(node.Path),
+		size:   node.FileSize,
+		blocks: make(map[int64][]byte),
+		limit:  limit,
+	}
+}
+
+func (rr *apiRangeReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	for n < len(p) && off+int64(n) < rr.size {
+		var pos = off + int64(n)
+		block, err := rr.block(pos / rangeBlockSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], block[pos%rangeBlockSize:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (rr *apiRangeReader) block(i int64) ([]byte, error) {
+	if b, ok := rr.blocks[i]; ok {
+		return b, nil
+	}
+
+	var start = i * rangeBlockSize
+	var length = min(rangeBlockSize, rr.size-start)
+	if rr.read+length > rr.limit {
+		return nil, errPreviewTooLarge
+	}
+
+	req, err := newAPIRequest(rr.ctx, rr.td, http.MethodGet, rr.url)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+length-1))
+
+	resp, err := rr.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errAPIRequest, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("%w: range request returned status %s", errAPIRequest, resp.Status)
+	}
+
+	var b = make([]byte, length)
+	if _, err = io.ReadFull(resp.Body, b); err != nil {
+		return nil, fmt.Errorf("%w: %w", errAPIRequest, err)
+	}
+	rr.read += length
+	rr.blocks[i] = b
+	return b, nil
+}
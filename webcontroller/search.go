@@ -0,0 +1,416 @@
+package webcontroller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/util"
+	"github.com/julienschmidt/httprouter"
+	blackfriday "github.com/russross/blackfriday/v2"
+)
+
+// searchIndex is an inverted index over the sections of the markdown pages. A
+// section is the text between two headings, so search results can link
+// directly to the heading. The index is built when the templates are parsed
+type searchIndex struct {
+	sections []searchSection
+	terms    map[string][]searchPosting
+}
+
+type searchSection struct {
+	PagePath  string
+	PageTitle string
+	Anchor    string // ID of the heading, empty for the text above the first heading
+	Heading   string
+	Text      string
+}
+
+type searchPosting struct {
+	section int
+	weight  int
+}
+
+// searchResult is a single search hit as returned by the search page and the
+// JSON endpoint
+type searchResult struct {
+	URL     string        `json:"url"`
+	Page    string        `json:"page"`
+	Heading string        `json:"heading"`
+	Snippet template.HTML `json:"snippet"`
+	Score   float64       `json:"score"`
+}
+
+const (
+	searchHeadingWeight = 5  // Matches in headings count for this many matches in the text
+	searchMaxResults    = 50 // Number of results returned for a query
+	searchSnippetLength = 200
+)
+
+// templateActionRegex matches template actions in markdown sources
+var templateActionRegex = regexp.MustCompile(`{{.*?}}`)
+
+// htmlTagRegex matches HTML tags in raw HTML blocks
+var htmlTagRegex = regexp.MustCompile(`<[^>]*>`)
+
+// buildSearchIndex indexes the markdown pages of the default locale. Pages
+// which don't depend on the request are executed so included templates are
+// searchable too. The other pages are indexed from their source with the
+// template actions removed, executing them could require API requests
+func (tm *TemplateManager) buildSearchIndex(set *templateSet) *searchIndex {
+	var idx = &searchIndex{terms: make(map[string][]searchPosting)}
+	var tpl = set.templates[defaultLocale]
+	if tpl == nil {
+		return idx
+	}
+
+	for _, page := range set.markdown {
+		if !page.routed || isLocalizedTemplate(page.Template) || page.Draft || page.Auth {
+			continue
+		}
+
+		var src []byte
+		if page.NoExec {
+			src = page.Source
+		} else if page.Static {
+			var buf bytes.Buffer
+			if err := tpl.ExecuteTemplate(&buf, page.Template, &TemplateData{
+				tpm:    tm,
+				Locale: set.locales[defaultLocale],
+			}); err != nil {
+				log.Error("Failed to execute '%s' for search index: %s", page.Template, err)
+				continue
+			}
+			src = buf.Bytes()
+		} else if t := tpl.Lookup(page.Template); t != nil && t.Tree != nil {
+			src = templateActionRegex.ReplaceAll([]byte(t.Tree.Root.String()), nil)
+		}
+
+		idx.addPage(page, src)
+	}
+
+	// Keep the order of the sections stable, the pages come from a map
+	sort.SliceStable(idx.sections, func(i, j int) bool {
+		return idx.sections[i].PagePath < idx.sections[j].PagePath
+	})
+	idx.buildTerms()
+	return idx
+}
+
+// addPage splits a markdown document into sections. The anchors are generated
+// the same way as the blackfriday HTML renderer does it, including the suffix
+// for duplicate headings. When a table of contents is rendered blackfriday
+// replaces the IDs of all headings which come after it with toc_N, where N
+// counts all headings in the document
+func (idx *searchIndex) addPage(page *markdownPage, src []byte) {
+	var doc = blackfriday.New(
+		blackfriday.WithExtensions(blackfriday.CommonExtensions | blackfriday.AutoHeadingIDs),
+	).Parse(src)
+
+	var headingIDs = make(map[string]int)
+	var uniqueID = func(id string) string {
+		for count, found := headingIDs[id]; found; count, found = headingIDs[id] {
+			var tmp = fmt.Sprintf("%s-%d", id, count+1)
+			if _, tmpFound := headingIDs[tmp]; !tmpFound {
+				headingIDs[id] = count + 1
+				id = tmp
+			} else {
+				id = id + "-1"
+			}
+		}
+		if _, found := headingIDs[id]; !found {
+			headingIDs[id] = 0
+		}
+		return id
+	}
+
+	var headingCount = 0
+	var tocRendered = false
+
+	var title = page.Title
+	var section = searchSection{PagePath: page.Path}
+	var text strings.Builder
+	var sections []searchSection
+	var flush = func() {
+		section.Text = strings.Join(strings.Fields(text.String()), " ")
+		if section.Text != "" || section.Heading != "" {
+			sections = append(sections, section)
+		}
+		text.Reset()
+	}
+
+	doc.Walk(func(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		if !entering {
+			return blackfriday.GoToNext
+		}
+
+		switch node.Type {
+		case blackfriday.Paragraph:
+			// Shortcodes show live data, there's nothing to index
+			if _, _, ok := parseShortcode(nodeText(node)); ok {
+				return blackfriday.SkipChildren
+			}
+		case blackfriday.Heading:
+			var heading = nodeText(node)
+			var id = node.HeadingID
+			if tocRendered {
+				id = fmt.Sprintf("toc_%d", headingCount)
+			}
+			headingCount++
+
+			if node.HeadingData.Level == 1 {
+				// The level 1 heading is the page title, it's not rendered
+				// as a heading so it doesn't get an ID
+				if title == "" {
+					title = heading
+				}
+				return blackfriday.SkipChildren
+			}
+
+			flush()
+			section = searchSection{
+				PagePath: page.Path,
+				Anchor:   uniqueID(id),
+				Heading:  heading,
+			}
+			return blackfriday.SkipChildren
+		case blackfriday.Text, blackfriday.Code, blackfriday.CodeBlock:
+			if node.Type == blackfriday.Text && bytes.Equal(node.Literal, []byte("[TOC]")) {
+				tocRendered = true
+				return blackfriday.GoToNext
+			}
+			text.Write(node.Literal)
+			text.WriteByte(' ')
+		case blackfriday.HTMLBlock, blackfriday.HTMLSpan:
+			text.Write(htmlTagRegex.ReplaceAll(node.Literal, []byte(" ")))
+			text.WriteByte(' ')
+		}
+		return blackfriday.GoToNext
+	})
+	flush()
+
+	for i := range sections {
+		sections[i].PageTitle = title
+	}
+	idx.sections = append(idx.sections, sections...)
+}
+
+// nodeText returns the text content of a node and its children
+func nodeText(node *blackfriday.Node) string {
+	var text strings.Builder
+	node.Walk(func(n *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		if entering {
+			text.Write(n.Literal)
+		}
+		return blackfriday.GoToNext
+	})
+	return text.String()
+}
+
+func (idx *searchIndex) buildTerms() {
+	for i, section := range idx.sections {
+		var counts = make(map[string]int)
+		for _, term := range searchTerms(section.Text) {
+			counts[term]++
+		}
+		for _, term := range searchTerms(section.Heading + " " + section.PageTitle) {
+			counts[term] += searchHeadingWeight
+		}
+		for term, weight := range counts {
+			idx.terms[term] = append(idx.terms[term], searchPosting{section: i, weight: weight})
+		}
+	}
+}
+
+// searchTerms splits text into lowercase words. Single characters are ignored
+func searchTerms(text string) (terms []string) {
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(word) > 1 {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// search returns the sections which contain all the words in the query, ranked
+// by TF-IDF. The last word of the query also matches longer words so results
+// can be shown while the user is typing
+func (idx *searchIndex) search(query string) (results []searchResult) {
+	var terms = searchTerms(query)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	var scores map[int]float64
+	for i, term := range terms {
+		var matches = make(map[int]float64)
+		var addPostings = func(postings []searchPosting) {
+			var idf = math.Log(1 + float64(len(idx.sections))/float64(len(postings)))
+			for _, p := range postings {
+				matches[p.section] += float64(p.weight) * idf
+			}
+		}
+
+		if i == len(terms)-1 {
+			for word, postings := range idx.terms {
+				if strings.HasPrefix(word, term) {
+					addPostings(postings)
+				}
+			}
+		} else if postings, ok := idx.terms[term]; ok {
+			addPostings(postings)
+		}
+
+		// Only keep the sections which matched all terms so far
+		if scores == nil {
+			scores = matches
+		} else {
+			for section, score := range scores {
+				if m, ok := matches[section]; ok {
+					scores[section] = score + m
+				} else {
+					delete(scores, section)
+				}
+			}
+		}
+	}
+
+	for i, score := range scores {
+		var section = idx.sections[i]
+		var url = "/" + section.PagePath
+		if section.Anchor != "" {
+			url += "#" + section.Anchor
+		}
+		var heading = section.Heading
+		if heading == "" {
+			heading = section.PageTitle
+		}
+
+		results = append(results, searchResult{
+			URL:     url,
+			Page:    section.PageTitle,
+			Heading: heading,
+			Snippet: searchSnippet(section.Text, terms),
+			Score:   math.Round(score*100) / 100,
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].URL < results[j].URL
+	})
+	if len(results) > searchMaxResults {
+		results = results[:searchMaxResults]
+	}
+	return results
+}
+
+// searchSnippet returns a piece of text around the first match of the query
+// with the matching words wrapped in <mark> tags. The terms are matched
+// case-insensitively on the original text. Lowercasing the text can change its
+// length, so offsets in a lowercased copy don't line up with the original
+func searchSnippet(text string, terms []string) template.HTML {
+	var match = searchTermsRegex(terms)
+	var start = 0
+	if match != nil {
+		if loc := match.FindStringIndex(text); loc != nil {
+			start = loc[0]
+		}
+	}
+
+	// Show a bit of context before the match and cut on word boundaries
+	var prefix, suffix = "…", "…"
+	start -= searchSnippetLength / 4
+	if start <= 0 {
+		start, prefix = 0, ""
+	} else if i := strings.IndexByte(text[start:], ' '); i != -1 {
+		start += i + 1
+	} else {
+		for start > 0 && !utf8.RuneStart(text[start]) {
+			start--
+		}
+	}
+	var end = start + searchSnippetLength
+	if end >= len(text) {
+		end, suffix = len(text), ""
+	} else if i := strings.LastIndexByte(text[start:end], ' '); i != -1 {
+		end = start + i
+	} else {
+		for end > start && !utf8.RuneStart(text[end]) {
+			end--
+		}
+	}
+
+	var snippet = text[start:end]
+	var out strings.Builder
+	out.WriteString(prefix)
+	var last = 0
+	if match != nil {
+		for _, loc := range match.FindAllStringIndex(snippet, -1) {
+			out.WriteString(template.HTMLEscapeString(snippet[last:loc[0]]))
+			out.WriteString("<mark>" + template.HTMLEscapeString(snippet[loc[0]:loc[1]]) + "</mark>")
+			last = loc[1]
+		}
+	}
+	out.WriteString(template.HTMLEscapeString(snippet[last:]))
+	out.WriteString(suffix)
+	return template.HTML(out.String())
+}
+
+// searchTermsRegex returns a case-insensitive regular expression which matches
+// any of the terms. Longer terms come first, so the longest match is marked
+func searchTermsRegex(terms []string) *regexp.Regexp {
+	var quoted = make([]string, 0, len(terms))
+	for _, term := range terms {
+		if term != "" {
+			quoted = append(quoted, regexp.QuoteMeta(term))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+	sort.SliceStable(quoted, func(i, j int) bool { return len(quoted[i]) > len(quoted[j]) })
+	return regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+}
+
+func (wc *WebController) serveSearch(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var td = wc.newTemplateData(w, r)
+	var query = r.FormValue("q")
+	td.Title = td.Locale.T("search.title")
+	td.Other = struct {
+		Query   string
+		Results []searchResult
+	}{
+		Query:   query,
+		Results: wc.templates.tpl.Load().search.search(query),
+	}
+
+	if err := wc.templates.Run(w, r, "search", td); err != nil && !util.IsNetError(err) {
+		log.Error("Error executing template '%s': %s", "search", err)
+	}
+}
+
+func (wc *WebController) serveSearchJSON(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var results = wc.templates.tpl.Load().search.search(r.FormValue("q"))
+	if results == nil {
+		results = []searchResult{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(results); err != nil && !util.IsNetError(err) {
+		log.Error("Failed to encode search results: %s", err)
+	}
+}
@@ -0,0 +1,53 @@
+package webcontroller
+
+import (
+	"html/template"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSearchSnippet(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		text  string
+		terms []string
+		want  template.HTML
+	}{
+		{"match", "Upload a file to pixeldrain", []string{"file"}, "Upload a <mark>file</mark> to pixeldrain"},
+		{"case", "FILE and File", []string{"file"}, "<mark>FILE</mark> and <mark>File</mark>"},
+		{"longest term", "filesystem", []string{"file", "filesystem"}, "<mark>filesystem</mark>"},
+		{"no match", "nothing here", []string{"file"}, "nothing here"},
+		{"escaped", "<b>file</b> & more", []string{"file"}, "&lt;b&gt;<mark>file</mark>&lt;/b&gt; &amp; more"},
+		{"regex characters", "costs 1.5 (euro)", []string{"(euro)"}, "costs 1.5 <mark>(euro)</mark>"},
+
+		// Lowercasing these characters changes their length in bytes
+		{"dotted capital I", "İİİİ file", []string{"file"}, "İİİİ <mark>file</mark>"},
+		{"kelvin sign", "KK file", []string{"file"}, "KK <mark>file</mark>"},
+		{"kelvin sign match", "5 K", []string{"k"}, "5 <mark>K</mark>"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := searchSnippet(tt.text, tt.terms); got != tt.want {
+				t.Errorf("searchSnippet(%q, %q) = %q, want %q", tt.text, tt.terms, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchSnippetLongText(t *testing.T) {
+	// Long text without spaces is cut in the middle of the multi-byte
+	// characters, the snippet must still be valid UTF-8
+	for _, text := range []string{
+		strings.Repeat("İ", 300) + "file" + strings.Repeat("é", 300),
+		strings.Repeat("word ", 100) + "file" + strings.Repeat(" word", 100),
+		strings.Repeat("K", 500),
+	} {
+		var got = string(searchSnippet(text, []string{"file"}))
+		if !utf8.ValidString(got) {
+			t.Errorf("snippet is not valid UTF-8: %q", got)
+		}
+		if strings.Contains(text, "file") && !strings.Contains(got, "<mark>file</mark>") {
+			t.Errorf("snippet does not contain the match: %q", got)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package webcontroller
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+)
+
+// Shortcodes embed live content in markdown pages. A shortcode is a paragraph
+// which only contains the name of the shortcode and its arguments between
+// square brackets:
+//
+//	[file_card id="abc123"]
+//
+// The function registered for the shortcode loads the data, which is then
+// rendered with the shortcode_<name> template. Pages which use shortcodes are
+// never cached, the content is loaded on every request
+type shortcodeFunc func(wc *WebController, r *http.Request, td *TemplateData, args map[string]string) (any, error)
+
+var shortcodes = map[string]shortcodeFunc{}
+
+// registerShortcode adds a shortcode to the registry. The name may only contain
+// lowercase letters and underscores
+func registerShortcode(name string, fn shortcodeFunc) {
+	if _, ok := shortcodes[name]; ok {
+		panic("shortcode registered twice: " + name)
+	}
+	shortcodes[name] = fn
+}
+
+func init() {
+	registerShortcode("file_embed", shortcodeFileEmbed)
+	registerShortcode("file_card", shortcodeFileCard)
+	registerShortcode("fs_listing", shortcodeFilesystemListing)
+	registerShortcode("limits", shortcodeLimits)
+}
+
+var (
+	shortcodeRegex    = regexp.MustCompile(`^\[([a-z_]+)((?:\s+\w+=(?:"[^"]*"|[^\s\]]+))*)\s*\]$`)
+	shortcodeArgRegex = regexp.MustCompile(`(\w+)=(?:"([^"]*)"|([^\s\]]+))`)
+	fileIDRegex       = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+)
+
+// parseShortcode checks if the text of a paragraph is a registered shortcode
+// and returns its name and arguments
+func parseShortcode(text string) (name string, args map[string]string, ok bool) {
+	var match = shortcodeRegex.FindStringSubmatch(strings.TrimSpace(text))
+	if match == nil {
+		return "", nil, false
+	}
+	if _, ok = shortcodes[match[1]]; !ok {
+		return "", nil, false
+	}
+
+	args = make(map[string]string)
+	for _, arg := range shortcodeArgRegex.FindAllStringSubmatch(match[2], -1) {
+		if arg[2] != "" {
+			args[arg[1]] = arg[2]
+		} else {
+			args[arg[1]] = arg[3]
+		}
+	}
+	return match[1], args, true
+}
+
+// renderShortcode runs a shortcode and writes the result to the output buffer.
+// Errors are shown in the page instead of the content
+func (wc *WebController) renderShortcode(
+	out *bytes.Buffer,
+	r *http.Request,
+	td *TemplateData,
+	name string,
+	args map[string]string,
+) {
+	var scd = *td
+	var tpl = "shortcode_" + name
+
+	data, err := shortcodes[name](wc, r, td, args)
+	if err != nil {
+		log.Debug("Shortcode '%s' failed: %s", name, err)
+		tpl, scd.Other = "shortcode_error", name
+	} else {
+		scd.Other = data
+	}
+
+	if err = wc.templates.Run(out, r, tpl, &scd); err != nil {
+		log.Error("Error executing template '%s': %s", tpl, err)
+	}
+}
+
+// shortcodeFileEmbed embeds the file viewer in an iframe
+//
+//	[file_embed id="abc123" height="600"]
+func shortcodeFileEmbed(wc *WebController, r *http.Request, td *TemplateData, args map[string]string) (any, error) {
+	if !fileIDRegex.MatchString(args["id"]) {
+		return nil, errors.New("invalid file ID")
+	}
+
+	var height = 600
+	if h, err := strconv.Atoi(args["height"]); err == nil && h > 0 {
+		height = h
+	}
+
+	return struct {
+		ID     string
+		Height int
+	}{args["id"], height}, nil
+}
+
+// shortcodeFileCard shows the thumbnail, name and description of a file, the
+// same information which is used for link previews
+//
+//	[file_card id="abc123"]
+func shortcodeFileCard(wc *WebController, r *http.Request, td *TemplateData, args map[string]string) (any, error) {
+	if !fileIDRegex.MatchString(args["id"]) {
+		return nil, errors.New("invalid file ID")
+	}
+
+	file, err := wc.getFileInfo(td, args["id"])
+	if err != nil {
+		return nil, err
+	}
+
+	var og = wc.metadataFromFile(r, td, file)
+	return struct {
+		File        pixelapi.FileInfo
+		URL         string
+		Title       string
+		Description string
+		Thumbnail   string
+	}{
+		File:        file,
+		URL:         og.prop("og:url"),
+		Title:       og.prop("og:title"),
+		Description: og.prop("og:description"),
+		Thumbnail:   "/api/file/" + file.ID + "/thumbnail",
+	}, nil
+}
+
+// shortcodeFilesystemListing lists the contents of a filesystem directory
+//
+//	[fs_listing path="/abc123/documents"]
+func shortcodeFilesystemListing(wc *WebController, r *http.Request, td *TemplateData, args map[string]string) (any, error) {
+	var path = "/" + strings.Trim(args["path"], "/")
+	if path == "/" {
+		return nil, errors.New("path is required")
+	}
+
+	node, err := wc.getFilesystemPath(td, strings.TrimPrefix(path, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	return struct {
+		Base     pixelapi.FilesystemNode
+		Children []pixelapi.FilesystemNode
+	}{node.Path[node.BaseIndex], node.Children}, nil
+}
+
+// limitKeys are the global settings which can be shown on the website. Other
+// settings are only for admins
+var limitKeys = []string{"max_file_size", "file_inactive_expiry_days"}
+
+type limitRow struct {
+	Key   string
+	Label string
+	Value string
+}
+
+// shortcodeLimits shows the current values of global settings. The keys
+// argument is a comma-separated list of settings to show
+//
+//	[limits keys="max_file_size,file_inactive_expiry_days"]
+func shortcodeLimits(wc *WebController, r *http.Request, td *TemplateData, args map[string]string) (any, error) {
+	globals, err := wc.getGlobals()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys = limitKeys
+	if args["keys"] != "" {
+		keys = strings.Split(args["keys"], ",")
+	}
+
+	var rows []limitRow
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if !slices.Contains(limitKeys, key) {
+			return nil, errors.New("global can't be shown: " + key)
+		}
+		val, ok := globals[key]
+		if !ok {
+			return nil, errors.New("unknown global: " + key)
+		}
+
+		var row = limitRow{
+			Key:   key,
+			Label: td.Locale.T("shortcode.limits." + key),
+			Value: val,
+		}
+		if n, err := strconv.Atoi(val); err == nil {
+			switch {
+			case key == "max_file_size":
+				row.Value = td.Locale.formatNumber(wc.templates.formatData(n))
+			case strings.HasSuffix(key, "_days"):
+				row.Value = td.Locale.T("shortcode.limits.days", n)
+			default:
+				row.Value = td.Locale.formatInt(n)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// getGlobals returns the global settings of the API. Reading the globals
+// requires an admin API key, which needs to be set in the configuration. The key
+// is only used on the server, it is never sent to the browser
+func (wc *WebController) getGlobals() (map[string]string, error) {
+	if wc.config.AdminAPIKey == "" {
+		return nil, errors.New("admin_api_key is not configured")
+	}
+
+	return wc.cache.globals.get("", func() (map[string]string, error) {
+		globals, err := wc.api.Login(wc.config.AdminAPIKey).AdminGetGlobals()
+		if err != nil {
+			return nil, err
+		}
+		var m = make(map[string]string, len(globals))
+		for _, g := range globals {
+			m[g.Key] = g.Value
+		}
+		return m, nil
+	})
+}
@@ -0,0 +1,255 @@
+package webcontroller
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"fornaxian.tech/log"
+	"fornaxian.tech/pixeldrain_api_client/pixelapi"
+	"fornaxian.tech/util"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Shared directories with the site_enabled property are served as static
+// websites on the sites domain. Directories show their index.html file and
+// files are sent as they are. The sites domain does not get the cookies of
+// pixeldrain, so scripts on a site can't make requests to the API in the name
+// of the visitor. The sandbox policy gives every page a unique origin, so sites
+// can't read each other's storage either
+const sitePolicy = "sandbox allow-scripts allow-popups allow-modals allow-downloads"
+
+// siteHeaders are the headers of API responses which are passed on to the
+// client when serving a site file
+var siteHeaders = []string{
+	"Content-Length", "Content-Range", "Accept-Ranges", "Last-Modified", "ETag",
+}
+
+// fsSite returns the root directory of the site a path is in. Only the
+// directory at the root of the path, the bucket or the shared directory, can be
+// a site. That way a missing page only needs one lookup to find its site
+func fsSite(path []pixelapi.FilesystemNode) (root pixelapi.FilesystemNode, ok bool) {
+	if len(path) == 0 || path[0].Type != "dir" || path[0].Properties["site_enabled"] != "true" {
+		return root, false
+	}
+	return path[0], true
+}
+
+// siteRoute is the route of the directory pages. On the sites domain it serves
+// the hosted sites, the other routes are not available there
+const siteRoute = "d/*path"
+
+// isSiteRequest returns true if the request is for the sites domain. Hosting
+// sites is disabled when no sites domain is configured
+func (wc *WebController) isSiteRequest(r *http.Request) bool {
+	return wc.config.SitesDomain != "" && strings.EqualFold(r.Host, wc.config.SitesDomain)
+}
+
+// appOnly wraps the handlers of the routes which are not part of the hosted
+// sites. They respond with a plain 404 Not Found on the sites domain, the app
+// must not run on the origin of the sites
+func (wc *WebController) appOnly(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if wc.isSiteRequest(r) {
+			setSiteHeaders(w)
+			http.NotFound(w, r)
+			return
+		}
+		handle(w, r, p)
+	}
+}
+
+// redirectToSite sends visitors of a sharing link to the site on the sites
+// domain. Users who can edit the directory, and links with a query like
+// ?viewer, get the filesystem viewer. It returns false if the path is not a
+// site
+func (wc *WebController) redirectToSite(w http.ResponseWriter, r *http.Request, fsPath pixelapi.FilesystemPath) bool {
+	if wc.config.SitesDomain == "" || r.URL.RawQuery != "" || fsPath.Permissions.Write {
+		return false
+	} else if _, ok := fsSite(fsPath.Path); !ok {
+		return false
+	}
+
+	var u = url.URL{Scheme: "https", Host: wc.config.SitesDomain, Path: r.URL.Path}
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+	return true
+}
+
+// serveSitePath serves a request on the sites domain. Sites are always viewed
+// anonymously, the sites domain does not have session cookies. Errors are
+// plain text, the pixeldrain error page does not belong on a hosted site
+func (wc *WebController) serveSitePath(w http.ResponseWriter, r *http.Request, p string) {
+	var td = wc.newCrawlerTemplateData(r)
+	fsPath, err := wc.getFilesystemPath(td, p)
+	if err != nil {
+		var status = classifyError(err).status
+		if status == http.StatusNotFound && wc.serveSiteParent(w, r, td, p) {
+			return
+		}
+		setSiteHeaders(w)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	root, ok := fsSite(fsPath.Path)
+	if !ok {
+		setSiteHeaders(w)
+		http.NotFound(w, r)
+		return
+	}
+	wc.serveSite(w, r, td, fsPath, root)
+}
+
+func (wc *WebController) serveSite(
+	w http.ResponseWriter,
+	r *http.Request,
+	td *TemplateData,
+	fsPath pixelapi.FilesystemPath,
+	root pixelapi.FilesystemNode,
+) {
+	var node = fsPath.Path[fsPath.BaseIndex]
+	if node.Type == "file" {
+		wc.serveSiteFile(w, r, td, node, http.StatusOK)
+		return
+	}
+
+	// Relative links in the index page only work when the directory URL ends
+	// with a slash
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		var u = *r.URL
+		u.Path += "/"
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+		return
+	}
+
+	for _, child := range fsPath.Children {
+		if child.Type == "file" && child.Name == "index.html" {
+			wc.serveSiteFile(w, r, td, child, http.StatusOK)
+			return
+		}
+	}
+	wc.serveSiteNotFound(w, r, td, root)
+}
+
+// serveSiteParent serves the 404 page of the site a missing path would have
+// been in. Only the root of the path is looked up, that is where the site
+// would be. It returns false if the path is not in a site
+func (wc *WebController) serveSiteParent(w http.ResponseWriter, r *http.Request, td *TemplateData, p string) bool {
+	var bucket, _, _ = strings.Cut(strings.TrimPrefix(p, "/"), "/")
+	if bucket == "" || bucket == p {
+		return false
+	}
+
+	fsPath, err := wc.getFilesystemPath(td, bucket)
+	if err != nil {
+		return false
+	}
+	root, ok := fsSite(fsPath.Path)
+	if ok {
+		wc.serveSiteNotFound(w, r, td, root)
+	}
+	return ok
+}
+
+// serveSiteNotFound serves the 404.html file of a site. Sites without a 404
+// page get a plain error message, the pixeldrain error page does not belong on
+// a hosted site
+func (wc *WebController) serveSiteNotFound(
+	w http.ResponseWriter,
+	r *http.Request,
+	td *TemplateData,
+	root pixelapi.FilesystemNode,
+) {
+	fsPath, err := wc.getFilesystemPath(td, strings.TrimPrefix(root.Path+"/404.html", "/"))
+	if err != nil || fsPath.Path[fsPath.BaseIndex].Type != "file" {
+		setSiteHeaders(w)
+		http.NotFound(w, r)
+		return
+	}
+	wc.serveSiteFile(w, r, td, fsPath.Path[fsPath.BaseIndex], http.StatusNotFound)
+}
+
+// serveSiteFile streams a file of a site from the API. The content type is
+// based on the file extension like on a regular web server. Range and
+// conditional requests are passed on to the API, except for error pages
+func (wc *WebController) serveSiteFile(
+	w http.ResponseWriter,
+	r *http.Request,
+	td *TemplateData,
+	node pixelapi.FilesystemNode,
+	status int,
+) {
+	setSiteHeaders(w)
+
+	req, err := newAPIRequest(r.Context(), td, r.Method, wc.config.APIURLInternal+"/filesystem"+fsEscapePath(node.Path))
+	if err != nil {
+		log.Error("Can't create site request: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if status == http.StatusOK {
+		for _, h := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+			if v := r.Header.Get(h); v != "" {
+				req.Header.Set(h, v)
+			}
+		}
+	}
+
+	// The API client has a timeout, which would interrupt large downloads. The
+	// request is cancelled when the client goes away instead
+	var client = *wc.apiHTTPClient
+	client.Timeout = 0
+	resp, err := client.Do(req)
+	if err != nil {
+		if !util.IsNetError(err) {
+			log.Error("Site request failed: %s", err)
+		}
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified, http.StatusRequestedRangeNotSatisfiable:
+	default:
+		if resp.StatusCode >= 500 {
+			log.Error("Site request for %s returned status %s", node.Path, resp.Status)
+			resp.StatusCode = http.StatusBadGateway
+		}
+		http.Error(w, http.StatusText(resp.StatusCode), resp.StatusCode)
+		return
+	}
+
+	var contentType = mime.TypeByExtension(path.Ext(node.Name))
+	if contentType == "" {
+		contentType = node.FileType
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	for _, h := range siteHeaders {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	if status == http.StatusOK {
+		status = resp.StatusCode
+	}
+	w.WriteHeader(status)
+
+	if _, err = io.Copy(w, resp.Body); err != nil && !util.IsNetError(err) {
+		log.Error("Failed to write site file: %s", err)
+	}
+}
+
+// setSiteHeaders isolates a hosted site from pixeldrain
+func setSiteHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Security-Policy", sitePolicy)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cross-Origin-Opener-Policy", "same-origin")
+	w.Header().Set("Referrer-Policy", "same-origin")
+}
@@ -0,0 +1,63 @@
+package webcontroller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestSitesDomainRoutes(t *testing.T) {
+	var apiRequests atomic.Int64
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiRequests.Add(1)
+		http.Error(w, `{"success":false,"value":"not_found"}`, http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	var r = httprouter.New()
+	New(r, "", Config{
+		APIURLInternal:   srv.URL + "/api",
+		ResourceDir:      "../res",
+		ProxyAPIRequests: true,
+		SitesDomain:      "sites.example",
+	})
+
+	var serve = func(host, path string) *httptest.ResponseRecorder {
+		var req = httptest.NewRequest("GET", path, nil)
+		req.Host = host
+		var w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, path := range []string{
+		"/", "/about", "/u/test", "/login", "/res/img/pixeldrain_256.png",
+		"/robots.txt", "/sitemap.xml", "/theme.css", "/api/misc/ping", "/missing",
+	} {
+		var w = serve("sites.example", path)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d on the sites domain, want 404", path, w.Code)
+		}
+		if w.Header().Get("Content-Security-Policy") != sitePolicy {
+			t.Errorf("%s: response on the sites domain does not have the site policy", path)
+		}
+		if strings.Contains(w.Body.String(), "<html") {
+			t.Errorf("%s: got an HTML page on the sites domain", path)
+		}
+	}
+
+	if n := apiRequests.Load(); n != 0 {
+		t.Errorf("made %d API requests on the sites domain", n)
+	}
+
+	// The app still works on other domains
+	for _, path := range []string{"/about", "/robots.txt", "/res/img/pixeldrain_256.png"} {
+		if w := serve("pixeldrain.example", path); w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d on the app domain, want 200", path, w.Code)
+		}
+	}
+}
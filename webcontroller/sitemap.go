@@ -0,0 +1,141 @@
+package webcontroller
+
+import (
+	"encoding/xml"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template/parse"
+	"time"
+
+	"fornaxian.tech/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// defaultRobotsTxt is served when robots_txt is not set in the config
+const defaultRobotsTxt = `# Go ahead robots, do your worst
+User-agent: *
+Disallow: /user
+Disallow: /admin
+Disallow: /search
+`
+
+// sitemapPage is a public page on the website
+type sitemapPage struct {
+	path     string
+	template string // Name of the template, used for the modification date
+}
+
+// templateDefineRegex finds the names of the templates which are defined in a
+// template file
+var templateDefineRegex = regexp.MustCompile(`{{-?\s*define\s+"([^"]+)"`)
+
+// modTime returns the last modification time of a template and the templates
+// it includes. For markdown pages the translations are included as well
+func (tm *TemplateManager) modTime(name string) (t time.Time) {
+	var set = tm.tpl.Load()
+	var tpl = set.templates[defaultLocale]
+	var seen = make(map[string]bool)
+
+	var visit func(name string)
+	visit = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+
+		var file = name
+		if f, ok := set.templateFiles[name]; ok {
+			file = f
+		}
+		if mod := set.modTimes[file]; mod.After(t) {
+			t = mod
+		}
+		if tpl != nil {
+			if def := tpl.Lookup(name); def != nil && def.Tree != nil {
+				templateIncludes(def.Tree.Root, visit)
+			}
+		}
+	}
+	visit(name)
+
+	if ext := filepath.Ext(name); ext == ".md" {
+		var prefix = strings.TrimSuffix(name, ext) + "."
+		for doc := range set.markdown {
+			if strings.HasPrefix(doc, prefix) && strings.HasSuffix(doc, ext) {
+				visit(doc)
+			}
+		}
+	}
+	return t
+}
+
+// templateIncludes calls fn with the names of the templates which are included
+// in a template with {{template}}
+func templateIncludes(node parse.Node, fn func(name string)) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			templateIncludes(child, fn)
+		}
+	case *parse.TemplateNode:
+		fn(n.Name)
+	case *parse.IfNode:
+		templateIncludes(n.List, fn)
+		templateIncludes(n.ElseList, fn)
+	case *parse.RangeNode:
+		templateIncludes(n.List, fn)
+		templateIncludes(n.ElseList, fn)
+	case *parse.WithNode:
+		templateIncludes(n.List, fn)
+		templateIncludes(n.ElseList, fn)
+	}
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+func (wc *WebController) serveSitemap(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var addr = getRequestAddress(r)
+	var set = sitemapURLSet{XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+
+	for _, page := range wc.sitemap {
+		var u = sitemapURL{Loc: addr + "/" + page.path}
+		if mod := wc.templates.modTime(page.template); !mod.IsZero() {
+			u.LastMod = mod.UTC().Format("2006-01-02")
+		}
+		set.URLs = append(set.URLs, u)
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	var enc = xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(set); err != nil {
+		log.Error("Failed to encode sitemap: %s", err)
+	}
+}
+
+// serveRobotsTxt serves the robots.txt rules from the config with a link to the
+// sitemap
+func (wc *WebController) serveRobotsTxt(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var rules = wc.config.RobotsTxt
+	if rules == "" {
+		rules = defaultRobotsTxt
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(strings.TrimRight(rules, "\n") + "\n\nSitemap: " + getRequestAddress(r) + "/sitemap.xml\n"))
+}
@@ -0,0 +1,64 @@
+package webcontroller
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTemplateModTime(t *testing.T) {
+	var dir = t.TempDir()
+	var base = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var files = []struct {
+		path    string
+		content string
+		days    int // Modification time after base
+	}{
+		{"template/page.html", `{{define "page"}}{{template "header"}}{{if .}}{{template "part.md"}}{{end}}{{end}}`, 1},
+		{"template/header.html", `{{define "header"}}{{range .}}{{template "footer"}}{{end}}{{end}}`, 2},
+		{"template/footer.html", `{{- define "footer"}}footer{{end}}`, 3},
+		{"template/other.html", `{{define "other"}}other{{end}}`, 10},
+		{"include/part.md", `part`, 4},
+		{"include/doc.md", "+++\npath = \"doc\"\n+++\n{{template \"part.md\"}}", 1},
+		{"include/doc.nl.md", "+++\npath = \"doc\"\n+++\ndocument", 5},
+		{"include/loop.md", `{{template "loop.md"}}`, 1},
+		{"locale/en.json", `{}`, 0},
+	}
+	for _, f := range files {
+		var path = filepath.Join(dir, f.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(f.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var mod = base.AddDate(0, 0, f.days)
+		if err := os.Chtimes(path, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tm = NewTemplateManager(dir, "", "", false)
+	tm.ParseTemplates(true)
+
+	for _, tt := range []struct {
+		name string
+		days int
+	}{
+		{"page", 4},   // Through part.md
+		{"header", 3}, // Through footer
+		{"footer", 3},
+		{"doc.md", 5}, // The translation is newer than the include
+		{"loop.md", 1},
+		{"missing", -1},
+	} {
+		var want time.Time
+		if tt.days >= 0 {
+			want = base.AddDate(0, 0, tt.days)
+		}
+		if got := tm.modTime(tt.name); !got.Equal(want) {
+			t.Errorf("modTime(%q) = %s, want %s", tt.name, got, want)
+		}
+	}
+}
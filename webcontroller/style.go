@@ -41,12 +41,23 @@ func userStyleFromRequest(r *http.Request) (s template.CSS) {
 }
 
 func userStyle(style string, hue int) template.CSS {
-	var (
-		def      styleSheet
-		light    styleSheet
-		hasLight bool
-	)
+	var def, light, hasLight, customHue = styleSheets(style)
+	if customHue && hue >= 0 && hue <= 360 {
+		def = def.withHue(hue)
+		light = light.withHue(hue)
+	}
+
+	if hasLight {
+		return template.CSS(def.withLight(light))
+	} else {
+		return template.CSS(def.String())
+	}
+}
 
+// styleSheets returns the style sheet of a theme, and the light variant if the
+// theme has one. Some themes don't support custom hues
+func styleSheets(style string) (def, light styleSheet, hasLight, customHue bool) {
+	customHue = true
 	switch style {
 	default:
 		fallthrough
@@ -68,15 +79,15 @@ func userStyle(style string, hue int) template.CSS {
 		def = solarizedLightStyle
 	case "classic":
 		def = classicStyle
-		hue = -1 // Does not support custom hues
+		customHue = false
 	case "purple_drain":
 		def = purpleDrainStyle
-		hue = -1 // Does not support custom hues
+		customHue = false
 	case "maroon":
 		def = maroonStyle
 	case "hacker":
 		def = hackerStyle
-		hue = -1 // Does not support custom hues
+		customHue = false
 	case "canta":
 		def = cantaPixeldrainStyle
 	case "skeuos":
@@ -94,17 +105,7 @@ func userStyle(style string, hue int) template.CSS {
 	case "pixeldrain98":
 		def = pixeldrain98Style
 	}
-
-	if hue >= 0 && hue <= 360 {
-		def = def.withHue(hue)
-		light = light.withHue(hue)
-	}
-
-	if hasLight {
-		return template.CSS(def.withLight(light))
-	} else {
-		return template.CSS(def.String())
-	}
+	return def, light, hasLight, customHue
 }
 
 type styleSheet struct {
@@ -137,6 +138,14 @@ type styleSheet struct {
 	Chart2 HSL
 	Chart3 HSL
 
+	// Colors for syntax highlighting in code blocks. Based on the highlight
+	// and text colors if undefined
+	SyntaxKeyword HSL
+	SyntaxString  HSL
+	SyntaxNumber  HSL
+	SyntaxName    HSL
+	SyntaxComment HSL
+
 	StyleOverrides string
 }
 
@@ -166,6 +175,11 @@ func (s styleSheet) withDefaults() styleSheet {
 	defaultCSS(&s.BodyBackground, s.BodyColor)
 	defaultHSL(&s.BackgroundText, s.BodyText)
 	defaultHSL(&s.Separator, s.BodyColor.Add(0, 0, .06))
+	defaultHSL(&s.SyntaxKeyword, s.Link)
+	defaultHSL(&s.SyntaxString, s.Link.Add(120, 0, 0))
+	defaultHSL(&s.SyntaxNumber, s.Link.Add(240, 0, 0))
+	defaultHSL(&s.SyntaxName, s.Link.Add(180, 0, 0))
+	defaultHSL(&s.SyntaxComment, s.BodyText.Add(0, 0, (.5-s.BodyText.Lightness)*.5))
 
 	return s
 }
@@ -199,6 +213,7 @@ func (s styleSheet) withHue(hue int) styleSheet {
 	s.Separator.Hue = hue
 	s.CardColor.Hue = hue
 	s.CardText.Hue = hue
+	s.SyntaxComment.Hue = hue
 	return s
 }
 
@@ -237,6 +252,12 @@ func (s styleSheet) String() string {
 	--chart_2_color: %s;
 	--chart_3_color: %s;
 
+	--syntax_keyword: %s;
+	--syntax_string:  %s;
+	--syntax_number:  %s;
+	--syntax_name:    %s;
+	--syntax_comment: %s;
+
 	--shadow_color: %s;
 }
 
@@ -269,6 +290,11 @@ func (s styleSheet) String() string {
 		s.Chart1.CSS(),
 		s.Chart2.CSS(),
 		s.Chart3.CSS(),
+		s.SyntaxKeyword.CSS(),
+		s.SyntaxString.CSS(),
+		s.SyntaxNumber.CSS(),
+		s.SyntaxName.CSS(),
+		s.SyntaxComment.CSS(),
 		s.BodyColor.Darken(0.8).CSS(),
 		s.StyleOverrides,
 	)
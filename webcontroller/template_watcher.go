@@ -0,0 +1,153 @@
+package webcontroller
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"fornaxian.tech/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+// resourceSnapshot maps every file in the resource directory to its size and
+// modification time. Two snapshots are compared to find out which files changed
+type resourceSnapshot map[string]string
+
+func (tm *TemplateManager) snapshotResources() (snap resourceSnapshot) {
+	snap = make(resourceSnapshot)
+	if err := filepath.Walk(tm.resourceDir, func(path string, f os.FileInfo, err error) error {
+		if err != nil || f.IsDir() {
+			return nil
+		}
+		snap[path] = fmt.Sprintf("%d-%d", f.Size(), f.ModTime().UnixNano())
+		return nil
+	}); err != nil {
+		log.Error("Failed to walk resource directory: %s", err)
+	}
+	return snap
+}
+
+// changedResources returns the paths which were added, removed or modified
+// between two snapshots
+func (snap resourceSnapshot) changedResources(newSnap resourceSnapshot) (changed []string) {
+	for path, v := range newSnap {
+		if snap[path] != v {
+			changed = append(changed, path)
+		}
+	}
+	for path := range snap {
+		if _, ok := newSnap[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
+
+// watchResources polls the resource directory for changes. When a template or
+// an include file changes the templates are parsed again, and when a static
+// file changes the asset manifest is rebuilt. Any change to the
+// resource directory is sent to the reload listeners. Polling is used instead
+// of inotify because it works the same on every platform, and it's only used
+// in debug mode anyway
+func (tm *TemplateManager) watchResources(interval time.Duration) {
+	var snap = tm.snapshotResources()
+	for range time.Tick(interval) {
+		var newSnap = tm.snapshotResources()
+		var changed = snap.changedResources(newSnap)
+		snap = newSnap
+		if len(changed) == 0 {
+			continue
+		}
+
+		var templatesChanged, staticChanged bool
+		for _, path := range changed {
+			if tm.isTemplatePath(path) {
+				templatesChanged = true
+			} else if strings.HasPrefix(path, filepath.Join(tm.resourceDir, "static")) {
+				staticChanged = true
+			}
+		}
+		if staticChanged {
+			log.Info("Static resources changed, rebuilding asset manifest")
+			tm.buildAssetManifest()
+		}
+		if templatesChanged {
+			log.Info("Templates changed, reloading")
+			tm.ParseTemplates(true)
+		}
+
+		tm.notifyListeners(changed[0])
+	}
+}
+
+func (tm *TemplateManager) isTemplatePath(path string) bool {
+	return strings.HasPrefix(path, filepath.Join(tm.resourceDir, "template")) ||
+		strings.HasPrefix(path, filepath.Join(tm.resourceDir, "include")) ||
+		strings.HasPrefix(path, filepath.Join(tm.resourceDir, "locale"))
+}
+
+// addListener registers a channel which will receive the path of a changed
+// resource file. The returned function must be called to remove the listener
+func (tm *TemplateManager) addListener() (ch chan string, remove func()) {
+	ch = make(chan string, 1)
+	tm.listenersMu.Lock()
+	tm.listeners[ch] = struct{}{}
+	tm.listenersMu.Unlock()
+
+	return ch, func() {
+		tm.listenersMu.Lock()
+		delete(tm.listeners, ch)
+		tm.listenersMu.Unlock()
+	}
+}
+
+func (tm *TemplateManager) notifyListeners(path string) {
+	tm.listenersMu.Lock()
+	defer tm.listenersMu.Unlock()
+	for ch := range tm.listeners {
+		// Don't block if the listener already has a pending notification, one
+		// reload is enough
+		select {
+		case ch <- path:
+		default:
+		}
+	}
+}
+
+// serveLiveReload is a server-sent events endpoint which sends a reload event
+// to the browser when a resource file changes. It's only registered in debug
+// mode
+func (wc *WebController) serveLiveReload(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var ch, remove = wc.templates.addListener()
+	defer remove()
+
+	var keepalive = time.NewTicker(time.Second * 30)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case path := <-ch:
+			fmt.Fprintf(w, "event: reload\ndata: %s\n\n", filepath.ToSlash(path))
+			flusher.Flush()
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"fornaxian.tech/log"
@@ -22,17 +24,23 @@ import (
 // the field Other you can pass your own template-specific variables.
 type TemplateData struct {
 	tpm           *TemplateManager
+	sessionKey    string // Set when the request carries a session cookie
+	realIP        string // Address of the visitor, passed on to the API
 	Authenticated bool
 	User          pixelapi.UserInfo
 	UserAgent     string
 	APIEndpoint   template.URL
 	PixelAPI      pixelapi.PixelAPI
+	Locale        *locale
 	Hostname      template.HTML
 
 	// Only used on file viewer page
 	Title  string
 	OGData ogData
 
+	// Only used on the filesystem viewer, to link to hosted sites
+	SitesDomain string
+
 	Other    interface{}
 	URLQuery url.Values
 
@@ -46,25 +54,28 @@ func (wc *WebController) newTemplateData(w http.ResponseWriter, r *http.Request)
 		Authenticated: false,
 		UserAgent:     r.UserAgent(),
 		APIEndpoint:   template.URL(wc.config.APIURLExternal),
+		realIP:        util.RemoteAddress(r),
 
 		// Use the user's IP address for making requests
 		PixelAPI: wc.api.RealIP(util.RemoteAddress(r)).RealAgent(r.UserAgent()),
 
 		Hostname: template.HTML(wc.hostname),
 		URLQuery: r.URL.Query(),
+		Locale:   wc.templates.localeFromRequest(r),
 	}
 
 	// If the user is authenticated we'll indentify him and put the user info
 	// into the templatedata. This is used for putting the username in the menu
 	// and stuff like that
 	if key, err := wc.getAPIKey(r); err == nil {
+		t.sessionKey = key
 		t.PixelAPI = t.PixelAPI.Login(key) // Use the user's API key for all requests
-		if t.User, err = t.PixelAPI.GetUser(); err != nil {
+		if t.User, err = wc.cache.user.get(key, t.PixelAPI.GetUser); err != nil {
 			// This session key doesn't work, or the backend is down, user
 			// cannot be authenticated
 			log.Debug("Session check for key '%s' failed: %s", key, err)
 
-			if err.Error() == "authentication_required" || err.Error() == "authentication_failed" {
+			if classifyError(err).status == http.StatusUnauthorized {
 				// Disable API authentication
 				t.PixelAPI = wc.api.RealIP(util.RemoteAddress(r)).RealAgent(r.UserAgent())
 
@@ -98,21 +109,65 @@ func (wc *WebController) newTemplateData(w http.ResponseWriter, r *http.Request)
 // TemplateManager parses templates and provides utility functions to the
 // templates' scripting language
 type TemplateManager struct {
-	tpl *template.Template
+	// The parsed template set. It's replaced as a whole when the templates are
+	// reloaded so requests which are running don't see a half-parsed set
+	tpl atomic.Pointer[templateSet]
+
+	// Content hashes of the static resources
+	assets atomic.Pointer[assetManifest]
+
+	// Clients which want to be notified when the resources change, used for
+	// reloading pages in debug mode
+	listeners   map[chan string]struct{}
+	listenersMu sync.Mutex
 
 	// Config
 	resourceDir         string
 	externalAPIEndpoint string
+	pathPrefix          string // Prefix of the routes on the router
 	debugModeEnabled    bool
 }
 
-// NewTemplateManager creates a new template manager
-func NewTemplateManager(resourceDir, externalAPIEndpoint string, debugMode bool) *TemplateManager {
-	return &TemplateManager{
+// templateSet contains a copy of the parsed templates for every locale. The
+// copies only differ in the template functions which depend on the locale
+type templateSet struct {
+	locales   map[string]*locale
+	templates map[string]*template.Template
+
+	// Markdown documents by template name
+	markdown map[string]*markdownPage
+
+	// Rendered markdown pages which don't depend on the request. Because the
+	// cache lives in the template set it's dropped when the templates are
+	// reloaded
+	rendered sync.Map
+
+	// Full-text index over the markdown pages
+	search *searchIndex
+
+	// Modification times of the template and include files by file name
+	modTimes map[string]time.Time
+
+	// Files of the templates which are defined in the template directory by
+	// template name. Include files are named after their file
+	templateFiles map[string]string
+}
+
+// NewTemplateManager creates a new template manager. In debug mode the resource
+// directory is watched and the templates are parsed again when they change
+func NewTemplateManager(resourceDir, externalAPIEndpoint, pathPrefix string, debugMode bool) *TemplateManager {
+	var tm = &TemplateManager{
+		listeners:           make(map[chan string]struct{}),
 		resourceDir:         resourceDir,
 		externalAPIEndpoint: externalAPIEndpoint,
+		pathPrefix:          pathPrefix,
 		debugModeEnabled:    debugMode,
 	}
+	tm.buildAssetManifest()
+	if debugMode {
+		go tm.watchResources(time.Second)
+	}
+	return tm
 }
 
 // ParseTemplates parses the templates in the template directory which is
@@ -126,21 +181,32 @@ func (tm *TemplateManager) ParseTemplates(silent bool) {
 	// Import template functions
 	tpl.Funcs(template.FuncMap{
 		"cacheID":        tm.cacheID,
+		"asset":          tm.asset,
+		"assetIntegrity": tm.assetIntegrity,
 		"debugMode":      tm.debugMode,
 		"apiUrl":         tm.apiURL,
+		"pathPrefix":     tm.prefix,
 		"pageNr":         tm.pageNr,
 		"add":            tm.add,
 		"sub":            tm.sub,
 		"mul":            tm.mul,
 		"div":            tm.div,
-		"formatData":     tm.formatData,
 		"formatDataBits": tm.formatDataBits,
-		"formatSC":       tm.formatSC,
 		"noescape":       tm.noEscape,
 		"noescapeJS":     tm.noEscapeJS,
 		"slashes":        tm.slashes,
+		"locales":        tm.localeNames,
 	})
 
+	// Placeholders for the locale functions, they're replaced for every locale
+	// after parsing
+	tpl.Funcs(tm.localeFuncs(&locale{Tag: defaultLocale}))
+
+	// Modification times of the template files by file name, used for the
+	// sitemap
+	var modTimes = make(map[string]time.Time)
+	var templateFiles = make(map[string]string)
+
 	// Parse dynamic templates
 	if err = filepath.Walk(tm.resourceDir+"/template", func(path string, f os.FileInfo, err error) error {
 		if f == nil || f.IsDir() {
@@ -148,6 +214,12 @@ func (tm *TemplateManager) ParseTemplates(silent bool) {
 		}
 
 		templatePaths = append(templatePaths, path)
+		modTimes[f.Name()] = f.ModTime()
+		if file, err := os.ReadFile(path); err == nil {
+			for _, match := range templateDefineRegex.FindAllSubmatch(file, -1) {
+				templateFiles[string(match[1])] = f.Name()
+			}
+		}
 		if !silent {
 			log.Info("Template found: %s", path)
 		}
@@ -161,6 +233,7 @@ func (tm *TemplateManager) ParseTemplates(silent bool) {
 
 	// Parse static resources
 	var file []byte
+	var markdown = make(map[string]*markdownPage)
 	if err = filepath.Walk(tm.resourceDir+"/include", func(path string, f os.FileInfo, err error) error {
 		if err != nil {
 			return fmt.Errorf("walk err: %w", err)
@@ -172,8 +245,19 @@ func (tm *TemplateManager) ParseTemplates(silent bool) {
 		if file, err = os.ReadFile(path); err != nil {
 			return err
 		}
+		modTimes[f.Name()] = f.ModTime()
+
+		if strings.HasSuffix(path, ".md") {
+			var page *markdownPage
+			page, file = parseFrontMatter(f.Name(), file)
+			markdown[f.Name()] = page
 
-		if strings.HasSuffix(path, ".png") {
+			// Documents which are not executed don't need to be parsed as
+			// templates
+			if page.NoExec {
+				return nil
+			}
+		} else if strings.HasSuffix(path, ".png") {
 			file = []byte("data:image/png;base64," + base64.StdEncoding.EncodeToString(file))
 		} else if strings.HasSuffix(path, ".gif") {
 			file = []byte("data:image/gif;base64," + base64.StdEncoding.EncodeToString(file))
@@ -197,18 +281,38 @@ func (tm *TemplateManager) ParseTemplates(silent bool) {
 		log.Error("Failed to parse templates: %s", err)
 	}
 
-	tm.tpl = tpl
+	// Make a copy of the templates for every locale. This needs to happen
+	// before the templates are executed for the first time
+	var set = &templateSet{
+		locales:   loadLocales(tm.resourceDir + "/locale"),
+		templates: make(map[string]*template.Template),
+		markdown:  markdown,
+		modTimes:  modTimes,
+
+		templateFiles: templateFiles,
+	}
+	for tag, l := range set.locales {
+		clone, err := tpl.Clone()
+		if err != nil {
+			log.Error("Failed to clone templates for locale '%s': %s", tag, err)
+			delete(set.locales, tag)
+			continue
+		}
+		set.templates[tag] = clone.Funcs(tm.localeFuncs(l))
+	}
+	set.search = tm.buildSearchIndex(set)
+
+	tm.tpl.Store(set)
 }
 
-// Run runs a template by name
+// Run runs a template by name. The template is executed with the locale of the
+// request
 func (tm *TemplateManager) Run(w io.Writer, r *http.Request, name string, data any) (err error) {
-	if tm.debugModeEnabled {
-		tm.ParseTemplates(true)
-	}
 	if r.Method == "HEAD" {
 		return nil
 	}
-	return tm.tpl.ExecuteTemplate(w, name, data)
+	var l = tm.localeFromRequest(r)
+	return tm.tpl.Load().templates[l.Tag].ExecuteTemplate(w, name, data)
 }
 
 // Template functions. These can be called from within the template to execute
@@ -228,6 +332,9 @@ func (tm *TemplateManager) debugMode() bool {
 func (tm *TemplateManager) apiURL() string {
 	return tm.externalAPIEndpoint
 }
+func (tm *TemplateManager) prefix() string {
+	return tm.pathPrefix
+}
 func (tm *TemplateManager) pageNr(s string) (nr int) {
 	// Atoi returns 0 on error, which is fine for page numbers
 	if nr, _ = strconv.Atoi(s); nr < 0 {
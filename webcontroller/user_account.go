@@ -1,7 +1,6 @@
 package webcontroller
 
 import (
-	"fmt"
 	"html/template"
 	"net/http"
 	"time"
@@ -14,7 +13,7 @@ import (
 // formAPIError makes it easier to display errors returned by the pixeldrain
 // API. TO make use of this function the form fields should be named exactly the
 // same as the API parameters
-func formAPIError(err error, f *Form) {
+func formAPIError(err error, f *Form, l *locale) {
 	fieldLabel := func(name string) string {
 		for _, v := range f.Fields {
 			if v.Name == name {
@@ -29,16 +28,16 @@ func formAPIError(err error, f *Form) {
 			for _, err := range apierr.Errors {
 				// Modify the message to make it more user-friendly
 				if err.StatusCode == "string_out_of_range" {
-					err.Message = fmt.Sprintf(
-						"%s is too long or too short. Should be between %v and %v characters. Current length: %v",
+					err.Message = l.T(
+						"form.error.string_out_of_range",
 						fieldLabel(err.Extra["field"].(string)),
 						err.Extra["min_len"],
 						err.Extra["max_len"],
 						err.Extra["len"],
 					)
 				} else if err.StatusCode == "field_contains_illegal_character" {
-					err.Message = fmt.Sprintf(
-						"Character '%v' is not allowed in %s",
+					err.Message = l.T(
+						"form.error.field_contains_illegal_character",
 						err.Extra["char"],
 						fieldLabel(err.Extra["field"].(string)),
 					)
@@ -51,7 +50,7 @@ func formAPIError(err error, f *Form) {
 		}
 	} else {
 		log.Error("Error submitting form: %s", err)
-		f.SubmitMessages = []template.HTML{"Internal Server Error"}
+		f.SubmitMessages = []template.HTML{l.HTML("form.error.internal")}
 	}
 }
 
@@ -65,6 +64,9 @@ func (wc *WebController) serveLogout(
 		if err = api.DeleteUserSession(key); err != nil {
 			log.Warn("logout failed for session '%s': %s", key, err)
 		}
+
+		// Make sure the deleted session can't be used from the cache anymore
+		wc.cache.user.invalidate(key)
 	}
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -77,10 +79,7 @@ func (wc *WebController) registerForm(td *TemplateData, r *http.Request) (f Form
 		capt, err := td.PixelAPI.GetMiscRecaptcha()
 		if err != nil {
 			log.Error("Error getting recaptcha key: %s", err)
-			f.SubmitMessages = []template.HTML{
-				"An internal server error had occurred. Registration is " +
-					"unavailable at the moment. Please return later",
-			}
+			f.SubmitMessages = []template.HTML{td.Locale.HTML("register.unavailable")}
 			return f
 		}
 		if capt.SiteKey == "" {
@@ -93,50 +92,41 @@ func (wc *WebController) registerForm(td *TemplateData, r *http.Request) (f Form
 	// Construct the form
 	f = Form{
 		Name:  "register",
-		Title: "Register a new pixeldrain account",
+		Title: td.Locale.T("register.title"),
 		Fields: []Field{
 			{
 				Name:        "username",
-				Label:       "Username",
-				Description: "used for logging into your account",
+				Label:       td.Locale.T("form.field.username"),
+				Description: td.Locale.HTML("register.username_description"),
 				Type:        FieldTypeUsername,
 			}, {
-				Name:  "email",
-				Label: "E-mail address",
-				Description: `not required. your e-mail address will only be
-					used for password resets and important account
-					notifications`,
-				Type: FieldTypeEmail,
+				Name:        "email",
+				Label:       td.Locale.T("form.field.email"),
+				Description: td.Locale.HTML("register.email_description"),
+				Type:        FieldTypeEmail,
 			}, {
 				Name:  "password",
-				Label: "Password",
+				Label: td.Locale.T("form.field.password"),
 				Type:  FieldTypeNewPassword,
 			}, {
-				Name:  "password2",
-				Label: "Password verification",
-				Description: "you need to enter your password twice so we " +
-					"can verify that no typing errors were made, which would " +
-					"prevent you from logging into your new account",
-				Type: FieldTypeNewPassword,
+				Name:        "password2",
+				Label:       td.Locale.T("form.field.password_verification"),
+				Description: td.Locale.HTML("form.password_verification_description"),
+				Type:        FieldTypeNewPassword,
 			}, {
-				Name:  "recaptcha_response",
-				Label: "reCaptcha",
-				Description: "the reCaptcha turing test verifies that you " +
-					"are not an evil robot that is trying to flood the " +
-					"website with fake accounts. Please click the white box " +
-					"to prove that you're not a robot",
+				Name:           "recaptcha_response",
+				Label:          td.Locale.T("form.field.recaptcha"),
+				Description:    td.Locale.HTML("register.recaptcha_description"),
 				Type:           FieldTypeCaptcha,
 				CaptchaSiteKey: wc.captchaKey(),
 			},
 		},
-		SubmitLabel: "Register",
+		SubmitLabel: td.Locale.T("register.submit"),
 	}
 
 	if f.ReadInput(r) {
 		if f.FieldVal("password") != f.FieldVal("password2") {
-			f.SubmitMessages = []template.HTML{
-				"Password verification failed. Please enter the same " +
-					"password in both password fields"}
+			f.SubmitMessages = []template.HTML{td.Locale.HTML("form.error.password_mismatch")}
 			return f
 		}
 		log.Debug("capt: %s", f.FieldVal("recaptcha_response"))
@@ -148,7 +138,7 @@ func (wc *WebController) registerForm(td *TemplateData, r *http.Request) (f Form
 			f.FieldVal("password"),
 			f.FieldVal("recaptcha_response"),
 		); err != nil {
-			formAPIError(err, &f)
+			formAPIError(err, &f, td.Locale)
 			return f
 		}
 
@@ -160,7 +150,7 @@ func (wc *WebController) registerForm(td *TemplateData, r *http.Request) (f Form
 		)
 		if err != nil {
 			log.Debug("Login failed: %s", err)
-			formAPIError(err, &f)
+			formAPIError(err, &f, td.Locale)
 			return
 		}
 
@@ -169,10 +159,7 @@ func (wc *WebController) registerForm(td *TemplateData, r *http.Request) (f Form
 
 		// Request was a success
 		f.SubmitSuccess = true
-		f.SubmitMessages = []template.HTML{
-			`Registration completed! You can now <a href="/login">log in ` +
-				`to your account</a>.<br/>We're glad to have you on ` +
-				`board, have fun sharing!`}
+		f.SubmitMessages = []template.HTML{td.Locale.HTML("register.success")}
 
 	}
 	return f
@@ -181,27 +168,20 @@ func (wc *WebController) registerForm(td *TemplateData, r *http.Request) (f Form
 func (wc *WebController) loginForm(td *TemplateData, r *http.Request) (f Form) {
 	f = Form{
 		Name:  "login",
-		Title: "Log in to your pixeldrain account",
+		Title: td.Locale.T("login.title"),
 		Fields: []Field{
 			{
 				Name:  "username",
-				Label: "Username",
+				Label: td.Locale.T("form.field.username"),
 				Type:  FieldTypeUsername,
 			}, {
 				Name:  "password",
-				Label: "Password",
+				Label: td.Locale.T("form.field.password"),
 				Type:  FieldTypeCurrentPassword,
 			},
 		},
-		SubmitLabel: "Login",
-		PostFormHTML: template.HTML(
-			`<p>If you don't have a pixeldrain account yet, you can ` +
-				`<a href="/register">register here</a>. No e-mail address is ` +
-				`required.</p>` +
-				`<p>Forgot your password? If your account has a valid e-mail ` +
-				`address you can <a href="/password_reset">request a new ` +
-				`password here</a>.</p>`,
-		),
+		SubmitLabel:  td.Locale.T("login.submit"),
+		PostFormHTML: td.Locale.HTML("login.post_form"),
 	}
 
 	// If the user is already logged in we redirect to the target page
@@ -218,11 +198,11 @@ func (wc *WebController) loginForm(td *TemplateData, r *http.Request) (f Form) {
 			"website login",
 		); err != nil {
 			log.Debug("Login failed: %s", err)
-			formAPIError(err, &f)
+			formAPIError(err, &f, td.Locale)
 		} else {
 			// Request was a success
 			f.SubmitSuccess = true
-			f.SubmitMessages = []template.HTML{"Success!"}
+			f.SubmitMessages = []template.HTML{td.Locale.HTML("login.success")}
 
 			// Set the autentication cookie
 			f.Extra.SetCookie = wc.sessionCookie(session)
@@ -263,24 +243,22 @@ func (wc *WebController) loginRedirect(r *http.Request) string {
 func (wc *WebController) passwordResetForm(td *TemplateData, r *http.Request) (f Form) {
 	f = Form{
 		Name:  "password_reset",
-		Title: "Recover lost password",
+		Title: td.Locale.T("password_reset.title"),
 		Fields: []Field{
 			{
-				Name:  "email",
-				Label: "E-mail address",
-				Description: `we will send a password reset link to this e-mail
-					address`,
-				Type: FieldTypeEmail,
+				Name:        "email",
+				Label:       td.Locale.T("form.field.email"),
+				Description: td.Locale.HTML("password_reset.email_description"),
+				Type:        FieldTypeEmail,
 			}, {
-				Name:  "recaptcha_response",
-				Label: "Turing test (click the white box)",
-				Description: "the reCaptcha turing test verifies that you " +
-					"are not an evil robot that is trying hijack accounts",
+				Name:           "recaptcha_response",
+				Label:          td.Locale.T("password_reset.recaptcha_label"),
+				Description:    td.Locale.HTML("password_reset.recaptcha_description"),
 				Type:           FieldTypeCaptcha,
 				CaptchaSiteKey: wc.captchaKey(),
 			},
 		},
-		SubmitLabel: "Submit",
+		SubmitLabel: td.Locale.T("form.submit"),
 	}
 
 	if f.ReadInput(r) {
@@ -288,12 +266,10 @@ func (wc *WebController) passwordResetForm(td *TemplateData, r *http.Request) (f
 			f.FieldVal("email"),
 			f.FieldVal("recaptcha_response"),
 		); err != nil {
-			formAPIError(err, &f)
+			formAPIError(err, &f, td.Locale)
 		} else {
 			f.SubmitSuccess = true
-			f.SubmitMessages = []template.HTML{
-				"Success! Check your inbox for instructions to reset your password",
-			}
+			f.SubmitMessages = []template.HTML{td.Locale.HTML("password_reset.success")}
 		}
 	}
 	return f
@@ -302,46 +278,40 @@ func (wc *WebController) passwordResetForm(td *TemplateData, r *http.Request) (f
 func (wc *WebController) passwordResetConfirmForm(td *TemplateData, r *http.Request) (f Form) {
 	f = Form{
 		Name:  "password_reset_confirm",
-		Title: "Reset lost password",
+		Title: td.Locale.T("password_reset_confirm.title"),
 		Fields: []Field{
 			{
 				Name:  "new_password",
-				Label: "Password",
+				Label: td.Locale.T("form.field.password"),
 				Type:  FieldTypeNewPassword,
 			}, {
-				Name:  "new_password2",
-				Label: "Password again",
-				Description: "you need to enter your password twice so we " +
-					"can verify that no typing errors were made, which would " +
-					"prevent you from logging into your new account",
-				Type: FieldTypeNewPassword,
+				Name:        "new_password2",
+				Label:       td.Locale.T("form.field.password_again"),
+				Description: td.Locale.HTML("form.password_verification_description"),
+				Type:        FieldTypeNewPassword,
 			},
 		},
-		SubmitLabel: "Submit",
+		SubmitLabel: td.Locale.T("form.submit"),
 	}
 
 	var resetKey = r.FormValue("key")
 	if resetKey == "" {
 		f.SubmitSuccess = false
-		f.SubmitMessages = []template.HTML{"Password reset key required"}
+		f.SubmitMessages = []template.HTML{td.Locale.HTML("password_reset_confirm.key_required")}
 		return f
 	}
 
 	if f.ReadInput(r) {
 		if f.FieldVal("new_password") != f.FieldVal("new_password2") {
-			f.SubmitMessages = []template.HTML{
-				"Password verification failed. Please enter the same " +
-					"password in both password fields"}
+			f.SubmitMessages = []template.HTML{td.Locale.HTML("form.error.password_mismatch")}
 			return f
 		}
 
 		if err := td.PixelAPI.PutUserPasswordResetConfirm(resetKey, f.FieldVal("new_password")); err != nil {
-			formAPIError(err, &f)
+			formAPIError(err, &f, td.Locale)
 		} else {
 			f.SubmitSuccess = true
-			f.SubmitMessages = []template.HTML{
-				`Success! You can now <a href="/login">log in</a> with your new password`,
-			}
+			f.SubmitMessages = []template.HTML{td.Locale.HTML("password_reset_confirm.success")}
 		}
 	}
 	return f
@@ -356,7 +326,7 @@ func (wc *WebController) serveEmailConfirm(
 	var status string
 
 	err = wc.api.PutUserEmailResetConfirm(r.FormValue("key"))
-	if err != nil && err.Error() == "not_found" {
+	if err != nil && classifyError(err).status == http.StatusNotFound {
 		status = "not_found"
 	} else if err != nil {
 		log.Debug("E-mail reset fail: %s", err)
@@ -1,10 +1,10 @@
 package webcontroller
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"html/template"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -16,18 +16,24 @@ import (
 	"fornaxian.tech/pixeldrain_api_client/pixelapi"
 	"fornaxian.tech/util"
 	"github.com/julienschmidt/httprouter"
-	blackfriday "github.com/russross/blackfriday/v2"
 )
 
 type Config struct {
-	APIURLExternal      string `toml:"api_url_external"`
-	APIURLInternal      string `toml:"api_url_internal"`
-	APISocketPath       string `toml:"api_socket_path"`
-	SessionCookieDomain string `toml:"session_cookie_domain"`
-	ResourceDir         string `toml:"resource_dir"`
-	DebugMode           bool   `toml:"debug_mode"`
-	ProxyAPIRequests    bool   `toml:"proxy_api_requests"`
-	MaintenanceMode     bool   `toml:"maintenance_mode"`
+	APIURLExternal      string   `toml:"api_url_external"`
+	APIURLInternal      string   `toml:"api_url_internal"`
+	APISocketPath       string   `toml:"api_socket_path"`
+	SessionCookieDomain string   `toml:"session_cookie_domain"`
+	ResourceDir         string   `toml:"resource_dir"`
+	DebugMode           bool     `toml:"debug_mode"`
+	ProxyAPIRequests    bool     `toml:"proxy_api_requests"`
+	MaintenanceMode     bool     `toml:"maintenance_mode"`
+	MaxViewerFiles      int      `toml:"max_viewer_files"`
+	AdminAPIKey         string   `toml:"admin_api_key"`
+	RobotsTxt           string   `toml:"robots_txt"`
+	CardCacheDir        string   `toml:"card_cache_dir"`
+	CrawlerUserAgents   []string `toml:"crawler_user_agents"`
+	DownloadUserAgents  []string `toml:"download_user_agents"`
+	SitesDomain         string   `toml:"sites_domain"`
 }
 
 // WebController controls how requests are handled and makes sure they have
@@ -42,12 +48,30 @@ type WebController struct {
 	// page-specific variables
 	captchaSiteKey string
 
+	// Public pages which are listed in the sitemap
+	sitemap []sitemapPage
+
 	httpClient *http.Client
 
 	// API client to use for all requests. If the user is authenticated you
 	// should call Login() on this object. Calling Login will create a copy and
 	// not alter the original PixelAPI, but it will use the same HTTP Transport
 	api pixelapi.PixelAPI
+
+	// HTTP client for API requests which the API client doesn't support, like
+	// range requests. It uses the API socket if one is configured
+	apiHTTPClient *http.Client
+
+	// Short-lived cache for the API lookups done on most page views
+	cache *apiCache
+
+	// Lowercase user agents of the bots which get the link preview page
+	// instead of the file viewer
+	crawlerAgents []string
+
+	// Lowercase user agents of the download tools which are redirected from
+	// the viewer pages to the download
+	downloadAgents []string
 }
 
 // New initializes a new WebController by registering all the request handlers
@@ -58,13 +82,49 @@ func New(r *httprouter.Router, prefix string, conf Config) (wc *WebController) {
 		config:     conf,
 		httpClient: &http.Client{Timeout: time.Minute * 10},
 		api:        pixelapi.New(conf.APIURLInternal),
+		cache:      newAPICache(),
+
+		apiHTTPClient: &http.Client{Timeout: time.Minute},
+	}
+
+	if conf.MaxViewerFiles <= 0 {
+		wc.config.MaxViewerFiles = 100
+	}
+
+	wc.crawlerAgents = lowerUserAgents(conf.CrawlerUserAgents)
+	if conf.CrawlerUserAgents == nil {
+		// Config files from before the option existed
+		wc.crawlerAgents = lowerUserAgents([]string{
+			"Discordbot", "Twitterbot", "Slackbot", "TelegramBot",
+			"facebookexternalhit", "WhatsApp", "Mastodon", "redditbot",
+			"LinkedInBot", "SkypeUriPreview", "vkShare", "Embedly",
+		})
+	}
+	wc.downloadAgents = lowerUserAgents(conf.DownloadUserAgents)
+	if conf.DownloadUserAgents == nil {
+		// Config files from before the option existed
+		wc.downloadAgents = []string{"wget/"}
+	}
+
+	if conf.CardCacheDir != "" {
+		if err = os.MkdirAll(conf.CardCacheDir, 0755); err != nil {
+			log.Error("Can't create card cache directory, cards will not be cached: %s", err)
+			wc.config.CardCacheDir = ""
+		} else {
+			go wc.cleanCardCache()
+		}
 	}
 
 	if conf.APISocketPath != "" {
 		wc.api = wc.api.UnixSocketPath(conf.APISocketPath)
+		wc.apiHTTPClient.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", conf.APISocketPath)
+			},
+		}
 	}
 
-	wc.templates = NewTemplateManager(conf.ResourceDir, conf.APIURLExternal, conf.DebugMode)
+	wc.templates = NewTemplateManager(conf.ResourceDir, conf.APIURLExternal, prefix, conf.DebugMode)
 	wc.templates.ParseTemplates(false)
 
 	if wc.hostname, err = os.Hostname(); err != nil {
@@ -72,20 +132,20 @@ func New(r *httprouter.Router, prefix string, conf Config) (wc *WebController) {
 	}
 
 	// Serve static files
-	var fs = http.FileServer(http.Dir(conf.ResourceDir + "/static"))
-	var resourceHandler = func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		// Cache resources for a year
-		w.Header().Set("Cache-Control", "public, max-age=31536000")
-		r.URL.Path = p.ByName("filepath")
-		fs.ServeHTTP(w, r)
-	}
+	var resourceHandler = wc.appOnly(wc.serveResource(http.FileServer(http.Dir(conf.ResourceDir + "/static"))))
 	r.HEAD(prefix+"/res/*filepath", resourceHandler)
 	r.OPTIONS(prefix+"/res/*filepath", resourceHandler)
 	r.GET(prefix+"/res/*filepath", resourceHandler)
 
 	// Static assets
-	r.GET(prefix+"/favicon.ico" /*  */, wc.serveFile("/favicon.ico"))
-	r.GET(prefix+"/robots.txt" /*   */, wc.serveFile("/robots.txt"))
+	r.GET(prefix+"/favicon.ico" /*  */, wc.appOnly(wc.serveFile("/favicon.ico")))
+	r.GET(prefix+"/robots.txt" /*   */, wc.appOnly(wc.serveRobotsTxt))
+	r.GET(prefix+"/sitemap.xml" /*  */, wc.appOnly(wc.serveSitemap))
+
+	// Tells the browser to reload the page when the resources change
+	if conf.DebugMode {
+		r.GET(prefix+"/debug/live_reload", wc.appOnly(wc.serveLiveReload))
+	}
 
 	if conf.MaintenanceMode {
 		r.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -105,12 +165,12 @@ func New(r *httprouter.Router, prefix string, conf Config) (wc *WebController) {
 		var prox = httputil.NewSingleHostReverseProxy(remoteURL)
 		prox.Transport = wc.httpClient.Transport
 
-		var proxyHandler = func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		var proxyHandler = wc.appOnly(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 			log.Info("Proxying request to %s", r.URL)
 			r.Host = remoteURL.Host
 			r.Header.Set("Origin", remoteURL.String())
 			prox.ServeHTTP(w, r)
-		}
+		})
 
 		r.Handle("OPTIONS", "/api/*p", proxyHandler)
 		r.Handle("POST", "/api/*p", proxyHandler)
@@ -125,95 +185,148 @@ func New(r *httprouter.Router, prefix string, conf Config) (wc *WebController) {
 	// Request method shorthands. These help keep the array of handlers aligned
 	const PST, GET = "POST", "GET"
 
-	// Loop over the handlers and register all of them in the router
+	// Loop over the handlers and register all of them in the router. Public
+	// pages set the sitemap field to the name of their template, which is
+	// used for the modification date in the sitemap
 	for _, h := range []struct {
 		method  string            // HTTP request method this API handler uses
 		path    string            // The URL path this API will be registered on
 		handler httprouter.Handle // The function to run when this API is called
+		sitemap string            // Template of a page which is listed in the sitemap
 	}{
 		// General navigation
-		{GET, "" /*                */, wc.serveLandingPage()},
-		{GET, "home" /*            */, wc.serveTemplate("home", handlerOpts{})},
-		{GET, "api" /*             */, wc.serveMarkdown("api.md", handlerOpts{})},
-		{GET, "history" /*         */, wc.serveTemplate("upload_history", handlerOpts{})},
-		{GET, "u/:id" /*           */, wc.serveFileViewer},
-		{GET, "u/:id/preview" /*   */, wc.serveFilePreview},
-		{GET, "l/:id" /*           */, wc.serveListViewer},
-		{GET, "d/*path" /*         */, wc.serveDirectory},
-		{GET, "t" /*               */, wc.serveTemplate("text_upload", handlerOpts{})},
-		{GET, "donation" /*        */, wc.serveMarkdown("donation.md", handlerOpts{})},
-		{GET, "widgets" /*         */, wc.serveTemplate("widgets", handlerOpts{})},
-		{GET, "about" /*           */, wc.serveMarkdown("about.md", handlerOpts{})},
-		{GET, "appearance" /*      */, wc.serveTemplate("appearance", handlerOpts{})},
-		{GET, "hosting" /*         */, wc.serveMarkdown("hosting.md", handlerOpts{})},
-		{GET, "acknowledgements" /**/, wc.serveMarkdown("acknowledgements.md", handlerOpts{})},
-		{GET, "business" /*        */, wc.serveMarkdown("business.md", handlerOpts{})},
-		{GET, "limits" /*          */, wc.serveMarkdown("limits.md", handlerOpts{})},
-		{GET, "abuse" /*           */, wc.serveMarkdown("abuse.md", handlerOpts{})},
-		{GET, "filesystem" /*      */, wc.serveMarkdown("filesystem.md", handlerOpts{})},
-		{GET, "100_gigabit_ethernet", wc.serveMarkdown("100_gigabit_ethernet.md", handlerOpts{NoExec: true})},
-		{GET, "apps" /*            */, wc.serveTemplate("apps", handlerOpts{})},
-		{GET, "speedtest" /*       */, wc.serveTemplate("speedtest", handlerOpts{})},
+		{GET, "" /*                  */, wc.serveLandingPage(), "home"},
+		{GET, "home" /*              */, wc.serveTemplate("home", handlerOpts{}), ""},
+		{GET, "history" /*           */, wc.serveTemplate("upload_history", handlerOpts{}), ""},
+		{GET, "u/:id" /*             */, wc.serveFileViewer, ""},
+		{GET, "u/:id/preview" /*     */, wc.serveFilePreview, ""},
+		{GET, "u/:id/archive.json" /**/, wc.serveArchiveListing, ""},
+		{GET, "u/:id/card.png" /*    */, wc.serveFileCard, ""},
+		{GET, "u/:id/player" /*      */, wc.serveFilePlayer, ""},
+		{GET, "l/:id" /*             */, wc.serveListViewer, ""},
+		{GET, "l/:id/card.png" /*    */, wc.serveListCard, ""},
+		{GET, "l/:id/feed.xml" /*    */, wc.serveListFeed, ""},
+		{GET, siteRoute /*           */, wc.serveDirectory, ""},
+		{GET, "t" /*                 */, wc.serveTemplate("text_upload", handlerOpts{}), "text_upload"},
+		{GET, "widgets" /*           */, wc.serveTemplate("widgets", handlerOpts{}), "widgets"},
+		{GET, "appearance" /*        */, wc.serveTemplate("appearance", handlerOpts{}), "appearance"},
+		{GET, "apps" /*              */, wc.serveTemplate("apps", handlerOpts{}), "apps"},
+		{GET, "speedtest" /*         */, wc.serveTemplate("speedtest", handlerOpts{}), "speedtest"},
+		{GET, "search" /*            */, wc.serveSearch, ""},
+		{GET, "search.json" /*       */, wc.serveSearchJSON, ""},
 
 		// User account pages
-		{GET, "register" /*         */, wc.serveForm(wc.registerForm, handlerOpts{NoEmbed: true})},
-		{PST, "register" /*         */, wc.serveForm(wc.registerForm, handlerOpts{NoEmbed: true})},
-		{GET, "login" /*            */, wc.serveForm(wc.loginForm, handlerOpts{NoEmbed: true})},
-		{PST, "login" /*            */, wc.serveForm(wc.loginForm, handlerOpts{NoEmbed: true})},
-		{GET, "password_reset" /*   */, wc.serveForm(wc.passwordResetForm, handlerOpts{NoEmbed: true})},
-		{PST, "password_reset" /*   */, wc.serveForm(wc.passwordResetForm, handlerOpts{NoEmbed: true})},
-		{GET, "logout" /*           */, wc.serveTemplate("logout", handlerOpts{Auth: true, NoEmbed: true})},
-		{PST, "logout" /*           */, wc.serveLogout},
-		{GET, "user/filemanager" /* */, wc.serveTemplate("file_manager", handlerOpts{Auth: true})},
-		{GET, "user/export/files" /**/, wc.serveUserExportFiles},
-		{GET, "user/export/lists" /**/, wc.serveUserExportLists},
+		{GET, "register" /*         */, wc.serveForm(wc.registerForm, handlerOpts{NoEmbed: true}), ""},
+		{PST, "register" /*         */, wc.serveForm(wc.registerForm, handlerOpts{NoEmbed: true}), ""},
+		{GET, "login" /*            */, wc.serveForm(wc.loginForm, handlerOpts{NoEmbed: true}), ""},
+		{PST, "login" /*            */, wc.serveForm(wc.loginForm, handlerOpts{NoEmbed: true}), ""},
+		{GET, "password_reset" /*   */, wc.serveForm(wc.passwordResetForm, handlerOpts{NoEmbed: true}), ""},
+		{PST, "password_reset" /*   */, wc.serveForm(wc.passwordResetForm, handlerOpts{NoEmbed: true}), ""},
+		{GET, "logout" /*           */, wc.serveTemplate("logout", handlerOpts{Auth: true, NoEmbed: true}), ""},
+		{PST, "logout" /*           */, wc.serveLogout, ""},
+		{GET, "user/filemanager" /*  */, wc.serveTemplate("file_manager", handlerOpts{Auth: true}), ""},
+		{GET, "user/export/files" /**/, wc.serveUserExportFiles, ""},
+		{GET, "user/export/lists" /**/, wc.serveUserExportLists, ""},
 
 		// User account settings
-		{GET, "user" /*                       */, wc.serveTemplate("user_home", handlerOpts{Auth: true})},
-		{GET, "user/home" /*                  */, wc.serveTemplate("user_home", handlerOpts{Auth: true})},
-		{GET, "user/settings" /*              */, wc.serveTemplate("user_home", handlerOpts{Auth: true})},
-		{GET, "user/sharing" /*               */, wc.serveTemplate("user_home", handlerOpts{Auth: true})},
-		{GET, "user/sharing/*p" /*            */, wc.serveTemplate("user_home", handlerOpts{Auth: true})},
-		{GET, "user/api_keys" /*              */, wc.serveTemplate("user_home", handlerOpts{Auth: true})},
-		{GET, "user/activity" /*              */, wc.serveTemplate("user_home", handlerOpts{Auth: true})},
-		{GET, "user/connect_app" /*           */, wc.serveTemplate("user_home", handlerOpts{Auth: true})},
-		{GET, "user/transactions" /*          */, wc.serveTemplate("user_home", handlerOpts{Auth: true})},
-		{GET, "user/subscription" /*          */, wc.serveTemplate("user_home", handlerOpts{Auth: true})},
-		{GET, "user/prepaid" /*               */, wc.serveTemplate("user_home", handlerOpts{Auth: true})},
-		{GET, "user/prepaid/*p" /*            */, wc.serveTemplate("user_home", handlerOpts{Auth: true})},
-		{GET, "user/confirm_email" /*         */, wc.serveEmailConfirm},
-		{GET, "user/password_reset_confirm" /**/, wc.serveForm(wc.passwordResetConfirmForm, handlerOpts{NoEmbed: true})},
-		{PST, "user/password_reset_confirm" /**/, wc.serveForm(wc.passwordResetConfirmForm, handlerOpts{NoEmbed: true})},
+		{GET, "user" /*                       */, wc.serveTemplate("user_home", handlerOpts{Auth: true}), ""},
+		{GET, "user/home" /*                  */, wc.serveTemplate("user_home", handlerOpts{Auth: true}), ""},
+		{GET, "user/settings" /*              */, wc.serveTemplate("user_home", handlerOpts{Auth: true}), ""},
+		{GET, "user/sharing" /*               */, wc.serveTemplate("user_home", handlerOpts{Auth: true}), ""},
+		{GET, "user/sharing/*p" /*            */, wc.serveTemplate("user_home", handlerOpts{Auth: true}), ""},
+		{GET, "user/api_keys" /*              */, wc.serveTemplate("user_home", handlerOpts{Auth: true}), ""},
+		{GET, "user/activity" /*              */, wc.serveTemplate("user_home", handlerOpts{Auth: true}), ""},
+		{GET, "user/connect_app" /*           */, wc.serveTemplate("user_home", handlerOpts{Auth: true}), ""},
+		{GET, "user/transactions" /*          */, wc.serveTemplate("user_home", handlerOpts{Auth: true}), ""},
+		{GET, "user/subscription" /*          */, wc.serveTemplate("user_home", handlerOpts{Auth: true}), ""},
+		{GET, "user/prepaid" /*               */, wc.serveTemplate("user_home", handlerOpts{Auth: true}), ""},
+		{GET, "user/prepaid/*p" /*            */, wc.serveTemplate("user_home", handlerOpts{Auth: true}), ""},
+		{GET, "user/confirm_email" /*         */, wc.serveEmailConfirm, ""},
+		{GET, "user/password_reset_confirm" /**/, wc.serveForm(wc.passwordResetConfirmForm, handlerOpts{NoEmbed: true}), ""},
+		{PST, "user/password_reset_confirm" /**/, wc.serveForm(wc.passwordResetConfirmForm, handlerOpts{NoEmbed: true}), ""},
 
 		// Admin settings
-		{GET, "admin" /*                   */, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/status" /*            */, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/block_files" /*       */, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/email_reporters" /*   */, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/abuse_reports" /*     */, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/ip_bans" /*           */, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/user_bans" /*         */, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/user_management" /*   */, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/mollie_settlements" /**/, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/paypal_taxes" /*      */, wc.serveTemplate("admin", handlerOpts{Auth: true})},
-		{GET, "admin/globals" /*           */, wc.serveForm(wc.adminGlobalsForm, handlerOpts{Auth: true})},
-		{PST, "admin/globals" /*           */, wc.serveForm(wc.adminGlobalsForm, handlerOpts{Auth: true})},
+		{GET, "admin" /*                   */, wc.serveTemplate("admin", handlerOpts{Auth: true}), ""},
+		{GET, "admin/status" /*            */, wc.serveTemplate("admin", handlerOpts{Auth: true}), ""},
+		{GET, "admin/block_files" /*       */, wc.serveTemplate("admin", handlerOpts{Auth: true}), ""},
+		{GET, "admin/email_reporters" /*   */, wc.serveTemplate("admin", handlerOpts{Auth: true}), ""},
+		{GET, "admin/abuse_reports" /*     */, wc.serveTemplate("admin", handlerOpts{Auth: true}), ""},
+		{GET, "admin/ip_bans" /*           */, wc.serveTemplate("admin", handlerOpts{Auth: true}), ""},
+		{GET, "admin/user_bans" /*         */, wc.serveTemplate("admin", handlerOpts{Auth: true}), ""},
+		{GET, "admin/user_management" /*   */, wc.serveTemplate("admin", handlerOpts{Auth: true}), ""},
+		{GET, "admin/mollie_settlements" /**/, wc.serveTemplate("admin", handlerOpts{Auth: true}), ""},
+		{GET, "admin/paypal_taxes" /*      */, wc.serveTemplate("admin", handlerOpts{Auth: true}), ""},
+		{GET, "admin/globals" /*           */, wc.serveForm(wc.adminGlobalsForm, handlerOpts{Auth: true}), ""},
+		{PST, "admin/globals" /*           */, wc.serveForm(wc.adminGlobalsForm, handlerOpts{Auth: true}), ""},
+		{GET, "admin/cache_stats" /*       */, wc.serveCacheStats, ""},
 
 		// Misc
-		{GET, "misc/sharex/pixeldrain.com.sxcu", wc.serveShareXConfig},
-		{GET, "theme.css", wc.themeHandler},
+		{GET, "misc/sharex/pixeldrain.com.sxcu", wc.serveShareXConfig, ""},
+		{GET, "theme.css", wc.themeHandler, ""},
+		{GET, "locale", wc.serveSetLocale, ""},
+		{GET, "oembed", wc.serveOEmbed, ""},
 	} {
-		r.Handle(h.method, prefix+"/"+h.path, middleware(h.handler))
+		// The sites domain only serves the hosted sites
+		var handle = middleware(h.handler)
+		if h.path != siteRoute {
+			handle = wc.appOnly(handle)
+		}
+
+		r.Handle(h.method, prefix+"/"+h.path, handle)
 
 		// Also support HEAD requests
 		if h.method == GET {
-			r.HEAD(prefix+"/"+h.path, middleware(h.handler))
+			r.HEAD(prefix+"/"+h.path, handle)
+		}
+
+		if h.sitemap != "" {
+			wc.sitemap = append(wc.sitemap, sitemapPage{path: h.path, template: h.sitemap})
+		}
+	}
+
+	// Markdown pages are registered based on the front matter of the
+	// documents. Pages which are added after startup need a restart before
+	// they get a URL. A page with a bad path is skipped, a mistake in a
+	// document should not take the whole website down
+	var pagePaths = make(map[string]string)
+	for _, page := range wc.templates.markdownPages() {
+		if other, ok := pagePaths[page.Path]; ok {
+			log.Error("Markdown page '%s' has the same path as '%s', it will not be served", page.Template, other)
+			continue
+		} else if err := registerPage(r, prefix+"/"+page.Path, wc.appOnly(middleware(wc.serveMarkdown(page.Template)))); err != nil {
+			log.Error("Can't register markdown page '%s' on path '%s': %s", page.Template, page.Path, err)
+			continue
+		}
+		pagePaths[page.Path] = page.Template
+
+		if !page.Auth {
+			wc.sitemap = append(wc.sitemap, sitemapPage{path: page.Path, template: page.Template})
 		}
 	}
 
 	return wc
 }
 
+// registerPage registers the GET and HEAD routes of a markdown page. The router
+// panics when a path conflicts with an existing route, the panic is returned as
+// an error instead
+func registerPage(r *httprouter.Router, path string, handle httprouter.Handle) (err error) {
+	if strings.ContainsAny(path, ":*") {
+		return errors.New("wildcards are not allowed in page paths")
+	} else if strings.HasSuffix(path, "/") || strings.Contains(path, "//") {
+		return errors.New("page path is empty or has empty elements")
+	}
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%v", rec)
+		}
+	}()
+	r.GET(path, handle)
+	r.HEAD(path, handle)
+	return nil
+}
+
 func middleware(handle httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		// Redirect the user to the correct domain
@@ -235,7 +348,6 @@ func middleware(handle httprouter.Handle) httprouter.Handle {
 type handlerOpts struct {
 	Auth    bool
 	NoEmbed bool
-	NoExec  bool
 }
 
 func (wc *WebController) serveLandingPage() httprouter.Handle {
@@ -273,77 +385,6 @@ func (wc *WebController) serveTemplate(tpl string, opts handlerOpts) httprouter.
 	}
 }
 
-func (wc *WebController) serveMarkdown(tpl string, opts handlerOpts) httprouter.Handle {
-	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		var err error
-		if opts.NoEmbed {
-			w.Header().Set("X-Frame-Options", "DENY")
-		}
-
-		var tpld = wc.newTemplateData(w, r)
-		if opts.Auth && !tpld.Authenticated {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
-		}
-
-		// Execute the raw markdown template and save the result in a buffer
-		var tplBuf bytes.Buffer
-		err = wc.templates.Run(&tplBuf, r, tpl, tpld)
-		if err != nil && !util.IsNetError(err) {
-			log.Error("Error executing template '%s': %s", tpl, err)
-			return
-		}
-
-		// Parse the markdown document and save the resulting HTML in a buffer
-		renderer := blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
-			Flags: blackfriday.CommonHTMLFlags | blackfriday.TOC,
-		})
-
-		// We parse the markdown document, walk through the nodes. Extract the
-		// title of the document, and the rest of the nodes are rendered like
-		// normal
-		var mdBuf bytes.Buffer
-
-		blackfriday.New(
-			blackfriday.WithRenderer(renderer),
-			blackfriday.WithExtensions(blackfriday.CommonExtensions|blackfriday.AutoHeadingIDs),
-		).Parse(
-			tplBuf.Bytes(),
-		).Walk(func(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
-			// Capture the title of the document so we can put it at the top of
-			// the template and in the metadata. When entering a h1 node the
-			// first child will be the title of the document. Save that value
-			if node.Type == blackfriday.Heading && node.HeadingData.Level == 1 {
-				tpld.Title = string(node.FirstChild.Literal)
-				return blackfriday.SkipChildren
-			}
-
-			// If this text node contains solely the text "[TOC]" then we render
-			// the table of contents
-			if node.Type == blackfriday.Text && bytes.Equal(node.Literal, []byte("[TOC]")) {
-				// Find the document node and render its TOC
-				for parent := node.Parent; ; parent = parent.Parent {
-					if parent.Type == blackfriday.Document {
-						renderer.RenderHeader(&mdBuf, parent)
-						return blackfriday.SkipChildren
-					}
-				}
-			}
-
-			return renderer.RenderNode(&mdBuf, node, entering)
-		})
-
-		// Pass the buffer's parsed contents to the wrapper template
-		tpld.Other = template.HTML(mdBuf.Bytes())
-
-		// Execute the wrapper template
-		err = wc.templates.Run(w, r, "markdown_wrapper", tpld)
-		if err != nil && !util.IsNetError(err) {
-			log.Error("Error executing template '%s': %s", tpl, err)
-		}
-	}
-}
-
 func (wc *WebController) serveFile(path string) httprouter.Handle {
 	return func(
 		w http.ResponseWriter,
@@ -420,19 +461,16 @@ func (wc *WebController) serveForm(
 }
 
 func (wc *WebController) serveForbidden(w http.ResponseWriter, r *http.Request) {
-	log.Debug("Forbidden: %s", r.URL)
-	w.WriteHeader(http.StatusForbidden)
-	wc.templates.Run(w, r, "403", wc.newTemplateData(w, r))
+	wc.serveError(w, r, nil, errorFor(http.StatusForbidden, nil))
 }
 
 func (wc *WebController) serveNotFound(w http.ResponseWriter, r *http.Request) {
-	log.Debug("Not Found: %s", r.URL)
-	w.WriteHeader(http.StatusNotFound)
-	wc.templates.Run(w, r, "404", wc.newTemplateData(w, r))
-}
-func (wc *WebController) serveUnavailableForLegalReasons(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusUnavailableForLegalReasons)
-	wc.templates.Run(w, r, "451", wc.newTemplateData(w, r))
+	if wc.isSiteRequest(r) {
+		setSiteHeaders(w)
+		http.NotFound(w, r)
+		return
+	}
+	wc.serveError(w, r, nil, errorFor(http.StatusNotFound, nil))
 }
 
 func (wc *WebController) getAPIKey(r *http.Request) (key string, err error) {